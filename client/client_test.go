@@ -136,6 +136,7 @@ func testMissing(t *testing.T, client *GitlabNetClient) {
 	t.Run("Missing error for GET", func(t *testing.T) {
 		response, err := client.Get(context.Background(), "/missing")
 		require.EqualError(t, err, "Internal API error (404)")
+		require.Equal(t, http.StatusNotFound, err.(*APIError).StatusCode)
 		require.Nil(t, response)
 	})
 
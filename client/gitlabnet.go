@@ -40,6 +40,8 @@ type GitlabNetClient struct {
 // APIError represents an API error
 type APIError struct {
 	Msg string
+	// StatusCode is the HTTP status code of the response, it's zero if the API is unreachable
+	StatusCode int
 }
 
 // OriginalRemoteIPContextKey is used as the key in a Context to set an X-Forwarded-For header in a request
@@ -111,7 +113,7 @@ func newRequest(ctx context.Context, method, host, path string, data interface{}
 
 func parseError(resp *http.Response, respErr error) error {
 	if resp == nil || respErr != nil {
-		return &APIError{"Internal API unreachable"}
+		return &APIError{Msg: "Internal API unreachable"}
 	}
 
 	if resp.StatusCode >= 200 && resp.StatusCode <= 399 {
@@ -121,9 +123,9 @@ func parseError(resp *http.Response, respErr error) error {
 	parsedResponse := &ErrorResponse{}
 
 	if err := json.NewDecoder(resp.Body).Decode(parsedResponse); err != nil {
-		return &APIError{fmt.Sprintf("Internal API error (%v)", resp.StatusCode)}
+		return &APIError{Msg: fmt.Sprintf("Internal API error (%v)", resp.StatusCode), StatusCode: resp.StatusCode}
 	}
-	return &APIError{parsedResponse.Message}
+	return &APIError{Msg: parsedResponse.Message, StatusCode: resp.StatusCode}
 }
 
 // Get makes a GET request
@@ -14,8 +14,10 @@ import (
 	pb "gitlab.com/gitlab-org/gitaly/v16/proto/go/gitalypb"
 	"gitlab.com/gitlab-org/labkit/log"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials/insecure"
 	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 )
 
 type TestGitalyServer struct {
@@ -67,6 +69,44 @@ func (s *TestGitalyServer) SSHUploadArchive(stream pb.SSHService_SSHUploadArchiv
 	return stream.Send(&pb.SSHUploadArchiveResponse{Stdout: response})
 }
 
+// TestReadmeContent is the content of README.md in the tree served by the test Gitaly server
+const TestReadmeContent = "# Project\n\nThis is a test project.\n"
+
+// testCommitServer serves a tree with README.md and a doc directory at the "main" revision
+type testCommitServer struct {
+	pb.UnimplementedCommitServiceServer
+}
+
+func (s *testCommitServer) GetTreeEntries(req *pb.GetTreeEntriesRequest, stream pb.CommitService_GetTreeEntriesServer) error {
+	if string(req.Revision) != "main" || string(req.Path) != "." {
+		return status.Error(codes.NotFound, "not found")
+	}
+
+	return stream.Send(&pb.GetTreeEntriesResponse{Entries: []*pb.TreeEntry{
+		{Oid: "3b18e512dba79e4c8300dd08aeb37f8e728b8dad", Path: []byte("doc"), Type: pb.TreeEntry_TREE, Mode: 0o40000},
+		{Oid: "8ab686eafeb1f44702738c8b0f24f2567c36da6d", Path: []byte("README.md"), Type: pb.TreeEntry_BLOB, Mode: 0o100644},
+	}})
+}
+
+func (s *testCommitServer) TreeEntry(req *pb.TreeEntryRequest, stream pb.CommitService_TreeEntryServer) error {
+	if string(req.Revision) != "main" {
+		return status.Error(codes.NotFound, "not found")
+	}
+
+	switch string(req.Path) {
+	case "README.md":
+		half := len(TestReadmeContent) / 2
+		if err := stream.Send(&pb.TreeEntryResponse{Type: pb.TreeEntryResponse_BLOB, Size: int64(len(TestReadmeContent)), Mode: 0o100644, Data: []byte(TestReadmeContent[:half])}); err != nil {
+			return err
+		}
+		return stream.Send(&pb.TreeEntryResponse{Data: []byte(TestReadmeContent[half:])})
+	case "doc":
+		return stream.Send(&pb.TreeEntryResponse{Type: pb.TreeEntryResponse_TREE, Mode: 0o40000})
+	default:
+		return status.Error(codes.NotFound, "not found")
+	}
+}
+
 func StartGitalyServer(t *testing.T, network string) (string, *TestGitalyServer) {
 	t.Helper()
 
@@ -114,6 +154,7 @@ func doStartTestServer(t *testing.T, network string, path string) (string, *Test
 
 	testServer := TestGitalyServer{}
 	pb.RegisterSSHServiceServer(server, &testServer)
+	pb.RegisterCommitServiceServer(server, &testCommitServer{})
 
 	go func() {
 		require.NoError(t, server.Serve(listener))
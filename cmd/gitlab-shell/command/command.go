@@ -3,6 +3,7 @@ package command
 
 import (
 	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/command"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/command/browse"
 	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/command/commandargs"
 	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/command/discover"
 	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/command/lfsauthenticate"
@@ -129,6 +130,8 @@ func Build(args *commandargs.Shell, config *config.Config, readWriter *readwrite
 		return &uploadpack.Command{Config: config, Args: args, ReadWriter: readWriter}
 	case commandargs.UploadArchive:
 		return &uploadarchive.Command{Config: config, Args: args, ReadWriter: readWriter}
+	case commandargs.Browse:
+		return &browse.Command{Config: config, Args: args, ReadWriter: readWriter}
 	case commandargs.PersonalAccessToken:
 		if config.PATConfig.Enabled {
 			return &personalaccesstoken.Command{Config: config, Args: args, ReadWriter: readWriter}
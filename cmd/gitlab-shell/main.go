@@ -17,6 +17,7 @@ import (
 	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/config"
 	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/console"
 	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/executable"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/handler"
 	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/logger"
 	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/sshenv"
 )
@@ -76,6 +77,9 @@ func main() {
 		if grpcstatus.Convert(err).Code() != grpccodes.Internal {
 			console.DisplayWarningMessage(err.Error(), readWriter.ErrOut)
 		}
+		if handler.IsLimitError(err) {
+			os.Exit(handler.LimitErrorExitStatus)
+		}
 		os.Exit(1)
 	}
 
@@ -4,6 +4,7 @@ package main
 import (
 	"context"
 	"flag"
+	"fmt"
 	"os"
 	"os/signal"
 	"syscall"
@@ -47,22 +48,9 @@ func main() {
 
 	flag.Parse()
 
-	cfg := new(config.Config)
-	if *configDir != "" {
-		var err error
-		cfg, err = config.NewFromDir(*configDir)
-		if err != nil {
-			log.WithError(err).Fatal("failed to load configuration from specified directory")
-		}
-	}
-
-	overrideConfigFromEnvironment(cfg)
-	if err := cfg.IsSane(); err != nil {
-		if *configDir == "" {
-			log.WithError(err).Fatal("no config-dir provided, using only environment variables")
-		} else {
-			log.WithError(err).Fatal("configuration error")
-		}
+	cfg, err := loadConfig()
+	if err != nil {
+		log.WithError(err).Fatal("configuration error")
 	}
 
 	cfg.ApplyGlobalState()
@@ -96,11 +84,97 @@ func main() {
 
 	gracefulShutdown(ctx, done, cfg, server, cancel)
 
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+
+	reloadOnSignal(ctx, reload, server)
+
+	upgrade := make(chan os.Signal, 1)
+	signal.Notify(upgrade, syscall.SIGUSR2)
+
+	upgradeOnSignal(ctx, upgrade, done, server)
+
 	if err := server.ListenAndServe(ctx); err != nil {
 		log.WithError(err).Fatal("GitLab built-in sshd failed to listen for new connections")
 	}
 }
 
+func loadConfig() (*config.Config, error) {
+	cfg := &config.Config{Gitaly: config.DefaultGitalyConfig}
+	if *configDir != "" {
+		var err error
+		cfg, err = config.NewFromDir(*configDir)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load configuration from specified directory: %w", err)
+		}
+	}
+
+	overrideConfigFromEnvironment(cfg)
+	cfg.ConfigureGitalyClient()
+	if err := cfg.IsSane(); err != nil {
+		if *configDir == "" {
+			return nil, fmt.Errorf("no config-dir provided, using only environment variables: %w", err)
+		}
+
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+func reloadOnSignal(ctx context.Context, reload chan os.Signal, server *sshd.Server) {
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case sig := <-reload:
+				ctxlog := log.WithContextFields(ctx, log.Fields{"signal": sig.String()})
+				ctxlog.Info("Reload initiated")
+
+				cfg, err := loadConfig()
+				if err != nil {
+					ctxlog.WithError(err).Error("Failed to reload configuration, keeping the current one")
+					continue
+				}
+
+				if err := server.Reload(cfg); err != nil {
+					ctxlog.WithError(err).Error("Failed to reload server configuration, keeping the current one")
+					continue
+				}
+
+				ctxlog.Info("Reload completed")
+			}
+		}
+	}()
+}
+
+// upgradeOnSignal starts the new binary with the listening sockets, and shuts
+// the server down gracefully once the new process accepts connections
+func upgradeOnSignal(ctx context.Context, upgrade chan os.Signal, done chan os.Signal, server *sshd.Server) {
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case sig := <-upgrade:
+				ctxlog := log.WithContextFields(ctx, log.Fields{"signal": sig.String()})
+				ctxlog.Info("Upgrade initiated")
+
+				if err := server.Upgrade(ctx); err != nil {
+					ctxlog.WithError(err).Error("Upgrade failed, keeping the current process")
+					continue
+				}
+
+				ctxlog.Info("Upgrade completed, draining the sessions")
+				done <- sig
+
+				return
+			}
+		}
+	}()
+}
+
 func gracefulShutdown(ctx context.Context, done chan os.Signal, cfg *config.Config, server *sshd.Server, cancel context.CancelFunc) {
 	go func() {
 		sig := <-done
@@ -113,7 +187,14 @@ func gracefulShutdown(ctx context.Context, done chan os.Signal, cfg *config.Conf
 			log.WithError(err).Fatal("Error shutting down the server")
 		}
 
-		<-time.After(gracePeriod)
+		drainCtx, drainCancel := context.WithTimeout(ctx, gracePeriod)
+		defer drainCancel()
+
+		if server.WaitForSessions(drainCtx) {
+			log.WithContextFields(ctx, log.Fields{"signal": sig.String()}).Info("All sessions completed")
+		} else {
+			log.WithContextFields(ctx, log.Fields{"signal": sig.String()}).Warn("Grace period expired, terminating the remaining sessions")
+		}
 
 		cancel()
 	}()
@@ -121,8 +202,14 @@ func gracefulShutdown(ctx context.Context, done chan os.Signal, cfg *config.Conf
 
 func startupMonitoringEndpoint(cfg *config.Config, server *sshd.Server) {
 	go func() {
-		err := monitoring.Start(
-			monitoring.WithListenerAddress(cfg.Server.WebListen),
+		// The listener is passed on to the new process of an upgrade
+		listener, err := server.ListenMonitoring(cfg.Server.WebListen)
+		if err != nil {
+			log.WithError(err).Fatal("monitoring service failed to listen")
+		}
+
+		err = monitoring.Start(
+			monitoring.WithListener(listener),
 			monitoring.WithBuildInformation(Version, BuildTime),
 			monitoring.WithServeMux(server.MonitoringServeMux()),
 		)
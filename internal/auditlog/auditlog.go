@@ -0,0 +1,147 @@
+// Package auditlog writes a record for every SSH session to a dedicated, append-only
+// stream of JSON lines. The stream is independent of the main log and its log level.
+package auditlog
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/syslog"
+	"os"
+	"sync"
+	"time"
+)
+
+// SyslogOutput is the output name used to send the records to the local syslog daemon
+const SyslogOutput = "syslog"
+
+const syslogTag = "gitlab-sshd"
+
+// Authentication methods of a session
+const (
+	AuthMethodKey         = "key"
+	AuthMethodCertificate = "certificate"
+	AuthMethodKrb5        = "krb5"
+)
+
+// Record describes a single SSH session
+type Record struct {
+	Time           time.Time `json:"time"`
+	CorrelationID  string    `json:"correlation_id"`
+	RemoteAddr     string    `json:"remote_addr"`
+	AuthMethod     string    `json:"auth_method"`
+	KeyFingerprint string    `json:"key_fingerprint,omitempty"`
+	KeyID          string    `json:"key_id,omitempty"`
+	Krb5Principal  string    `json:"krb5_principal,omitempty"`
+	Username       string    `json:"username,omitempty"`
+	CommandType    string    `json:"command_type,omitempty"`
+	Project        string    `json:"project,omitempty"`
+	ExitStatus     uint32    `json:"exit_status"`
+	ReadBytes      int64     `json:"read_bytes"`
+	WrittenBytes   int64     `json:"written_bytes"`
+	DurationS      float64   `json:"duration_s"`
+}
+
+// Logger writes audit records to a file or to syslog. A nil Logger, or a Logger
+// without an output, discards the records.
+type Logger struct {
+	mu sync.Mutex
+	w  io.WriteCloser
+}
+
+// New opens the audit log output, which is either the path of a file that records
+// are appended to or SyslogOutput. An empty output disables the audit log until
+// it's reopened with an output.
+func New(output string) (*Logger, error) {
+	l := &Logger{}
+	if err := l.Reopen(output); err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
+
+func open(output string) (io.WriteCloser, error) {
+	switch output {
+	case "":
+		return nil, nil
+	case SyslogOutput:
+		w, err := syslog.New(syslog.LOG_INFO|syslog.LOG_AUTH, syslogTag)
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect to syslog: %w", err)
+		}
+
+		return w, nil
+	}
+
+	f, err := os.OpenFile(output, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log: %w", err)
+	}
+
+	return f, nil
+}
+
+// Log writes the record as a single JSON line
+func (l *Logger) Log(record Record) error {
+	if l == nil {
+		return nil
+	}
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.w == nil {
+		return nil
+	}
+
+	_, err = l.w.Write(data)
+
+	return err
+}
+
+// Reopen closes the current output and opens the given one, so a rotated audit
+// log file is recreated and a changed output is used. The current output is
+// kept if the new one can't be opened.
+func (l *Logger) Reopen(output string) error {
+	if l == nil {
+		return nil
+	}
+
+	w, err := open(output)
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.w != nil {
+		_ = l.w.Close()
+	}
+	l.w = w
+
+	return nil
+}
+
+// Close closes the output
+func (l *Logger) Close() error {
+	if l == nil {
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.w == nil {
+		return nil
+	}
+
+	return l.w.Close()
+}
@@ -0,0 +1,116 @@
+package auditlog
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewDisabled(t *testing.T) {
+	logger, err := New("")
+	require.NoError(t, err)
+
+	require.NoError(t, logger.Log(Record{}))
+	require.NoError(t, logger.Reopen(""))
+	require.NoError(t, logger.Close())
+}
+
+func TestNilLogger(t *testing.T) {
+	var logger *Logger
+
+	require.NoError(t, logger.Log(Record{}))
+	require.NoError(t, logger.Reopen("audit.log"))
+	require.NoError(t, logger.Close())
+}
+
+func TestNewInvalidFile(t *testing.T) {
+	_, err := New(filepath.Join(t.TempDir(), "missing", "audit.log"))
+	require.ErrorContains(t, err, "failed to open audit log")
+}
+
+func TestLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+
+	logger, err := New(path)
+	require.NoError(t, err)
+
+	first := Record{
+		Time:           time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+		CorrelationID:  "correlation-id",
+		RemoteAddr:     "127.0.0.1:1234",
+		AuthMethod:     AuthMethodKey,
+		KeyFingerprint: "SHA256:fingerprint",
+		KeyID:          "1",
+		Username:       "alex-doe",
+		CommandType:    "git-upload-pack",
+		Project:        "group/project",
+		ExitStatus:     0,
+		ReadBytes:      10,
+		WrittenBytes:   20,
+		DurationS:      1.5,
+	}
+	second := Record{AuthMethod: AuthMethodKrb5, Krb5Principal: "alex@EXAMPLE.COM", ExitStatus: 1}
+
+	require.NoError(t, logger.Log(first))
+
+	// Simulate a log rotation
+	require.NoError(t, os.Rename(path, path+".1"))
+	require.NoError(t, logger.Reopen(path))
+	require.NoError(t, logger.Log(second))
+	require.NoError(t, logger.Close())
+
+	require.Equal(t, []Record{first}, readRecords(t, path+".1"))
+	require.Equal(t, []Record{second}, readRecords(t, path))
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+}
+
+func TestReopenWithAnotherOutput(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "audit.log")
+	newPath := filepath.Join(dir, "new-audit.log")
+
+	// An audit log that is disabled at startup can be enabled
+	logger, err := New("")
+	require.NoError(t, err)
+	require.NoError(t, logger.Reopen(path))
+	require.NoError(t, logger.Log(Record{KeyID: "1"}))
+
+	// The current output is kept when the new one can't be opened
+	require.ErrorContains(t, logger.Reopen(filepath.Join(dir, "missing", "audit.log")), "failed to open audit log")
+	require.NoError(t, logger.Log(Record{KeyID: "2"}))
+
+	require.NoError(t, logger.Reopen(newPath))
+	require.NoError(t, logger.Log(Record{KeyID: "3"}))
+
+	require.NoError(t, logger.Reopen(""))
+	require.NoError(t, logger.Log(Record{KeyID: "4"}))
+	require.NoError(t, logger.Close())
+
+	require.Equal(t, []Record{{KeyID: "1"}, {KeyID: "2"}}, readRecords(t, path))
+	require.Equal(t, []Record{{KeyID: "3"}}, readRecords(t, newPath))
+}
+
+func readRecords(t *testing.T, path string) []Record {
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+
+	var records []Record
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var record Record
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &record))
+		records = append(records, record)
+	}
+	require.NoError(t, scanner.Err())
+
+	return records
+}
@@ -0,0 +1,103 @@
+// Package cache provides a size-bound in-memory cache with expiring entries.
+package cache
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// Entry is a cached result of a lookup. Err is set for negatively cached lookups.
+type Entry[V any] struct {
+	Value V
+	Err   error
+
+	key       string
+	expiresAt time.Time
+}
+
+// Cache is a least recently used cache with expiring entries. It's safe for concurrent use.
+type Cache[V any] struct {
+	maxSize int
+	now     func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List
+}
+
+// New creates a cache that holds at most maxSize entries. When the cache is full,
+// the least recently used entry is evicted. A non-positive maxSize means no bound.
+func New[V any](maxSize int) *Cache[V] {
+	return &Cache[V]{
+		maxSize: maxSize,
+		now:     time.Now,
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
+
+// Get returns the entry stored for the key if it hasn't expired yet
+func (c *Cache[V]) Get(key string) (Entry[V], bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return Entry[V]{}, false
+	}
+
+	entry := elem.Value.(*Entry[V])
+	if !c.now().Before(entry.expiresAt) {
+		c.remove(elem)
+
+		return Entry[V]{}, false
+	}
+
+	c.order.MoveToFront(elem)
+
+	return *entry, true
+}
+
+// Set stores the result of a lookup for the key for the ttl duration
+func (c *Cache[V]) Set(key string, value V, err error, ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[key]; ok {
+		c.remove(elem)
+	}
+
+	entry := &Entry[V]{Value: value, Err: err, key: key, expiresAt: c.now().Add(ttl)}
+	c.entries[key] = c.order.PushFront(entry)
+
+	for c.maxSize > 0 && c.order.Len() > c.maxSize {
+		c.remove(c.order.Back())
+	}
+}
+
+// Flush removes all the entries from the cache
+func (c *Cache[V]) Flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries = make(map[string]*list.Element)
+	c.order.Init()
+}
+
+// Len returns the number of entries in the cache, including the expired ones that haven't been evicted yet
+func (c *Cache[V]) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.order.Len()
+}
+
+func (c *Cache[V]) remove(elem *list.Element) {
+	entry := c.order.Remove(elem).(*Entry[V])
+	delete(c.entries, entry.key)
+}
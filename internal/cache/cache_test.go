@@ -0,0 +1,93 @@
+package cache
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetAndSet(t *testing.T) {
+	c := New[string](0)
+
+	_, found := c.Get("key")
+	require.False(t, found)
+
+	c.Set("key", "value", nil, time.Minute)
+
+	entry, found := c.Get("key")
+	require.True(t, found)
+	require.Equal(t, "value", entry.Value)
+	require.NoError(t, entry.Err)
+}
+
+func TestNegativeEntry(t *testing.T) {
+	c := New[string](0)
+	err := errors.New("not found")
+
+	c.Set("key", "", err, time.Minute)
+
+	entry, found := c.Get("key")
+	require.True(t, found)
+	require.Equal(t, err, entry.Err)
+}
+
+func TestExpiration(t *testing.T) {
+	now := time.Now()
+
+	c := New[string](0)
+	c.now = func() time.Time { return now }
+
+	c.Set("key", "value", nil, time.Minute)
+
+	now = now.Add(time.Minute)
+
+	_, found := c.Get("key")
+	require.False(t, found)
+	require.Equal(t, 0, c.Len())
+}
+
+func TestZeroTTLIsNotCached(t *testing.T) {
+	c := New[string](0)
+
+	c.Set("key", "value", nil, 0)
+
+	_, found := c.Get("key")
+	require.False(t, found)
+}
+
+func TestMaxSize(t *testing.T) {
+	c := New[string](2)
+
+	c.Set("first", "1", nil, time.Minute)
+	c.Set("second", "2", nil, time.Minute)
+
+	// Use the first entry, so the second one becomes the least recently used
+	_, found := c.Get("first")
+	require.True(t, found)
+
+	c.Set("third", "3", nil, time.Minute)
+
+	require.Equal(t, 2, c.Len())
+
+	_, found = c.Get("second")
+	require.False(t, found)
+
+	_, found = c.Get("first")
+	require.True(t, found)
+
+	_, found = c.Get("third")
+	require.True(t, found)
+}
+
+func TestFlush(t *testing.T) {
+	c := New[string](0)
+
+	c.Set("key", "value", nil, time.Minute)
+	c.Flush()
+
+	_, found := c.Get("key")
+	require.False(t, found)
+	require.Equal(t, 0, c.Len())
+}
@@ -3,14 +3,18 @@ package authorizedkeys
 
 import (
 	"context"
+	"encoding/base64"
 	"fmt"
 	"strconv"
 
+	"golang.org/x/crypto/ssh"
+
 	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/command/commandargs"
 	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/command/readwriter"
 	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/config"
 	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/gitlabnet/authorizedkeys"
 	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/keyline"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/revokedkeys"
 )
 
 // Command contains the configuration, arguments, and I/O interfaces.
@@ -39,6 +43,16 @@ func (c *Command) Execute(ctx context.Context) (context.Context, error) {
 }
 
 func (c *Command) printKeyLine(ctx context.Context) error {
+	revoked, err := c.isRevoked(ctx)
+	if err != nil {
+		return err
+	}
+
+	if revoked {
+		_, _ = fmt.Fprintf(c.ReadWriter.Out, "# Key %s is revoked\n", c.Args.Key)
+		return nil
+	}
+
 	response, err := c.getAuthorizedKey(ctx)
 	if err != nil {
 		_, _ = fmt.Fprintf(c.ReadWriter.Out, "# No key was found for %s\n", c.Args.Key)
@@ -63,3 +77,28 @@ func (c *Command) getAuthorizedKey(ctx context.Context) (*authorizedkeys.Respons
 
 	return client.GetByKey(ctx, c.Args.Key)
 }
+
+func (c *Command) isRevoked(ctx context.Context) (bool, error) {
+	if c.Config.RevokedKeysFile == "" {
+		return false, nil
+	}
+
+	revokedKeys, err := revokedkeys.Load(c.Config.RevokedKeysFile)
+	if err != nil {
+		return false, fmt.Errorf("failed to load revoked keys: %w", err)
+	}
+
+	// The key is passed by OpenSSH as a base64-encoded blob. If it can't be parsed,
+	// it's not a valid key and the lookup in GitLab fails anyway.
+	blob, err := base64.StdEncoding.DecodeString(c.Args.Key)
+	if err != nil {
+		return false, nil
+	}
+
+	key, err := ssh.ParsePublicKey(blob)
+	if err != nil {
+		return false, nil
+	}
+
+	return revokedKeys.Check(ctx, key), nil
+}
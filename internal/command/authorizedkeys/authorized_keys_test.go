@@ -3,11 +3,17 @@ package authorizedkeys
 import (
 	"bytes"
 	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
 	"encoding/json"
 	"net/http"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
 
 	"gitlab.com/gitlab-org/gitlab-shell/v14/client/testserver"
 	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/command/commandargs"
@@ -91,3 +97,64 @@ func TestExecute(t *testing.T) {
 		})
 	}
 }
+
+func TestExecuteWithRevokedKeys(t *testing.T) {
+	url := testserver.StartSocketHTTPServer(t, requests)
+
+	publicKey, _, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	revokedKey, err := ssh.NewPublicKey(publicKey)
+	require.NoError(t, err)
+	encodedKey := base64.StdEncoding.EncodeToString(revokedKey.Marshal())
+
+	revokedKeysFile := filepath.Join(t.TempDir(), "revoked_keys")
+	require.NoError(t, os.WriteFile(revokedKeysFile, ssh.MarshalAuthorizedKey(revokedKey), 0o600))
+
+	testCases := []struct {
+		desc            string
+		revokedKeysFile string
+		key             string
+		expectedOutput  string
+		expectedErr     string
+	}{
+		{
+			desc:            "With a revoked key",
+			revokedKeysFile: revokedKeysFile,
+			key:             encodedKey,
+			expectedOutput:  "# Key " + encodedKey + " is revoked\n",
+		},
+		{
+			desc:            "With a key that isn't revoked",
+			revokedKeysFile: revokedKeysFile,
+			key:             "key",
+			expectedOutput:  "command=\"/tmp/bin/gitlab-shell key-1\",no-port-forwarding,no-X11-forwarding,no-agent-forwarding,no-pty public-key\n",
+		},
+		{
+			desc:            "With a missing revoked keys file",
+			revokedKeysFile: filepath.Join(t.TempDir(), "missing"),
+			key:             "key",
+			expectedErr:     "failed to load revoked keys",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			buffer := &bytes.Buffer{}
+			cmd := &Command{
+				Config:     &config.Config{RootDir: "/tmp", GitlabUrl: url, RevokedKeysFile: tc.revokedKeysFile},
+				Args:       &commandargs.AuthorizedKeys{ExpectedUser: "user", ActualUser: "user", Key: tc.key},
+				ReadWriter: &readwriter.ReadWriter{Out: buffer},
+			}
+
+			_, err := cmd.Execute(context.Background())
+
+			if tc.expectedErr != "" {
+				require.ErrorContains(t, err, tc.expectedErr)
+				return
+			}
+
+			require.NoError(t, err)
+			require.Equal(t, tc.expectedOutput, buffer.String())
+		})
+	}
+}
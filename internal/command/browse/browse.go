@@ -0,0 +1,190 @@
+// Package browse implements a read-only protocol to list the tree of a
+// repository at a revision and to download single files, without a clone.
+//
+// The client sends one request per line:
+//
+//	ls <repository> <revision> [<path>]
+//	get <repository> <revision> <path>
+//
+// A successful ls is answered with "ok", one "<mode> <type> <oid>\t<path>" line
+// per entry and an empty line. A successful get is answered with "ok <size>"
+// followed by exactly size bytes of file content. A failed request is answered
+// with "error <message>" and the client may send the next request. The session
+// ends when the client closes its input.
+package browse
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"gitlab.com/gitlab-org/labkit/log"
+
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/command"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/command/commandargs"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/command/readwriter"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/command/shared/accessverifier"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/command/shared/disallowedcommand"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/config"
+)
+
+// maxRequestLength is the maximum length of a request line
+const maxRequestLength = 4096
+
+var errInvalidRequest = errors.New("invalid request")
+
+// Command represents the gitlab-browse command
+type Command struct {
+	Config     *config.Config
+	Args       *commandargs.Shell
+	ReadWriter *readwriter.ReadWriter
+
+	// responses caches the access checks of the session, by repository
+	responses map[string]*accessverifier.Response
+}
+
+type request struct {
+	op       string
+	repo     string
+	revision string
+	path     string
+}
+
+// Execute serves the requests of the client until it closes its input
+func (c *Command) Execute(ctx context.Context) (context.Context, error) {
+	if len(c.Args.SSHArgs) != 1 {
+		return ctx, disallowedcommand.Error
+	}
+
+	ctxWithLogData := ctx
+	in := bufio.NewReaderSize(c.ReadWriter.In, maxRequestLength)
+
+	for {
+		line, err := in.ReadSlice('\n')
+		if errors.Is(err, io.EOF) && len(line) == 0 {
+			return ctxWithLogData, nil
+		}
+		if err != nil && !errors.Is(err, io.EOF) {
+			return ctxWithLogData, err
+		}
+
+		req, err := parseRequest(string(line))
+		if err != nil {
+			if err := c.writeError(err); err != nil {
+				return ctxWithLogData, err
+			}
+			continue
+		}
+
+		response, err := c.verifyAccess(ctx, req.repo)
+		if err != nil {
+			if err := c.writeError(err); err != nil {
+				return ctxWithLogData, err
+			}
+			continue
+		}
+
+		ctxWithLogData = context.WithValue(ctx, command.LogDataKey, command.NewLogData(
+			response.Gitaly.Repo.GlProjectPath,
+			response.Username,
+			response.ProjectID,
+			response.RootNamespaceID,
+		))
+
+		log.WithContextFields(ctx, log.Fields{
+			"op":       req.op,
+			"repo":     req.repo,
+			"revision": req.revision,
+			"path":     req.path,
+		}).Info("browse: executing request")
+
+		switch req.op {
+		case "ls":
+			err = c.listTree(ctx, response, req)
+		case "get":
+			err = c.getBlob(ctx, response, req)
+		}
+
+		var reqErr *requestError
+		if errors.As(err, &reqErr) {
+			err = c.writeError(reqErr)
+		}
+		if err != nil {
+			return ctxWithLogData, err
+		}
+	}
+}
+
+func parseRequest(line string) (*request, error) {
+	line = strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r")
+
+	fields := strings.SplitN(line, " ", 4)
+	if len(fields) < 3 {
+		return nil, errInvalidRequest
+	}
+
+	req := &request{op: fields[0], repo: fields[1], revision: fields[2]}
+	if len(fields) == 4 {
+		req.path = fields[3]
+	}
+
+	switch {
+	case req.op != "ls" && req.op != "get":
+		return nil, fmt.Errorf("unknown operation %q", req.op)
+	case req.op == "get" && req.path == "":
+		return nil, errInvalidRequest
+	case strings.HasPrefix(req.revision, "-"):
+		return nil, fmt.Errorf("invalid revision %q", req.revision)
+	}
+
+	return req, nil
+}
+
+// verifyAccess checks whether the user may read the repository, with the
+// same /allowed check as git-upload-pack
+func (c *Command) verifyAccess(ctx context.Context, repo string) (*accessverifier.Response, error) {
+	if response, ok := c.responses[repo]; ok {
+		return response, nil
+	}
+
+	cmd := accessverifier.Command{
+		Config:     c.Config,
+		Args:       c.Args,
+		ReadWriter: c.ReadWriter,
+	}
+
+	response, err := cmd.Verify(ctx, commandargs.UploadPack, repo)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.IsCustomAction() {
+		return nil, errors.New("browsing isn't supported on this server, please use the primary")
+	}
+
+	if c.responses == nil {
+		c.responses = make(map[string]*accessverifier.Response)
+	}
+	c.responses[repo] = response
+
+	return response, nil
+}
+
+// requestError is an error of a single request, that's reported to the client
+type requestError struct {
+	message string
+}
+
+func (e *requestError) Error() string {
+	return e.message
+}
+
+func (c *Command) writeError(err error) error {
+	message := strings.ReplaceAll(err.Error(), "\n", " ")
+	_, err = fmt.Fprintf(c.ReadWriter.Out, "error %s\n", message)
+
+	return err
+}
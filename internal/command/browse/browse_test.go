@@ -0,0 +1,94 @@
+package browse
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-shell/v14/client/testserver"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/command"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/command/commandargs"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/command/readwriter"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/command/shared/disallowedcommand"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/config"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/testhelper/requesthandlers"
+)
+
+func setup(t *testing.T, requests []testserver.TestRequestHandler, input string) (*Command, *bytes.Buffer) {
+	url := testserver.StartHTTPServer(t, requests)
+
+	cfg := &config.Config{GitlabUrl: url}
+	cfg.GitalyClient.InitSidechannelRegistry(context.Background())
+
+	output := &bytes.Buffer{}
+	cmd := &Command{
+		Config: cfg,
+		Args: &commandargs.Shell{
+			GitlabKeyID: "1",
+			CommandType: commandargs.Browse,
+			SSHArgs:     []string{string(commandargs.Browse)},
+		},
+		ReadWriter: &readwriter.ReadWriter{Out: output, ErrOut: &bytes.Buffer{}, In: strings.NewReader(input)},
+	}
+
+	return cmd, output
+}
+
+func TestBrowse(t *testing.T) {
+	gitalyAddress, _ := testserver.StartGitalyServer(t, "tcp")
+	requests := requesthandlers.BuildAllowedWithGitalyHandlers(t, gitalyAddress)
+
+	input := strings.Join([]string{
+		"ls group/repo main",
+		"get group/repo main README.md",
+		"get group/repo main doc",
+		"get group/repo unknown README.md",
+		"ls group/repo unknown",
+		"rm group/repo main README.md",
+		"get group/repo main",
+		"ls group/repo --output=/tmp/file",
+		"",
+	}, "\n")
+
+	cmd, output := setup(t, requests, input)
+
+	ctxWithLogData, err := cmd.Execute(context.Background())
+	require.NoError(t, err)
+
+	expected := "ok\n" +
+		"040000 tree 3b18e512dba79e4c8300dd08aeb37f8e728b8dad\tdoc\n" +
+		"100644 blob 8ab686eafeb1f44702738c8b0f24f2567c36da6d\tREADME.md\n" +
+		"\n" +
+		fmt.Sprintf("ok %d\n", len(testserver.TestReadmeContent)) + testserver.TestReadmeContent +
+		"error doc is not a file\n" +
+		"error README.md not found at unknown\n" +
+		"error tree not found at unknown\n" +
+		"error unknown operation \"rm\"\n" +
+		"error invalid request\n" +
+		"error invalid revision \"--output=/tmp/file\"\n"
+	require.Equal(t, expected, output.String())
+
+	data := ctxWithLogData.Value(command.LogDataKey).(command.LogData)
+	require.Equal(t, "alex-doe", data.Username)
+	require.Equal(t, "group/project-path", data.Meta.Project)
+}
+
+func TestBrowseDisallowedByAPI(t *testing.T) {
+	cmd, output := setup(t, requesthandlers.BuildDisallowedByAPIHandlers(t), "ls group/repo main\n")
+
+	_, err := cmd.Execute(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, "error Disallowed by API call\n", output.String())
+}
+
+func TestBrowseWithArguments(t *testing.T) {
+	cmd, _ := setup(t, nil, "")
+	cmd.Args.SSHArgs = []string{string(commandargs.Browse), "group/repo"}
+
+	_, err := cmd.Execute(context.Background())
+	require.ErrorIs(t, err, disallowedcommand.Error)
+}
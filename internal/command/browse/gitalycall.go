@@ -0,0 +1,162 @@
+package browse
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+
+	"google.golang.org/grpc"
+	grpccodes "google.golang.org/grpc/codes"
+	grpcstatus "google.golang.org/grpc/status"
+
+	pb "gitlab.com/gitlab-org/gitaly/v16/proto/go/gitalypb"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/command/commandargs"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/command/shared/accessverifier"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/handler"
+)
+
+func (c *Command) listTree(ctx context.Context, response *accessverifier.Response, req *request) error {
+	gc := handler.NewGitalyCommand(c.Config, string(commandargs.Browse), response)
+
+	path := req.path
+	if path == "" {
+		path = "."
+	}
+
+	grpcReq := &pb.GetTreeEntriesRequest{
+		Repository:    &response.Gitaly.Repo,
+		Revision:      []byte(req.revision),
+		Path:          []byte(path),
+		Sort:          pb.GetTreeEntriesRequest_TREES_FIRST,
+		SkipFlatPaths: true,
+	}
+
+	return gc.RunGitalyCommand(ctx, func(ctx context.Context, conn *grpc.ClientConn) (int32, error) {
+		ctx, cancel := gc.PrepareContext(ctx, grpcReq.Repository, c.Args.Env)
+		defer cancel()
+
+		stream, err := pb.NewCommitServiceClient(conn).GetTreeEntries(ctx, grpcReq)
+		if err != nil {
+			return 1, err
+		}
+
+		// Entries are only sent once they have all been received, so that an
+		// error can still be reported
+		var entries []*pb.TreeEntry
+		for {
+			resp, err := stream.Recv()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				return 1, requestErrorFromStatus(err, req)
+			}
+
+			entries = append(entries, resp.GetEntries()...)
+		}
+
+		if _, err := io.WriteString(c.ReadWriter.Out, "ok\n"); err != nil {
+			return 1, err
+		}
+		for _, entry := range entries {
+			if _, err := fmt.Fprintf(c.ReadWriter.Out, "%06o %s %s\t%s\n", entry.GetMode(), entryType(entry.GetType()), entry.GetOid(), entry.GetPath()); err != nil {
+				return 1, err
+			}
+		}
+		if _, err := io.WriteString(c.ReadWriter.Out, "\n"); err != nil {
+			return 1, err
+		}
+
+		return 0, nil
+	})
+}
+
+func (c *Command) getBlob(ctx context.Context, response *accessverifier.Response, req *request) error {
+	gc := handler.NewGitalyCommand(c.Config, string(commandargs.Browse), response)
+
+	grpcReq := &pb.TreeEntryRequest{
+		Repository: &response.Gitaly.Repo,
+		Revision:   []byte(req.revision),
+		Path:       []byte(req.path),
+	}
+
+	return gc.RunGitalyCommand(ctx, func(ctx context.Context, conn *grpc.ClientConn) (int32, error) {
+		ctx, cancel := gc.PrepareContext(ctx, grpcReq.Repository, c.Args.Env)
+		defer cancel()
+
+		stream, err := pb.NewCommitServiceClient(conn).TreeEntry(ctx, grpcReq)
+		if err != nil {
+			return 1, err
+		}
+
+		first, err := stream.Recv()
+		if err != nil {
+			return 1, requestErrorFromStatus(err, req)
+		}
+		if first.GetType() != pb.TreeEntryResponse_BLOB {
+			return 1, &requestError{message: fmt.Sprintf("%s is not a file", req.path)}
+		}
+
+		if _, err := io.WriteString(c.ReadWriter.Out, "ok "+strconv.FormatInt(first.GetSize(), 10)+"\n"); err != nil {
+			return 1, err
+		}
+
+		// The size has been announced, so an error from now on ends the session
+		written := int64(0)
+		for resp := first; ; {
+			n, err := c.ReadWriter.Out.Write(resp.GetData())
+			written += int64(n)
+			if err != nil {
+				return 1, err
+			}
+
+			resp, err = stream.Recv()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				return 1, err
+			}
+		}
+
+		if written != first.GetSize() {
+			return 1, fmt.Errorf("sent %d bytes of %s instead of %d", written, req.path, first.GetSize())
+		}
+
+		return 0, nil
+	})
+}
+
+// requestErrorFromStatus turns the errors caused by the request, such as an
+// unknown revision or path, into errors reported to the client
+func requestErrorFromStatus(err error, req *request) error {
+	switch grpcstatus.Code(err) {
+	case grpccodes.NotFound:
+		return &requestError{message: fmt.Sprintf("%s not found at %s", displayPath(req.path), req.revision)}
+	case grpccodes.InvalidArgument:
+		return &requestError{message: grpcstatus.Convert(err).Message()}
+	}
+
+	return err
+}
+
+func displayPath(path string) string {
+	if path == "" {
+		return "tree"
+	}
+
+	return path
+}
+
+func entryType(t pb.TreeEntry_EntryType) string {
+	switch t {
+	case pb.TreeEntry_TREE:
+		return "tree"
+	case pb.TreeEntry_COMMIT:
+		return "commit"
+	default:
+		return "blob"
+	}
+}
@@ -26,6 +26,7 @@ type LogMetadata struct {
 type LogData struct {
 	Username     string      `json:"username"`
 	WrittenBytes int64       `json:"written_bytes"`
+	ReadBytes    int64       `json:"read_bytes"`
 	Meta         LogMetadata `json:"meta"`
 }
 
@@ -97,6 +98,7 @@ func NewLogData(project, username string, projectID, rootNamespaceID int) LogDat
 	return LogData{
 		Username:     username,
 		WrittenBytes: 0,
+		ReadBytes:    0,
 		Meta: LogMetadata{
 			Project:         project,
 			RootNamespace:   rootNameSpace,
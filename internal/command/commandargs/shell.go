@@ -22,6 +22,7 @@ const (
 	UploadPack          CommandType = "git-upload-pack"
 	UploadArchive       CommandType = "git-upload-archive"
 	PersonalAccessToken CommandType = "personal_access_token"
+	Browse              CommandType = "gitlab-browse"
 )
 
 // Regular expressions for parsing key IDs and usernames from arguments
@@ -0,0 +1,93 @@
+package githttp
+
+import (
+	"context"
+	"io"
+
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/command/commandargs"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/command/readwriter"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/command/shared/customaction"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/config"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/gitlabnet/accessverifier"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/gitlabnet/git"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/pktline"
+	"gitlab.com/gitlab-org/labkit/log"
+)
+
+// ArchiveCommand handles the execution of a Git archive operation against the primary
+type ArchiveCommand struct {
+	Config     *config.Config
+	ReadWriter *readwriter.ReadWriter
+	Args       *commandargs.Shell
+	Response   *accessverifier.Response
+}
+
+// When Git over SSH is routed to the primary, the request is sent to its SSH endpoint:
+//
+// 1. Read the arguments provided by user via SSH (stdinReader) until a flush packet
+// 2. Perform /ssh-upload-archive request and send this data
+// 3. Return the output to the user
+//
+// There's no HTTP(S) equivalent of git-upload-archive, so otherwise the request
+// is proxied through the custom action.
+
+// Execute runs the archive command by determining the appropriate method (SSH/custom action)
+func (c *ArchiveCommand) Execute(ctx context.Context) error {
+	data := c.Response.Payload.Data
+
+	// For Git over SSH routing
+	if data.GeoProxyFetchSSHDirectToPrimary {
+		log.ContextLogger(ctx).Info("Using Git over SSH upload archive")
+
+		client := &git.Client{URL: data.PrimaryRepo, Headers: data.RequestHeaders}
+		return c.requestSSHUploadArchive(ctx, client)
+	}
+
+	customAction := customaction.Command{
+		Config:     c.Config,
+		ReadWriter: c.ReadWriter,
+		EOFSent:    false,
+	}
+
+	return customAction.Execute(ctx, c.Response)
+}
+
+func (c *ArchiveCommand) requestSSHUploadArchive(ctx context.Context, client *git.Client) error {
+	pipeReader, pipeWriter := io.Pipe()
+	go c.readFromStdin(pipeWriter)
+
+	response, err := client.SSHUploadArchive(ctx, pipeReader)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close() //nolint:errcheck
+
+	_, err = io.Copy(c.ReadWriter.Out, response.Body)
+
+	return err
+}
+
+// readFromStdin forwards the arguments of the archive request. The client keeps
+// its side of the connection open while it waits for the archive, so the request
+// body ends with the flush packet that terminates the arguments.
+func (c *ArchiveCommand) readFromStdin(pw *io.PipeWriter) {
+	scanner := pktline.NewScanner(c.ReadWriter.In)
+
+	for scanner.Scan() {
+		line := scanner.Bytes()
+
+		_, err := pw.Write(line)
+		if err != nil {
+			log.WithError(err).Error("failed to write line")
+		}
+
+		if pktline.IsFlush(line) {
+			break
+		}
+	}
+
+	err := pw.Close()
+	if err != nil {
+		log.WithError(err).Error("failed to close writer")
+	}
+}
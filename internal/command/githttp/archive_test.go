@@ -0,0 +1,129 @@
+package githttp
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-shell/v14/client/testserver"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/command/readwriter"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/command/shared/customaction"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/config"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/gitlabnet/accessverifier"
+)
+
+var archiveRequest = "0012argument HEAD\n001aargument --format=tar\n0000"
+
+func TestArchiveExecute(t *testing.T) {
+	url := setupSSHArchive(t, http.StatusOK)
+	output := &bytes.Buffer{}
+	// Everything after the flush packet isn't part of the request
+	input := strings.NewReader(archiveRequest + "0000")
+
+	cmd := &ArchiveCommand{
+		Config:     &config.Config{GitlabUrl: url},
+		ReadWriter: &readwriter.ReadWriter{Out: output, In: input},
+		Response: &accessverifier.Response{
+			Payload: accessverifier.CustomPayload{
+				Data: accessverifier.CustomPayloadData{
+					PrimaryRepo:                     url,
+					GeoProxyFetchSSHDirectToPrimary: true,
+					RequestHeaders:                  map[string]string{"Authorization": "token"},
+				},
+			},
+		},
+	}
+
+	require.NoError(t, cmd.Execute(context.Background()))
+	require.Equal(t, "upload-archive-response", output.String())
+}
+
+func TestArchiveExecuteWithFailedRequest(t *testing.T) {
+	url := setupSSHArchive(t, http.StatusForbidden)
+	output := &bytes.Buffer{}
+
+	cmd := &ArchiveCommand{
+		Config:     &config.Config{GitlabUrl: url},
+		ReadWriter: &readwriter.ReadWriter{Out: output, In: strings.NewReader(archiveRequest)},
+		Response: &accessverifier.Response{
+			Payload: accessverifier.CustomPayload{
+				Data: accessverifier.CustomPayloadData{PrimaryRepo: url, GeoProxyFetchSSHDirectToPrimary: true},
+			},
+		},
+	}
+
+	require.EqualError(t, cmd.Execute(context.Background()), "Forbidden")
+	require.Empty(t, output.String())
+}
+
+func TestArchiveExecuteWithCustomAction(t *testing.T) {
+	requests := []testserver.TestRequestHandler{
+		{
+			Path: "/geo/proxy/upload_archive",
+			Handler: func(w http.ResponseWriter, r *http.Request) {
+				var request *customaction.Request
+				assert.NoError(t, json.NewDecoder(r.Body).Decode(&request))
+				assert.Equal(t, "https://primary/group/repo.git", request.Data.PrimaryRepo)
+
+				assert.NoError(t, json.NewEncoder(w).Encode(customaction.Response{Result: []byte("custom-action-response")}))
+			},
+		},
+		{
+			Path: "/ssh-upload-archive",
+			Handler: func(_ http.ResponseWriter, _ *http.Request) {
+				assert.Fail(t, "the SSH endpoint of the primary must not be requested")
+			},
+		},
+	}
+	url := testserver.StartHTTPServer(t, requests)
+	output := &bytes.Buffer{}
+
+	cmd := &ArchiveCommand{
+		Config:     &config.Config{GitlabUrl: url},
+		ReadWriter: &readwriter.ReadWriter{Out: output, In: strings.NewReader(archiveRequest)},
+		Response: &accessverifier.Response{
+			Payload: accessverifier.CustomPayload{
+				Action: "geo_proxy_to_primary",
+				Data: accessverifier.CustomPayloadData{
+					APIEndpoints: []string{"/geo/proxy/upload_archive"},
+					PrimaryRepo:  "https://primary/group/repo.git",
+				},
+			},
+		},
+	}
+
+	require.NoError(t, cmd.Execute(context.Background()))
+	require.Equal(t, "custom-action-response", output.String())
+}
+
+func setupSSHArchive(t *testing.T, statusCode int) string {
+	requests := []testserver.TestRequestHandler{
+		{
+			Path: "/ssh-upload-archive",
+			Handler: func(w http.ResponseWriter, r *http.Request) {
+				body, err := io.ReadAll(r.Body)
+				assert.NoError(t, err)
+				defer r.Body.Close()
+
+				assert.Equal(t, archiveRequest, string(body))
+
+				if statusCode != http.StatusOK {
+					w.WriteHeader(statusCode)
+					w.Write([]byte("Forbidden"))
+					return
+				}
+
+				w.Write([]byte("upload-archive-response"))
+			},
+		},
+	}
+
+	return testserver.StartHTTPServer(t, requests)
+}
@@ -30,13 +30,6 @@ func (e *errCustom) Is(err error) bool {
 	return err == e.err || err == e
 }
 
-func newErrUnsupported(operation string) error {
-	return &errCustom{
-		err:     transfer.ErrNotAllowed,
-		message: fmt.Sprintf("%s is not yet supported by git-lfs-transfer. See https://gitlab.com/groups/gitlab-org/-/epics/11872 to track progress.", operation),
-	}
-}
-
 type GitlabAuthentication struct {
 	href string
 	auth string
@@ -55,6 +48,9 @@ type idData struct {
 	Oid       string            `json:"oid"`
 	Href      string            `json:"href"`
 	Headers   map[string]string `json:"headers,omitempty"`
+
+	VerifyHref    string            `json:"verify_href,omitempty"`
+	VerifyHeaders map[string]string `json:"verify_headers,omitempty"`
 }
 
 func NewGitlabBackend(ctx context.Context, config *config.Config, args *commandargs.Shell, auth *GitlabAuthentication) (*GitlabBackend, error) {
@@ -72,14 +68,7 @@ func NewGitlabBackend(ctx context.Context, config *config.Config, args *commanda
 	}, nil
 }
 
-func (b *GitlabBackend) issueBatchArgs(op string, oid string, href string, headers map[string]string) (args transfer.Args, err error) {
-	data := &idData{
-		Operation: op,
-		Oid:       oid,
-		Href:      href,
-		Headers:   headers,
-	}
-
+func (b *GitlabBackend) issueBatchArgs(data *idData) (args transfer.Args, err error) {
 	args = transfer.Args{
 		"id":    "",
 		"token": "",
@@ -128,7 +117,20 @@ func (b *GitlabBackend) Batch(op string, pointers []transfer.BatchItem, args tra
 		var args transfer.Args
 
 		if action, present = retObject.Actions[op]; present {
-			args, err = b.issueBatchArgs(op, retObject.Oid, action.Href, action.Header)
+			data := &idData{
+				Operation: op,
+				Oid:       retObject.Oid,
+				Href:      action.Href,
+				Headers:   action.Header,
+			}
+			// The verify action is carried along with the upload one, so that the
+			// verify-object request can't be pointed to an arbitrary URL
+			if verify, ok := retObject.Actions["verify"]; ok && op == "upload" {
+				data.VerifyHref = verify.Href
+				data.VerifyHeaders = verify.Header
+			}
+
+			args, err = b.issueBatchArgs(data)
 			if err != nil {
 				return nil, err
 			}
@@ -153,28 +155,37 @@ func (b *GitlabBackend) Batch(op string, pointers []transfer.BatchItem, args tra
 }
 
 func (b *GitlabBackend) parseAndCheckBatchArgs(op, oid, id, token string) (href string, headers map[string]string, err error) {
+	data, err := b.parseAndCheckBatchID(op, oid, id, token)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return data.Href, data.Headers, nil
+}
+
+func (b *GitlabBackend) parseAndCheckBatchID(op, oid, id, token string) (*idData, error) {
 	if id == "" {
-		return "", nil, &errCustom{
+		return nil, &errCustom{
 			err:     transfer.ErrParseError,
 			message: "missing id",
 		}
 	}
 	if token == "" {
-		return "", nil, &errCustom{
+		return nil, &errCustom{
 			err:     transfer.ErrUnauthorized,
 			message: "missing token",
 		}
 	}
 	idBinary, err := base64.StdEncoding.DecodeString(id)
 	if err != nil {
-		return "", nil, &errCustom{
+		return nil, &errCustom{
 			err:     transfer.ErrParseError,
 			message: "invalid id",
 		}
 	}
 	tokenBinary, err := base64.StdEncoding.DecodeString(token)
 	if err != nil {
-		return "", nil, &errCustom{
+		return nil, &errCustom{
 			err:     transfer.ErrParseError,
 			message: "invalid token",
 		}
@@ -182,7 +193,7 @@ func (b *GitlabBackend) parseAndCheckBatchArgs(op, oid, id, token string) (href
 	h := hmac.New(sha256.New, []byte(b.config.Secret))
 	h.Write(idBinary)
 	if !hmac.Equal(tokenBinary, h.Sum(nil)) {
-		return "", nil, &errCustom{
+		return nil, &errCustom{
 			err:     transfer.ErrForbidden,
 			message: "token hash mismatch",
 		}
@@ -191,38 +202,61 @@ func (b *GitlabBackend) parseAndCheckBatchArgs(op, oid, id, token string) (href
 	idData := &idData{}
 	err = json.Unmarshal(idBinary, idData)
 	if err != nil {
-		return "", nil, &errCustom{
+		return nil, &errCustom{
 			err:     transfer.ErrParseError,
 			message: "invalid id",
 		}
 	}
 	if idData.Operation != op {
-		return "", nil, &errCustom{
+		return nil, &errCustom{
 			err:     transfer.ErrForbidden,
 			message: "invalid operation",
 		}
 	}
 	if idData.Oid != oid {
-		return "", nil, &errCustom{
+		return nil, &errCustom{
 			err:     transfer.ErrForbidden,
 			message: "invalid oid",
 		}
 	}
 
-	return idData.Href, idData.Headers, nil
+	return idData, nil
 }
 
-func (b *GitlabBackend) Upload(oid string, _ int64, r io.Reader, args transfer.Args) error {
+func (b *GitlabBackend) Upload(oid string, size int64, r io.Reader, args transfer.Args) error {
 	href, headers, err := b.parseAndCheckBatchArgs("upload", oid, args["id"], args["token"])
 	if err != nil {
 		_, _ = io.Copy(io.Discard, r)
 		return err
 	}
-	return b.client.PutObject(oid, href, headers, r)
+	// r checks the size and the checksum of the data against the oid and fails
+	// the read with transfer.ErrCorruptData on mismatch, which aborts the upload
+	return b.client.PutObject(oid, size, href, headers, r)
 }
 
-func (b *GitlabBackend) Verify(_ string, _ int64, _ transfer.Args) (transfer.Status, error) {
-	// Not needed, all verification is done in upload step.
+func (b *GitlabBackend) Verify(oid string, size int64, args transfer.Args) (transfer.Status, error) {
+	// Objects that were already present don't get batch arguments
+	if args["id"] == "" {
+		return transfer.SuccessStatus(), nil
+	}
+
+	data, err := b.parseAndCheckBatchID("upload", oid, args["id"], args["token"])
+	if err != nil {
+		return nil, err
+	}
+	// GitLab didn't ask for verification
+	if data.VerifyHref == "" {
+		return transfer.SuccessStatus(), nil
+	}
+
+	err = b.client.VerifyObject(oid, size, data.VerifyHref, data.VerifyHeaders)
+	if errors.Is(err, transfer.ErrNotFound) {
+		return transfer.NewStatus(transfer.StatusNotFound, fmt.Sprintf("object %s not found", oid)), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
 	return transfer.SuccessStatus(), nil
 }
 
@@ -253,6 +287,13 @@ type gitlabLock struct {
 
 func (l *gitlabLock) Unlock() error {
 	lock, err := l.gitlabLockBackend.client.Unlock(l.id, l.gitlabLockBackend.args["force"] == "true", l.gitlabLockBackend.args["refname"])
+	if errors.Is(err, transfer.ErrConflict) {
+		// The transfer protocol has no conflict status for unlocking, the lock can only be released with --force
+		return &errCustom{
+			err:     transfer.ErrForbidden,
+			message: fmt.Sprintf("lock %s is held by another user", l.id),
+		}
+	}
 	if err != nil {
 		return err
 	}
@@ -324,8 +365,20 @@ func (b *gitlabLockBackend) Create(path string, refname string) (transfer.Lock,
 	return lock, err
 }
 
-func (b *gitlabLockBackend) Unlock(_ transfer.Lock) error {
-	return newErrUnsupported("unlock")
+func (b *gitlabLockBackend) Unlock(lock transfer.Lock) error {
+	if lock == nil {
+		return transfer.ErrNotFound
+	}
+
+	l, ok := lock.(*gitlabLock)
+	if !ok {
+		l = &gitlabLock{
+			gitlabLockBackend: b,
+			id:                lock.ID(),
+		}
+	}
+
+	return l.Unlock()
 }
 
 func (b *gitlabLockBackend) FromPath(path string) (transfer.Lock, error) {
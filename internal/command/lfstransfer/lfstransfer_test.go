@@ -16,6 +16,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/charmbracelet/git-lfs-transfer/transfer"
 	"github.com/git-lfs/pktline"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -396,6 +397,10 @@ func TestLfsTransferBatchUpload(t *testing.T) {
 			"Authorization": "Basic 1234567890",
 			"Content-Type":  "application/octet-stream",
 		},
+		"verify_href": fmt.Sprintf("%s/group/repo/info/lfs/objects/verify", url),
+		"verify_headers": map[string]interface{}{
+			"Authorization": "Basic 1234567890",
+		},
 	}, id)
 
 	h := hmac.New(sha256.New, []byte("very secret"))
@@ -736,12 +741,33 @@ func TestLfsTransferPutObject(t *testing.T) {
 		"error: token hash mismatch",
 	}, data)
 
+	idJSON = map[string]interface{}{
+		"operation": "upload",
+		"oid":       evenLargerFileOid,
+		"href":      fmt.Sprintf("%s/evil-url", url),
+	}
+	idBinary, _ = json.Marshal(idJSON)
+	idBase64 = base64.StdEncoding.EncodeToString(idBinary)
+	h = hmac.New(sha256.New, []byte("very secret"))
+	h.Write(idBinary)
+	tokenBinary = h.Sum(nil)
+	tokenBase64 = base64.StdEncoding.EncodeToString(tokenBinary)
+	corruptedContents := strings.Repeat("x", evenLargerFileLen)
+	writeCommandArgsAndBinaryData(t, pl, fmt.Sprintf("put-object %s", evenLargerFileOid), []string{fmt.Sprintf("size=%d", evenLargerFileLen), fmt.Sprintf("id=%s", idBase64), fmt.Sprintf("token=%s", tokenBase64)}, [][]byte{[]byte(corruptedContents)})
+	status, args, data = readStatusArgsAndTextData(t, pl)
+	require.Equal(t, "status 400", status)
+	require.Empty(t, args)
+	corruptedHash := sha256.Sum256([]byte(corruptedContents))
+	require.Equal(t, []string{
+		fmt.Sprintf("error: corrupt data: invalid object ID, expected %s, got %x", evenLargerFileOid, corruptedHash),
+	}, data)
+
 	quit(t, pl)
 	wg.Wait()
 }
 
 func TestLfsTransferVerifyObject(t *testing.T) {
-	_, cmd, pl, _ := setup(t, "rw", "group/repo", "upload")
+	url, cmd, pl, _ := setup(t, "rw", "group/repo", "upload")
 	wg := setupWaitGroupForExecute(t, cmd)
 	negotiateVersion(t, pl)
 
@@ -749,6 +775,50 @@ func TestLfsTransferVerifyObject(t *testing.T) {
 	status := readStatus(t, pl)
 	require.Equal(t, "status 200", status)
 
+	verifyArgs := func(oid string, size int, verifyHref string) []string {
+		idBinary, _ := json.Marshal(map[string]interface{}{
+			"operation":   "upload",
+			"oid":         oid,
+			"href":        fmt.Sprintf("%s/group/repo/gitlab-lfs/objects/%s/%d", url, oid, size),
+			"verify_href": verifyHref,
+			"verify_headers": map[string]interface{}{
+				"Authorization": "Basic 1234567890",
+			},
+		})
+		h := hmac.New(sha256.New, []byte("very secret"))
+		h.Write(idBinary)
+		return []string{
+			fmt.Sprintf("size=%d", size),
+			fmt.Sprintf("id=%s", base64.StdEncoding.EncodeToString(idBinary)),
+			fmt.Sprintf("token=%s", base64.StdEncoding.EncodeToString(h.Sum(nil))),
+		}
+	}
+	verifyHref := fmt.Sprintf("%s/group/repo/info/lfs/objects/verify", url)
+
+	writeCommandArgs(t, pl, fmt.Sprintf("verify-object %s", evenLargerFileOid), verifyArgs(evenLargerFileOid, evenLargerFileLen, verifyHref))
+	status = readStatus(t, pl)
+	require.Equal(t, "status 200", status)
+
+	writeCommandArgs(t, pl, fmt.Sprintf("verify-object %s", evenLargerFileOid), verifyArgs(evenLargerFileOid, evenLargerFileLen-1, verifyHref))
+	status, args, data := readStatusArgsAndTextData(t, pl)
+	require.Equal(t, "status 404", status)
+	require.Empty(t, args)
+	require.Equal(t, []string{
+		fmt.Sprintf("object %s not found", evenLargerFileOid),
+	}, data)
+
+	writeCommandArgs(t, pl, fmt.Sprintf("verify-object %s", largeFileOid), verifyArgs(evenLargerFileOid, evenLargerFileLen, verifyHref))
+	status, args, data = readStatusArgsAndTextData(t, pl)
+	require.Equal(t, "status 403", status)
+	require.Empty(t, args)
+	require.Equal(t, []string{
+		"error: invalid oid",
+	}, data)
+
+	writeCommandArgs(t, pl, fmt.Sprintf("verify-object %s", evenLargerFileOid), verifyArgs(evenLargerFileOid, evenLargerFileLen, ""))
+	status = readStatus(t, pl)
+	require.Equal(t, "status 200", status)
+
 	quit(t, pl)
 	wg.Wait()
 }
@@ -852,10 +922,54 @@ func TestLfsTransferUnlock(t *testing.T) {
 		"error: not found",
 	}, data)
 
+	writeCommand(t, pl, "unlock lock5")
+	status, args, data = readStatusArgsAndTextData(t, pl)
+	require.Equal(t, "status 403", status)
+	require.Empty(t, args)
+	require.Equal(t, []string{
+		"error: lock lock5 is held by another user",
+	}, data)
+
 	quit(t, pl)
 	wg.Wait()
 }
 
+func TestGitlabLockBackendUnlock(t *testing.T) {
+	requests := []testserver.TestRequestHandler{
+		{
+			Path: "/group/repo/info/lfs/locks/lock1/unlock",
+			Handler: func(w http.ResponseWriter, r *http.Request) {
+				var body map[string]interface{}
+				assert.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+				assert.Equal(t, map[string]interface{}{"force": true}, body)
+
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"lock": map[string]interface{}{
+						"id":        "lock1",
+						"path":      "/large/file/1",
+						"locked_at": time.Date(2023, 10, 3, 13, 56, 20, 0, time.UTC).Format(time.RFC3339),
+						"owner":     map[string]interface{}{"name": "johndoe"},
+					},
+				})
+			},
+		},
+	}
+	url := testserver.StartHTTPServer(t, requests)
+
+	backend, err := NewGitlabBackend(context.Background(), &config.Config{}, &commandargs.Shell{}, &GitlabAuthentication{href: url + "/group/repo/info/lfs"})
+	require.NoError(t, err)
+
+	lockBackend := backend.LockBackend(transfer.Args{"force": "true"})
+
+	lock, err := lockBackend.FromID("lock1")
+	require.NoError(t, err)
+	require.NoError(t, lockBackend.Unlock(lock))
+	require.Equal(t, "/large/file/1", lock.Path())
+	require.Equal(t, "johndoe", lock.OwnerName())
+
+	require.ErrorIs(t, lockBackend.Unlock(nil), transfer.ErrNotFound)
+}
+
 func TestLfsTransferListLockDownload(t *testing.T) {
 	_, cmd, pl, _ := setup(t, "rw", "group/repo", "download")
 	wg := setupWaitGroupForExecute(t, cmd)
@@ -1226,6 +1340,12 @@ func setup(t *testing.T, keyID string, repo string, op string) (string, *Command
 										"Content-Type":  "application/octet-stream",
 									},
 								},
+								"verify": map[string]interface{}{
+									"href": fmt.Sprintf("%s/group/repo/info/lfs/objects/verify", url),
+									"header": map[string]interface{}{
+										"Authorization": "Basic 1234567890",
+									},
+								},
 							}
 						}
 					default:
@@ -1267,6 +1387,23 @@ func setup(t *testing.T, keyID string, repo string, op string) (string, *Command
 				assert.Equal(t, []byte(evenLargerFileContents), body)
 			},
 		},
+		{
+			Path: "/group/repo/info/lfs/objects/verify",
+			Handler: func(w http.ResponseWriter, r *http.Request) {
+				assert.Equal(t, http.MethodPost, r.Method)
+				assert.Equal(t, "Basic 1234567890", r.Header.Get("Authorization"))
+				assert.Equal(t, "application/vnd.git-lfs+json", r.Header.Get("Content-Type"))
+
+				var requestBody struct {
+					Oid  string `json:"oid"`
+					Size int64  `json:"size"`
+				}
+				assert.NoError(t, json.NewDecoder(r.Body).Decode(&requestBody))
+				if requestBody.Oid != evenLargerFileOid || requestBody.Size != int64(evenLargerFileLen) {
+					w.WriteHeader(http.StatusNotFound)
+				}
+			},
+		},
 		{
 			Path: "/group/repo/info/lfs/locks/verify",
 			Handler: func(w http.ResponseWriter, r *http.Request) {
@@ -1464,6 +1601,19 @@ func setup(t *testing.T, keyID string, repo string, op string) (string, *Command
 				writer.Encode(lock)
 			},
 		},
+		{
+			Path: "/group/repo/info/lfs/locks/lock5/unlock",
+			Handler: func(w http.ResponseWriter, r *http.Request) {
+				assert.Equal(t, http.MethodPost, r.Method)
+
+				lock := map[string]interface{}{
+					"message": "conflict",
+				}
+				w.WriteHeader(http.StatusConflict)
+				writer := json.NewEncoder(w)
+				writer.Encode(lock)
+			},
+		},
 	}
 
 	url = testserver.StartHTTPServer(t, requests)
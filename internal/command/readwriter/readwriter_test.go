@@ -2,6 +2,8 @@ package readwriter
 
 import (
 	"bytes"
+	"io"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -24,3 +26,15 @@ func TestCountingWriter_Write(t *testing.T) {
 	cw.Write(testString)
 	require.Equal(t, int64(22), cw.N)
 }
+
+func TestCountingReader_Read(t *testing.T) {
+	cr := &CountingReader{
+		R: strings.NewReader("test string"),
+	}
+
+	data, err := io.ReadAll(cr)
+
+	require.NoError(t, err)
+	require.Equal(t, "test string", string(data))
+	require.Equal(t, int64(11), cr.N)
+}
@@ -24,6 +24,12 @@ func (c *Command) performGitalyCall(ctx context.Context, response *accessverifie
 		GitConfigOptions: response.GitConfigOptions,
 	}
 
+	release, err := gc.WaitForConcurrencyLimits(ctx, c.ReadWriter.ErrOut)
+	if err != nil {
+		return err
+	}
+	defer release()
+
 	return gc.RunGitalyCommand(ctx, func(ctx context.Context, conn *grpc.ClientConn) (int32, error) {
 		ctx, cancel := gc.PrepareContext(ctx, request.Repository, c.Args.Env)
 		defer cancel()
@@ -17,6 +17,12 @@ func (c *Command) performGitalyCall(ctx context.Context, response *accessverifie
 
 	request := &pb.SSHUploadArchiveRequest{Repository: &response.Gitaly.Repo}
 
+	release, err := gc.WaitForConcurrencyLimits(ctx, c.ReadWriter.ErrOut)
+	if err != nil {
+		return err
+	}
+	defer release()
+
 	return gc.RunGitalyCommand(ctx, func(ctx context.Context, conn *grpc.ClientConn) (int32, error) {
 		ctx, cancel := gc.PrepareContext(ctx, request.Repository, c.Args.Env)
 		defer cancel()
@@ -6,8 +6,10 @@ import (
 
 	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/command"
 	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/command/commandargs"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/command/githttp"
 	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/command/readwriter"
 	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/command/shared/accessverifier"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/command/shared/customaction"
 	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/command/shared/disallowedcommand"
 	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/config"
 )
@@ -19,8 +21,6 @@ type Command struct {
 	ReadWriter *readwriter.ReadWriter
 }
 
-type logInfo struct{}
-
 // Execute executes the upload archive command
 func (c *Command) Execute(ctx context.Context) (context.Context, error) {
 	args := c.Args.SSHArgs
@@ -40,7 +40,27 @@ func (c *Command) Execute(ctx context.Context) (context.Context, error) {
 		response.ProjectID,
 		response.RootNamespaceID,
 	)
-	ctxWithLogData := context.WithValue(ctx, logInfo{}, logData)
+	ctxWithLogData := context.WithValue(ctx, command.LogDataKey, logData)
+
+	if response.IsCustomAction() {
+		if response.Payload.Data.GeoProxyFetchDirectToPrimary {
+			cmd := githttp.ArchiveCommand{
+				Config:     c.Config,
+				ReadWriter: c.ReadWriter,
+				Args:       c.Args,
+				Response:   response,
+			}
+
+			return ctxWithLogData, cmd.Execute(ctx)
+		}
+
+		customAction := customaction.Command{
+			Config:     c.Config,
+			ReadWriter: c.ReadWriter,
+			EOFSent:    false,
+		}
+		return ctxWithLogData, customAction.Execute(ctx, response)
+	}
 
 	return ctxWithLogData, c.performGitalyCall(ctx, response)
 }
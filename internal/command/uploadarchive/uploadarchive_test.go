@@ -3,8 +3,12 @@ package uploadarchive
 import (
 	"bytes"
 	"context"
+	"encoding/json"
+	"io"
+	"net/http"
 	"testing"
 
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"gitlab.com/gitlab-org/labkit/correlation"
 
@@ -28,12 +32,62 @@ func TestAllowedAccess(t *testing.T) {
 	ctxWithLogData, err := cmd.Execute(ctx)
 	require.NoError(t, err)
 
-	data := ctxWithLogData.Value(logInfo{}).(command.LogData)
+	data := ctxWithLogData.Value(command.LogDataKey).(command.LogData)
 	require.Equal(t, "alex-doe", data.Username)
 	require.Equal(t, "group/project-path", data.Meta.Project)
 	require.Equal(t, "group", data.Meta.RootNamespace)
 }
 
+func TestGeoProxySSHDirectToPrimary(t *testing.T) {
+	requests := []testserver.TestRequestHandler{
+		{
+			Path: "/api/v4/internal/allowed",
+			Handler: func(w http.ResponseWriter, r *http.Request) {
+				body := map[string]interface{}{
+					"status":        true,
+					"gl_id":         "1",
+					"gl_username":   "alex-doe",
+					"gl_repository": "project-1",
+					"payload": map[string]interface{}{
+						"action": "geo_proxy_to_primary",
+						"data": map[string]interface{}{
+							"gl_username":                           "alex-doe",
+							"primary_repo":                          "http://" + r.Host + "/group/repo.git",
+							"geo_proxy_direct_to_primary":           true,
+							"geo_proxy_fetch_direct_to_primary":     true,
+							"geo_proxy_fetch_ssh_direct_to_primary": true,
+							"request_headers":                       map[string]string{"Authorization": "token"},
+						},
+					},
+				}
+				w.WriteHeader(http.StatusMultipleChoices)
+				assert.NoError(t, json.NewEncoder(w).Encode(body))
+			},
+		},
+		{
+			Path: "/group/repo.git/ssh-upload-archive",
+			Handler: func(w http.ResponseWriter, r *http.Request) {
+				body, err := io.ReadAll(r.Body)
+				assert.NoError(t, err)
+				defer r.Body.Close()
+
+				assert.Equal(t, "0012argument HEAD\n0000", string(body))
+				assert.Equal(t, "token", r.Header.Get("Authorization"))
+
+				w.Write([]byte("archive"))
+			},
+		},
+	}
+
+	cmd := setup(t, "1", requests)
+	output := &bytes.Buffer{}
+	cmd.ReadWriter = &readwriter.ReadWriter{Out: output, In: bytes.NewBufferString("0012argument HEAD\n0000")}
+
+	_, err := cmd.Execute(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, "archive", output.String())
+}
+
 func TestForbiddenAccess(t *testing.T) {
 	requests := requesthandlers.BuildDisallowedByAPIHandlers(t)
 
@@ -22,13 +22,22 @@ func (c *Command) performGitalyCall(ctx context.Context, response *accessverifie
 		GitConfigOptions: response.GitConfigOptions,
 	}
 
+	release, err := gc.WaitForConcurrencyLimits(ctx, c.ReadWriter.ErrOut)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	// Nothing is sent to the client before Gitaly has accepted the call, so it
+	// can be retried when Gitaly is unavailable
+	rw := gc.TrackReadWriter(c.ReadWriter)
+
 	var stats *pb.PackfileNegotiationStatistics
-	err := gc.RunGitalyCommand(ctx, func(ctx context.Context, conn *grpc.ClientConn) (int32, error) {
+	err = gc.RunGitalyCommand(ctx, func(ctx context.Context, conn *grpc.ClientConn) (int32, error) {
 		ctx, cancel := gc.PrepareContext(ctx, request.Repository, c.Args.Env)
 		defer cancel()
 
 		registry := c.Config.GitalyClient.SidechannelRegistry
-		rw := c.ReadWriter
 
 		var (
 			result client.UploadPackResult
@@ -23,8 +23,6 @@ type Command struct {
 	ReadWriter *readwriter.ReadWriter
 }
 
-type logDataKey struct{}
-
 // Execute executes the upload-pack command
 func (c *Command) Execute(ctx context.Context) (context.Context, error) {
 	args := c.Args.SSHArgs
@@ -44,7 +42,7 @@ func (c *Command) Execute(ctx context.Context) (context.Context, error) {
 		response.ProjectID,
 		response.RootNamespaceID,
 	)
-	ctxWithLogData := context.WithValue(ctx, logDataKey{}, logData)
+	ctxWithLogData := context.WithValue(ctx, command.LogDataKey, logData)
 
 	if response.IsCustomAction() {
 		if response.Payload.Data.GeoProxyFetchDirectToPrimary {
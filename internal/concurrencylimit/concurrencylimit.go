@@ -0,0 +1,191 @@
+// Package concurrencylimit limits the number of operations that run at the same
+// time on a key, such as a root namespace or a project, and queues the others.
+package concurrencylimit
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/metrics"
+)
+
+// Limit is the maximum number of operations that run at the same time on the
+// Key of a Scope. A Max of zero or less means no limit.
+type Limit struct {
+	Scope string
+	Key   string
+	Max   int
+}
+
+// QueueTimeoutError is returned when an operation has been queued for longer than the queue timeout
+type QueueTimeoutError struct {
+	Limit Limit
+}
+
+func (e *QueueTimeoutError) Error() string {
+	return fmt.Sprintf("timed out waiting for a slot: %d operations are already running on %s %s", e.Limit.Max, e.Limit.Scope, e.Limit.Key)
+}
+
+type limitKey struct {
+	scope string
+	key   string
+}
+
+type slots struct {
+	max     int
+	running int
+	queue   *list.List
+}
+
+// Limiter keeps track of the operations running on each key. The limits are
+// passed on every acquisition, so that they can be changed on the fly.
+type Limiter struct {
+	mu    sync.Mutex
+	slots map[limitKey]*slots
+}
+
+// New returns a Limiter without any running operation
+func New() *Limiter {
+	return &Limiter{slots: make(map[limitKey]*slots)}
+}
+
+// Acquire waits until the operation fits in all the limits, for up to timeout
+// in total. onQueued is called once if the operation has to wait. The
+// returned function must be called when the operation is done.
+func (l *Limiter) Acquire(ctx context.Context, limits []Limit, timeout time.Duration, onQueued func()) (func(), error) {
+	var releases []func()
+	release := func() {
+		for i := len(releases) - 1; i >= 0; i-- {
+			releases[i]()
+		}
+	}
+
+	notify := sync.OnceFunc(func() {
+		if onQueued != nil {
+			onQueued()
+		}
+	})
+
+	// A single deadline is shared by all the limits, so that queuing on several
+	// of them doesn't add up their timeouts
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+
+	for _, limit := range limits {
+		if limit.Max <= 0 {
+			continue
+		}
+
+		if err := l.acquire(ctx, limit, deadline, notify); err != nil {
+			release()
+			return nil, err
+		}
+
+		releases = append(releases, func() { l.release(limit) })
+	}
+
+	return sync.OnceFunc(release), nil
+}
+
+// acquire waits for a slot of the limit until deadline. A zero deadline means no timeout.
+func (l *Limiter) acquire(ctx context.Context, limit Limit, deadline time.Time, onQueued func()) error {
+	key := limitKey{scope: limit.Scope, key: limit.Key}
+
+	l.mu.Lock()
+	s, ok := l.slots[key]
+	if !ok {
+		s = &slots{queue: list.New()}
+		l.slots[key] = s
+	}
+	s.max = limit.Max
+
+	if s.running < s.max && s.queue.Len() == 0 {
+		s.running++
+		l.mu.Unlock()
+
+		return nil
+	}
+
+	ready := make(chan struct{})
+	elem := s.queue.PushBack(ready)
+	l.mu.Unlock()
+
+	onQueued()
+
+	queued := metrics.ConcurrencyLimitQueuedOperations.WithLabelValues(limit.Scope)
+	queued.Inc()
+	defer queued.Dec()
+
+	start := time.Now()
+	defer func() {
+		metrics.ConcurrencyLimitQueueWaitDuration.WithLabelValues(limit.Scope).Observe(time.Since(start).Seconds())
+	}()
+
+	var expired <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	var err error
+	select {
+	case <-ready:
+		return nil
+	case <-expired:
+		metrics.ConcurrencyLimitQueueTimeoutsTotal.WithLabelValues(limit.Scope).Inc()
+		err = &QueueTimeoutError{Limit: limit}
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	select {
+	case <-ready:
+		// The slot has been handed over while giving up: pass it on
+		l.releaseSlot(key, s)
+	default:
+		s.queue.Remove(elem)
+		l.cleanup(key, s)
+	}
+
+	return err
+}
+
+func (l *Limiter) release(limit Limit) {
+	key := limitKey{scope: limit.Scope, key: limit.Key}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.releaseSlot(key, l.slots[key])
+}
+
+// releaseSlot starts the next queued operations. The limiter must be locked.
+func (l *Limiter) releaseSlot(key limitKey, s *slots) {
+	s.running--
+
+	// The limit may have been lowered in the meantime, so the queued
+	// operations are only started while there is room
+	for s.running < s.max && s.queue.Len() > 0 {
+		ready := s.queue.Remove(s.queue.Front()).(chan struct{})
+		s.running++
+		close(ready)
+	}
+
+	l.cleanup(key, s)
+}
+
+// cleanup forgets the keys without running or queued operations. The limiter must be locked.
+func (l *Limiter) cleanup(key limitKey, s *slots) {
+	if s.running == 0 && s.queue.Len() == 0 {
+		delete(l.slots, key)
+	}
+}
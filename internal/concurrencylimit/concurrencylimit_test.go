@@ -0,0 +1,167 @@
+package concurrencylimit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/metrics"
+)
+
+func TestAcquireWithinLimit(t *testing.T) {
+	l := New()
+	limits := []Limit{{Scope: "project", Key: "group/project", Max: 2}}
+
+	first, err := l.Acquire(context.Background(), limits, time.Second, func() { t.Fatal("unexpected queueing") })
+	require.NoError(t, err)
+	second, err := l.Acquire(context.Background(), limits, time.Second, func() { t.Fatal("unexpected queueing") })
+	require.NoError(t, err)
+
+	first()
+	second()
+	require.Empty(t, l.slots)
+}
+
+func TestAcquireWithoutLimit(t *testing.T) {
+	l := New()
+	limits := []Limit{{Scope: "project", Key: "group/project"}}
+
+	for i := 0; i < 10; i++ {
+		_, err := l.Acquire(context.Background(), limits, time.Second, nil)
+		require.NoError(t, err)
+	}
+	require.Empty(t, l.slots)
+}
+
+func TestAcquireQueued(t *testing.T) {
+	l := New()
+	limits := []Limit{{Scope: "test_queued", Key: "group", Max: 1}}
+
+	release, err := l.Acquire(context.Background(), limits, time.Second, nil)
+	require.NoError(t, err)
+
+	queued := make(chan struct{})
+	acquired := make(chan func())
+	go func() {
+		release, err := l.Acquire(context.Background(), limits, 5*time.Second, func() { close(queued) })
+		require.NoError(t, err)
+		acquired <- release
+	}()
+
+	<-queued
+	require.InDelta(t, 1, testutil.ToFloat64(metrics.ConcurrencyLimitQueuedOperations.WithLabelValues("test_queued")), 0.1)
+
+	release()
+	// Releasing twice doesn't free another slot
+	release()
+
+	(<-acquired)()
+	require.InDelta(t, 0, testutil.ToFloat64(metrics.ConcurrencyLimitQueuedOperations.WithLabelValues("test_queued")), 0.1)
+	require.Empty(t, l.slots)
+}
+
+func TestAcquireTimeout(t *testing.T) {
+	l := New()
+	limits := []Limit{
+		{Scope: "test_timeout_namespace", Key: "group", Max: 2},
+		{Scope: "test_timeout_project", Key: "group/project", Max: 1},
+	}
+
+	release, err := l.Acquire(context.Background(), limits, time.Second, nil)
+	require.NoError(t, err)
+	defer release()
+
+	timeouts := testutil.ToFloat64(metrics.ConcurrencyLimitQueueTimeoutsTotal.WithLabelValues("test_timeout_project"))
+
+	queued := false
+	_, err = l.Acquire(context.Background(), limits, time.Millisecond, func() { queued = true })
+	require.True(t, queued)
+
+	var timeoutErr *QueueTimeoutError
+	require.ErrorAs(t, err, &timeoutErr)
+	require.Equal(t, limits[1], timeoutErr.Limit)
+	require.EqualError(t, err, "timed out waiting for a slot: 1 operations are already running on test_timeout_project group/project")
+	require.InDelta(t, timeouts+1, testutil.ToFloat64(metrics.ConcurrencyLimitQueueTimeoutsTotal.WithLabelValues("test_timeout_project")), 0.1)
+
+	// The root namespace slot acquired before the timeout has been released
+	require.Equal(t, 1, l.slots[limitKey{scope: "test_timeout_namespace", key: "group"}].running)
+}
+
+func TestAcquireTimeoutSharedByLimits(t *testing.T) {
+	l := New()
+	limits := []Limit{
+		{Scope: "test_shared_timeout_namespace", Key: "group", Max: 1},
+		{Scope: "test_shared_timeout_project", Key: "group/project", Max: 1},
+	}
+
+	releaseNamespace, err := l.Acquire(context.Background(), limits[:1], 0, nil)
+	require.NoError(t, err)
+
+	releaseProject, err := l.Acquire(context.Background(), limits[1:], 0, nil)
+	require.NoError(t, err)
+	defer releaseProject()
+
+	// The namespace slot is freed shortly before the timeout, leaving little
+	// time to wait for the project slot
+	timer := time.AfterFunc(200*time.Millisecond, releaseNamespace)
+	defer timer.Stop()
+
+	start := time.Now()
+	_, err = l.Acquire(context.Background(), limits, 300*time.Millisecond, nil)
+
+	var timeoutErr *QueueTimeoutError
+	require.ErrorAs(t, err, &timeoutErr)
+	require.Equal(t, limits[1], timeoutErr.Limit)
+	require.Less(t, time.Since(start), 450*time.Millisecond)
+}
+
+func TestAcquireCanceled(t *testing.T) {
+	l := New()
+	limits := []Limit{{Scope: "project", Key: "group/project", Max: 1}}
+
+	release, err := l.Acquire(context.Background(), limits, time.Second, nil)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err = l.Acquire(ctx, limits, time.Second, nil)
+	require.ErrorIs(t, err, context.Canceled)
+
+	release()
+	require.Empty(t, l.slots)
+}
+
+func TestReleaseWithLoweredLimit(t *testing.T) {
+	l := New()
+
+	first, err := l.Acquire(context.Background(), []Limit{{Scope: "project", Key: "group/project", Max: 2}}, time.Second, nil)
+	require.NoError(t, err)
+	second, err := l.Acquire(context.Background(), []Limit{{Scope: "project", Key: "group/project", Max: 2}}, time.Second, nil)
+	require.NoError(t, err)
+
+	lowered := []Limit{{Scope: "project", Key: "group/project", Max: 1}}
+	queued := make(chan struct{})
+	acquired := make(chan struct{})
+	go func() {
+		release, err := l.Acquire(context.Background(), lowered, 5*time.Second, func() { close(queued) })
+		require.NoError(t, err)
+		close(acquired)
+		release()
+	}()
+	<-queued
+
+	// One operation is still running, so the queued one must keep waiting
+	first()
+	select {
+	case <-acquired:
+		t.Fatal("the queued operation has been started above the limit")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	second()
+	<-acquired
+}
@@ -6,6 +6,7 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"slices"
 	"sync"
 	"time"
 
@@ -30,26 +31,142 @@ type GSSAPIConfig struct {
 	LibPath              string
 }
 
+// RateLimitConfig configures a token bucket rate limiter. Rate is the number of
+// new sessions allowed per second and Burst is the size of the bucket. A zero
+// Rate disables the limiter.
+type RateLimitConfig struct {
+	Rate  float64 `yaml:"rate,omitempty"`
+	Burst int     `yaml:"burst,omitempty"`
+}
+
+// AuthCacheConfig configures the cache of /authorized_keys and /authorized_certs lookups
+type AuthCacheConfig struct {
+	Enabled     bool         `yaml:"enabled,omitempty"`
+	TTL         YamlDuration `yaml:"ttl,omitempty"`
+	NegativeTTL YamlDuration `yaml:"negative_ttl,omitempty"`
+	MaxSize     int          `yaml:"max_size,omitempty"`
+}
+
+// UserCertificatesConfig configures authentication with SSH user certificates
+type UserCertificatesConfig struct {
+	Enabled bool `yaml:"enabled,omitempty"`
+	// KRLFile is the path to an OpenSSH key revocation list that is checked before a certificate is accepted
+	KRLFile string `yaml:"krl_file,omitempty"`
+}
+
+// AuditLogConfig configures the audit log stream with a record for every SSH session
+type AuditLogConfig struct {
+	// Output is the path of a file that records are appended to, or "syslog"
+	Output string `yaml:"output,omitempty"`
+}
+
+// CommandTimeoutsConfig bounds how long the commands executed in gitlab-sshd
+// sessions may run. A zero value disables the corresponding timeout.
+type CommandTimeoutsConfig struct {
+	// MaxDuration is the maximum duration of a command, by command type such as git-upload-pack
+	MaxDuration map[string]YamlDuration `yaml:"max_duration,omitempty"`
+	// IdleTimeout is how long a command may go without reading from or writing to the client
+	IdleTimeout YamlDuration `yaml:"idle_timeout,omitempty"`
+}
+
 type ServerConfig struct {
-	Listen                  string       `yaml:"listen,omitempty"`
-	ProxyProtocol           bool         `yaml:"proxy_protocol,omitempty"`
-	ProxyPolicy             string       `yaml:"proxy_policy,omitempty"`
-	ProxyAllowed            []string     `yaml:"proxy_allowed,omitempty"`
-	WebListen               string       `yaml:"web_listen,omitempty"`
-	ConcurrentSessionsLimit int64        `yaml:"concurrent_sessions_limit,omitempty"`
-	ClientAliveInterval     YamlDuration `yaml:"client_alive_interval,omitempty"`
-	GracePeriod             YamlDuration `yaml:"grace_period"`
-	ProxyHeaderTimeout      YamlDuration `yaml:"proxy_header_timeout"`
-	LoginGraceTime          YamlDuration `yaml:"login_grace_time"`
-	ReadinessProbe          string       `yaml:"readiness_probe"`
-	LivenessProbe           string       `yaml:"liveness_probe"`
-	HostKeyFiles            []string     `yaml:"host_key_files,omitempty"`
-	HostCertFiles           []string     `yaml:"host_cert_files,omitempty"`
-	MACs                    []string     `yaml:"macs"`
-	KexAlgorithms           []string     `yaml:"kex_algorithms"`
-	PublicKeyAlgorithms     []string     `yaml:"public_key_algorithms"`
-	Ciphers                 []string     `yaml:"ciphers"`
-	GSSAPI                  GSSAPIConfig `yaml:"gssapi,omitempty"`
+	Listen                  string                 `yaml:"listen,omitempty"`
+	ProxyProtocol           bool                   `yaml:"proxy_protocol,omitempty"`
+	ProxyPolicy             string                 `yaml:"proxy_policy,omitempty"`
+	ProxyAllowed            []string               `yaml:"proxy_allowed,omitempty"`
+	WebListen               string                 `yaml:"web_listen,omitempty"`
+	ConcurrentSessionsLimit int64                  `yaml:"concurrent_sessions_limit,omitempty"`
+	ClientAliveInterval     YamlDuration           `yaml:"client_alive_interval,omitempty"`
+	GracePeriod             YamlDuration           `yaml:"grace_period"`
+	ProxyHeaderTimeout      YamlDuration           `yaml:"proxy_header_timeout"`
+	LoginGraceTime          YamlDuration           `yaml:"login_grace_time"`
+	ReadinessProbe          string                 `yaml:"readiness_probe"`
+	LivenessProbe           string                 `yaml:"liveness_probe"`
+	DrainProbe              string                 `yaml:"drain_probe"`
+	HostKeyFiles            []string               `yaml:"host_key_files,omitempty"`
+	HostCertFiles           []string               `yaml:"host_cert_files,omitempty"`
+	MACs                    []string               `yaml:"macs"`
+	KexAlgorithms           []string               `yaml:"kex_algorithms"`
+	PublicKeyAlgorithms     []string               `yaml:"public_key_algorithms"`
+	Ciphers                 []string               `yaml:"ciphers"`
+	GSSAPI                  GSSAPIConfig           `yaml:"gssapi,omitempty"`
+	IPRateLimit             RateLimitConfig        `yaml:"ip_rate_limit,omitempty"`
+	UserRateLimit           RateLimitConfig        `yaml:"user_rate_limit,omitempty"`
+	AuthCache               AuthCacheConfig        `yaml:"auth_cache,omitempty"`
+	UserCertificates        UserCertificatesConfig `yaml:"user_certificates,omitempty"`
+	AuditLog                AuditLogConfig         `yaml:"audit_log,omitempty"`
+	CommandTimeouts         CommandTimeoutsConfig  `yaml:"command_timeouts,omitempty"`
+	// ProxyTLVs are the PROXY protocol v2 TLVs that are passed on to GitLab
+	ProxyTLVs []ProxyTLVConfig `yaml:"proxy_tlvs,omitempty"`
+	// UpgradeTimeout is how long the new process of an upgrade has to accept connections
+	UpgradeTimeout YamlDuration `yaml:"upgrade_timeout,omitempty"`
+	// Listeners replaces listen and the proxy protocol settings with several
+	// listeners, each with its own policy
+	Listeners []ListenerConfig `yaml:"listeners,omitempty"`
+	// AcceptedEnv lists the client environment variables that are forwarded to GitLab and Gitaly, like OpenSSH's AcceptEnv
+	AcceptedEnv []string `yaml:"accepted_env,omitempty"`
+	// AdminTokenFile is the path of a file with the token that authenticates requests to the admin endpoints
+	AdminTokenFile string `yaml:"admin_token_file,omitempty"`
+	// IPRulesFile is the path of a file with the client IP addresses that are allowed or denied before the SSH handshake
+	IPRulesFile string `yaml:"ip_rules_file,omitempty"`
+}
+
+// ProxyTLVConfig configures a PROXY protocol v2 TLV that is passed on to
+// GitLab. Type is authority, aws_vpc_endpoint_id, azure_private_endpoint_link_id,
+// gcp_psc_connection_id, or the number of a custom type, like 0xE5. Name
+// defaults to the type.
+type ProxyTLVConfig struct {
+	Name string `yaml:"name,omitempty"`
+	Type string `yaml:"type"`
+}
+
+// ListenerConfig configures a listener of gitlab-sshd. Listen is a TCP address,
+// unix:<path> for a Unix domain socket, or systemd:<name> for a socket passed
+// by systemd socket activation. Empty auth methods allow all the methods, and
+// empty algorithm lists fall back to the sshd settings.
+type ListenerConfig struct {
+	Name   string `yaml:"name,omitempty"`
+	Listen string `yaml:"listen"`
+	// SocketMode is the octal file mode of a Unix domain socket, like 0660
+	SocketMode          string   `yaml:"socket_mode,omitempty"`
+	ProxyProtocol       bool     `yaml:"proxy_protocol,omitempty"`
+	ProxyPolicy         string   `yaml:"proxy_policy,omitempty"`
+	ProxyAllowed        []string `yaml:"proxy_allowed,omitempty"`
+	AuthMethods         []string `yaml:"auth_methods,omitempty"`
+	MACs                []string `yaml:"macs,omitempty"`
+	KexAlgorithms       []string `yaml:"kex_algorithms,omitempty"`
+	PublicKeyAlgorithms []string `yaml:"public_key_algorithms,omitempty"`
+	Ciphers             []string `yaml:"ciphers,omitempty"`
+}
+
+// AllowsAuthMethod tells whether the listener accepts the SSH authentication method
+func (lc *ListenerConfig) AllowsAuthMethod(method string) bool {
+	return len(lc.AuthMethods) == 0 || slices.Contains(lc.AuthMethods, method)
+}
+
+// ListenerConfigs returns the configured listeners, or a single listener with
+// the listen and proxy protocol settings. Listeners without a name are named
+// after their address.
+func (sc *ServerConfig) ListenerConfigs() []ListenerConfig {
+	if len(sc.Listeners) == 0 {
+		return []ListenerConfig{{
+			Name:          sc.Listen,
+			Listen:        sc.Listen,
+			ProxyProtocol: sc.ProxyProtocol,
+			ProxyPolicy:   sc.ProxyPolicy,
+			ProxyAllowed:  sc.ProxyAllowed,
+		}}
+	}
+
+	listeners := make([]ListenerConfig, len(sc.Listeners))
+	for i, listener := range sc.Listeners {
+		if listener.Name == "" {
+			listener.Name = listener.Listen
+		}
+		listeners[i] = listener
+	}
+
+	return listeners
 }
 
 // HTTPSettingsConfig are HTTP related settings
@@ -65,6 +182,29 @@ type LFSConfig struct {
 	PureSSHProtocol bool `yaml:"pure_ssh_protocol"`
 }
 
+// GitalyConfig configures the cache of the connections to Gitaly and the
+// retries of the calls that fail because Gitaly is unavailable
+type GitalyConfig struct {
+	UnhealthyThreshold  YamlDuration `yaml:"unhealthy_threshold,omitempty"`
+	IdleTTL             YamlDuration `yaml:"idle_ttl,omitempty"`
+	MaxConnections      int          `yaml:"max_connections,omitempty"`
+	RetryMaxAttempts    int          `yaml:"retry_max_attempts,omitempty"`
+	RetryInitialBackoff YamlDuration `yaml:"retry_initial_backoff,omitempty"`
+	RetryMaxBackoff     YamlDuration `yaml:"retry_max_backoff,omitempty"`
+}
+
+// ConcurrencyLimitsConfig limits the Git operations that run at the same time
+// on a root namespace or a project. The root_namespaces and projects overrides
+// take precedence over the root_namespace and project defaults. Zero disables
+// a limit.
+type ConcurrencyLimitsConfig struct {
+	RootNamespace  int            `yaml:"root_namespace,omitempty"`
+	Project        int            `yaml:"project,omitempty"`
+	RootNamespaces map[string]int `yaml:"root_namespaces,omitempty"`
+	Projects       map[string]int `yaml:"projects,omitempty"`
+	QueueTimeout   YamlDuration   `yaml:"queue_timeout,omitempty"`
+}
+
 type PATConfig struct {
 	Enabled       bool     `yaml:"enabled,omitempty"`
 	AllowedScopes []string `yaml:"allowed_scopes,omitempty"`
@@ -80,13 +220,18 @@ type Config struct {
 	GitlabRelativeURLRoot string `yaml:"gitlab_relative_url_root"`
 	GitlabTracing         string `yaml:"gitlab_tracing"`
 	// SecretFilePath is only for parsing. Application code should always use Secret.
-	SecretFilePath string             `yaml:"secret_file"`
-	Secret         string             `yaml:"secret"`
-	SslCertDir     string             `yaml:"ssl_cert_dir"`
-	HTTPSettings   HTTPSettingsConfig `yaml:"http_settings"`
-	Server         ServerConfig       `yaml:"sshd"`
-	LFSConfig      LFSConfig          `yaml:"lfs"`
-	PATConfig      PATConfig          `yaml:"pat"`
+	SecretFilePath string `yaml:"secret_file"`
+	Secret         string `yaml:"secret"`
+	SslCertDir     string `yaml:"ssl_cert_dir"`
+	// RevokedKeysFile is an OpenSSH KRL or a list of public keys that are rejected without an API call
+	RevokedKeysFile string             `yaml:"revoked_keys_file"`
+	HTTPSettings    HTTPSettingsConfig `yaml:"http_settings"`
+	Server          ServerConfig       `yaml:"sshd"`
+	LFSConfig       LFSConfig          `yaml:"lfs"`
+	PATConfig       PATConfig          `yaml:"pat"`
+	Gitaly          GitalyConfig       `yaml:"gitaly"`
+	// ConcurrencyLimits only apply within a gitlab-sshd process
+	ConcurrencyLimits ConcurrencyLimitsConfig `yaml:"concurrency_limits"`
 
 	httpClient     *client.HTTPClient
 	httpClientErr  error
@@ -104,6 +249,9 @@ var (
 		Server:    DefaultServerConfig,
 		User:      "git",
 		PATConfig: DefaultPATConfig,
+		Gitaly:    DefaultGitalyConfig,
+
+		ConcurrencyLimits: DefaultConcurrencyLimitsConfig,
 	}
 
 	DefaultServerConfig = ServerConfig{
@@ -114,8 +262,15 @@ var (
 		ClientAliveInterval:     YamlDuration(15 * time.Second),
 		ProxyHeaderTimeout:      YamlDuration(500 * time.Millisecond),
 		LoginGraceTime:          YamlDuration(60 * time.Second),
+		UpgradeTimeout:          YamlDuration(time.Minute),
 		ReadinessProbe:          "/start",
 		LivenessProbe:           "/health",
+		DrainProbe:              "/drain",
+		AuthCache: AuthCacheConfig{
+			TTL:         YamlDuration(time.Minute),
+			NegativeTTL: YamlDuration(10 * time.Second),
+			MaxSize:     10000,
+		},
 		HostKeyFiles: []string{
 			"/run/secrets/ssh-hostkeys/ssh_host_rsa_key",
 			"/run/secrets/ssh-hostkeys/ssh_host_ecdsa_key",
@@ -126,6 +281,18 @@ var (
 	DefaultPATConfig = PATConfig{
 		Enabled: true,
 	}
+
+	DefaultGitalyConfig = GitalyConfig{
+		UnhealthyThreshold:  YamlDuration(30 * time.Second),
+		IdleTTL:             YamlDuration(10 * time.Minute),
+		RetryMaxAttempts:    3,
+		RetryInitialBackoff: YamlDuration(100 * time.Millisecond),
+		RetryMaxBackoff:     YamlDuration(time.Second),
+	}
+
+	DefaultConcurrencyLimitsConfig = ConcurrencyLimitsConfig{
+		QueueTimeout: YamlDuration(30 * time.Second),
+	}
 )
 
 func (d *YamlDuration) UnmarshalYAML(unmarshal func(interface{}) error) error {
@@ -223,9 +390,37 @@ func newFromFile(path string) (*Config, error) {
 		cfg.LogFile = filepath.Join(cfg.RootDir, cfg.LogFile)
 	}
 
+	if output := cfg.Server.AuditLog.Output; output != "" && output != "syslog" && !filepath.IsAbs(output) {
+		cfg.Server.AuditLog.Output = filepath.Join(cfg.RootDir, output)
+	}
+
+	if cfg.Server.AdminTokenFile != "" && !filepath.IsAbs(cfg.Server.AdminTokenFile) {
+		cfg.Server.AdminTokenFile = filepath.Join(cfg.RootDir, cfg.Server.AdminTokenFile)
+	}
+
+	if cfg.Server.IPRulesFile != "" && !filepath.IsAbs(cfg.Server.IPRulesFile) {
+		cfg.Server.IPRulesFile = filepath.Join(cfg.RootDir, cfg.Server.IPRulesFile)
+	}
+
+	if cfg.RevokedKeysFile != "" && !filepath.IsAbs(cfg.RevokedKeysFile) {
+		cfg.RevokedKeysFile = filepath.Join(cfg.RootDir, cfg.RevokedKeysFile)
+	}
+
+	cfg.ConfigureGitalyClient()
+
 	return cfg, nil
 }
 
+// ConfigureGitalyClient applies the gitaly settings to the Gitaly client. It's done when the
+// config is read from a file, a config that is built otherwise must call it.
+func (c *Config) ConfigureGitalyClient() {
+	c.GitalyClient.CacheConfig = gitaly.CacheConfig{
+		UnhealthyThreshold: time.Duration(c.Gitaly.UnhealthyThreshold),
+		IdleTTL:            time.Duration(c.Gitaly.IdleTTL),
+		MaxSize:            c.Gitaly.MaxConnections,
+	}
+}
+
 func parseSecret(cfg *Config) error {
 	// The secret was parsed from yaml no need to read another file
 	if cfg.Secret != "" {
@@ -77,6 +77,20 @@ func TestNewFromDir(t *testing.T) {
 	require.Equal(t, 10*time.Second, time.Duration(cfg.Server.GracePeriod))
 	require.Equal(t, 1*time.Minute, time.Duration(cfg.Server.ClientAliveInterval))
 	require.Equal(t, 500*time.Millisecond, time.Duration(cfg.Server.ProxyHeaderTimeout))
+	require.Equal(t, 30*time.Second, cfg.GitalyClient.CacheConfig.UnhealthyThreshold)
+	require.Equal(t, 10*time.Minute, cfg.GitalyClient.CacheConfig.IdleTTL)
+	require.Zero(t, cfg.GitalyClient.CacheConfig.MaxSize)
+}
+
+func TestConfigureGitalyClient(t *testing.T) {
+	cfg := &Config{Gitaly: DefaultGitalyConfig}
+	cfg.Gitaly.MaxConnections = 5
+
+	cfg.ConfigureGitalyClient()
+
+	require.Equal(t, 30*time.Second, cfg.GitalyClient.CacheConfig.UnhealthyThreshold)
+	require.Equal(t, 10*time.Minute, cfg.GitalyClient.CacheConfig.IdleTTL)
+	require.Equal(t, 5, cfg.GitalyClient.CacheConfig.MaxSize)
 }
 
 func TestYAMLDuration(t *testing.T) {
@@ -104,3 +118,68 @@ func TestYAMLDuration(t *testing.T) {
 		})
 	}
 }
+
+func TestCommandTimeoutsConfig(t *testing.T) {
+	data := `
+max_duration:
+  git-upload-pack: 1h
+  git-receive-pack: 30m
+idle_timeout: 600
+`
+
+	var cfg CommandTimeoutsConfig
+	require.NoError(t, yaml.Unmarshal([]byte(data), &cfg))
+
+	require.Equal(t, time.Hour, time.Duration(cfg.MaxDuration["git-upload-pack"]))
+	require.Equal(t, 30*time.Minute, time.Duration(cfg.MaxDuration["git-receive-pack"]))
+	require.Equal(t, 10*time.Minute, time.Duration(cfg.IdleTimeout))
+}
+
+func TestListenerConfigs(t *testing.T) {
+	t.Run("defaults to the listen settings", func(t *testing.T) {
+		cfg := ServerConfig{Listen: "[::]:22", ProxyProtocol: true, ProxyPolicy: "require"}
+
+		require.Equal(t, []ListenerConfig{
+			{Name: "[::]:22", Listen: "[::]:22", ProxyProtocol: true, ProxyPolicy: "require"},
+		}, cfg.ListenerConfigs())
+	})
+
+	t.Run("uses the configured listeners", func(t *testing.T) {
+		data := `
+listen: "[::]:22"
+listeners:
+  - name: internal
+    listen: "10.0.0.1:22"
+  - listen: "[::]:2222"
+    proxy_protocol: true
+    proxy_policy: require
+    auth_methods: [publickey]
+    kex_algorithms: [curve25519-sha256]
+`
+
+		var cfg ServerConfig
+		require.NoError(t, yaml.Unmarshal([]byte(data), &cfg))
+
+		require.Equal(t, []ListenerConfig{
+			{Name: "internal", Listen: "10.0.0.1:22"},
+			{
+				Name:          "[::]:2222",
+				Listen:        "[::]:2222",
+				ProxyProtocol: true,
+				ProxyPolicy:   "require",
+				AuthMethods:   []string{"publickey"},
+				KexAlgorithms: []string{"curve25519-sha256"},
+			},
+		}, cfg.ListenerConfigs())
+	})
+}
+
+func TestListenerAllowsAuthMethod(t *testing.T) {
+	all := ListenerConfig{}
+	require.True(t, all.AllowsAuthMethod("publickey"))
+	require.True(t, all.AllowsAuthMethod("gssapi-with-mic"))
+
+	keysOnly := ListenerConfig{AuthMethods: []string{"publickey"}}
+	require.True(t, keysOnly.AllowsAuthMethod("publickey"))
+	require.False(t, keysOnly.AllowsAuthMethod("gssapi-with-mic"))
+}
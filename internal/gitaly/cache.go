@@ -0,0 +1,215 @@
+package gitaly
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+
+	"gitlab.com/gitlab-org/labkit/log"
+
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/metrics"
+)
+
+// CacheConfig configures when connections are evicted from the connection cache.
+// A zero value disables the corresponding eviction.
+type CacheConfig struct {
+	// UnhealthyThreshold is how long a connection may fail to connect before it's evicted
+	UnhealthyThreshold time.Duration
+	// IdleTTL is how long a connection may stay unused before it's evicted
+	IdleTTL time.Duration
+	// MaxSize is the maximum number of cached connections, the least recently used one is evicted first
+	MaxSize int
+}
+
+type cachedConnection struct {
+	conn    *grpc.ClientConn
+	address string
+
+	lastUsed       atomic.Int64
+	unhealthySince atomic.Int64
+	inUse          atomic.Int64
+	evicted        atomic.Bool
+	closeOnce      sync.Once
+}
+
+func newCachedConnection(address string, now time.Time) *cachedConnection {
+	cc := &cachedConnection{address: address}
+	cc.lastUsed.Store(now.UnixNano())
+
+	return cc
+}
+
+// dialOptions track the RPCs in flight, so that a connection that is evicted
+// while it's in use is only closed once its RPCs are done
+func (cc *cachedConnection) dialOptions() []grpc.DialOption {
+	return []grpc.DialOption{
+		grpc.WithChainUnaryInterceptor(
+			func(ctx context.Context, method string, req, reply interface{}, conn *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+				cc.begin()
+				defer cc.end()
+
+				return invoker(ctx, method, req, reply, conn, opts...)
+			},
+		),
+		grpc.WithChainStreamInterceptor(
+			func(ctx context.Context, desc *grpc.StreamDesc, conn *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+				cc.begin()
+
+				stream, err := streamer(ctx, desc, conn, method, opts...)
+				if err != nil {
+					cc.end()
+					return nil, err
+				}
+
+				// A stream is done when its context is canceled or when it returns an error
+				end := sync.OnceFunc(cc.end)
+				stop := context.AfterFunc(ctx, end)
+
+				return &trackedStream{
+					ClientStream: stream,
+					done: func() {
+						stop()
+						end()
+					},
+				}, nil
+			},
+		),
+	}
+}
+
+// acquire counts the connection as in use until ctx is done. A context that
+// can't be done isn't counted, since the connection would never be released.
+func (cc *cachedConnection) acquire(ctx context.Context) {
+	if ctx.Done() == nil {
+		cc.lastUsed.Store(time.Now().UnixNano())
+		return
+	}
+
+	cc.begin()
+	context.AfterFunc(ctx, cc.end)
+}
+
+func (cc *cachedConnection) begin() {
+	cc.inUse.Add(1)
+	cc.lastUsed.Store(time.Now().UnixNano())
+}
+
+func (cc *cachedConnection) end() {
+	cc.lastUsed.Store(time.Now().UnixNano())
+
+	if cc.inUse.Add(-1) == 0 && cc.evicted.Load() {
+		cc.close()
+	}
+}
+
+func (cc *cachedConnection) close() {
+	cc.closeOnce.Do(func() {
+		_ = cc.conn.Close()
+	})
+}
+
+// monitor records since when the connection has been failing to connect
+func (cc *cachedConnection) monitor() {
+	state := cc.conn.GetState()
+
+	for {
+		switch state {
+		case connectivity.TransientFailure:
+			cc.unhealthySince.CompareAndSwap(0, time.Now().UnixNano())
+		case connectivity.Idle, connectivity.Ready:
+			cc.unhealthySince.Store(0)
+		case connectivity.Shutdown:
+			return
+		}
+
+		if !cc.conn.WaitForStateChange(context.Background(), state) {
+			return
+		}
+		state = cc.conn.GetState()
+	}
+}
+
+// evictionReason returns why the connection must be evicted, or an empty string
+func (cc *cachedConnection) evictionReason(cfg CacheConfig, now time.Time) string {
+	if cc.conn.GetState() == connectivity.Shutdown {
+		return "shutdown"
+	}
+
+	if since := cc.unhealthySince.Load(); cfg.UnhealthyThreshold > 0 && since != 0 && now.Sub(time.Unix(0, since)) > cfg.UnhealthyThreshold {
+		return "unhealthy"
+	}
+
+	if cfg.IdleTTL > 0 && cc.inUse.Load() == 0 && now.Sub(time.Unix(0, cc.lastUsed.Load())) > cfg.IdleTTL {
+		return "idle"
+	}
+
+	return ""
+}
+
+type trackedStream struct {
+	grpc.ClientStream
+
+	done func()
+}
+
+func (s *trackedStream) RecvMsg(m interface{}) error {
+	err := s.ClientStream.RecvMsg(m)
+	if err != nil {
+		s.done()
+	}
+
+	return err
+}
+
+// evictConnections removes the connections that are broken or that have been
+// idle for too long. The cache must be locked for writing.
+func (c *Client) evictConnections(ctx context.Context, now time.Time) {
+	for cmd, cc := range c.cache.connections {
+		if reason := cc.evictionReason(c.CacheConfig, now); reason != "" {
+			c.evictConnection(ctx, cmd, reason)
+		}
+	}
+}
+
+// makeRoom evicts the least recently used connections until a new one fits
+// in the cache. A connection that is in use is only closed once it's released.
+// The cache must be locked for writing.
+func (c *Client) makeRoom(ctx context.Context) {
+	if c.CacheConfig.MaxSize <= 0 {
+		return
+	}
+
+	for len(c.cache.connections) >= c.CacheConfig.MaxSize {
+		var lruCmd Command
+		var lru *cachedConnection
+		for cmd, cc := range c.cache.connections {
+			if lru == nil || cc.lastUsed.Load() < lru.lastUsed.Load() {
+				lruCmd, lru = cmd, cc
+			}
+		}
+
+		c.evictConnection(ctx, lruCmd, "max_size")
+	}
+}
+
+func (c *Client) evictConnection(ctx context.Context, cmd Command, reason string) {
+	cc := c.cache.connections[cmd]
+	delete(c.cache.connections, cmd)
+
+	metrics.GitalyCachedConnections.WithLabelValues(cc.address).Dec()
+	metrics.GitalyConnectionEvictionsTotal.WithLabelValues(reason).Inc()
+
+	log.WithContextFields(ctx, log.Fields{
+		"gitaly_address": cc.address,
+		"reason":         reason,
+	}).Info("Evicting Gitaly connection from the cache")
+
+	cc.evicted.Store(true)
+	if cc.inUse.Load() == 0 {
+		cc.close()
+	}
+}
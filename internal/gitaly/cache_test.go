@@ -0,0 +1,178 @@
+package gitaly
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/connectivity"
+
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/metrics"
+)
+
+func TestEvictUnhealthyConnection(t *testing.T) {
+	c := newClient()
+	c.CacheConfig.UnhealthyThreshold = time.Millisecond
+
+	cmd := Command{ServiceName: "git-upload-pack", Address: unusedAddress(t)}
+
+	conn, err := c.GetConnection(context.Background(), cmd)
+	require.NoError(t, err)
+	conn.Connect()
+
+	cachedConn := c.cache.connections[cmd]
+	require.Eventually(t, func() bool {
+		return cachedConn.unhealthySince.Load() != 0
+	}, 5*time.Second, time.Millisecond)
+	time.Sleep(2 * time.Millisecond)
+
+	newConn, err := c.GetConnection(context.Background(), cmd)
+	require.NoError(t, err)
+	require.NotEqual(t, conn, newConn)
+	require.Equal(t, connectivity.Shutdown, conn.GetState())
+	require.Len(t, c.cache.connections, 1)
+	require.InDelta(t, 1, testutil.ToFloat64(metrics.GitalyCachedConnections.WithLabelValues(cmd.Address)), 0.1)
+}
+
+func TestEvictClosedConnection(t *testing.T) {
+	c := newClient()
+
+	cmd := Command{ServiceName: "git-upload-pack", Address: unusedAddress(t)}
+
+	conn, err := c.GetConnection(context.Background(), cmd)
+	require.NoError(t, err)
+	require.NoError(t, conn.Close())
+
+	newConn, err := c.GetConnection(context.Background(), cmd)
+	require.NoError(t, err)
+	require.NotEqual(t, conn, newConn)
+	require.NotEqual(t, connectivity.Shutdown, newConn.GetState())
+}
+
+func TestEvictIdleConnection(t *testing.T) {
+	c := newClient()
+	c.CacheConfig.IdleTTL = time.Millisecond
+
+	cmd := Command{ServiceName: "git-upload-pack", Address: unusedAddress(t)}
+	conn, err := c.GetConnection(context.Background(), cmd)
+	require.NoError(t, err)
+
+	time.Sleep(2 * time.Millisecond)
+
+	otherCmd := Command{ServiceName: "git-upload-pack", Address: unusedAddress(t)}
+	_, err = c.GetConnection(context.Background(), otherCmd)
+	require.NoError(t, err)
+
+	require.Equal(t, connectivity.Shutdown, conn.GetState())
+	require.Len(t, c.cache.connections, 1)
+	require.Contains(t, c.cache.connections, otherCmd)
+	require.InDelta(t, 0, testutil.ToFloat64(metrics.GitalyCachedConnections.WithLabelValues(cmd.Address)), 0.1)
+}
+
+func TestEvictLeastRecentlyUsedConnection(t *testing.T) {
+	c := newClient()
+	c.CacheConfig.MaxSize = 2
+
+	firstCmd := Command{ServiceName: "git-upload-pack", Address: unusedAddress(t)}
+	secondCmd := Command{ServiceName: "git-receive-pack", Address: firstCmd.Address}
+	thirdCmd := Command{ServiceName: "git-upload-archive", Address: firstCmd.Address}
+
+	firstConn, err := c.GetConnection(context.Background(), firstCmd)
+	require.NoError(t, err)
+	secondConn, err := c.GetConnection(context.Background(), secondCmd)
+	require.NoError(t, err)
+
+	// A cache hit doesn't evict anything
+	conn, err := c.GetConnection(context.Background(), firstCmd)
+	require.NoError(t, err)
+	require.Equal(t, firstConn, conn)
+	require.Len(t, c.cache.connections, 2)
+
+	_, err = c.GetConnection(context.Background(), thirdCmd)
+	require.NoError(t, err)
+
+	require.Len(t, c.cache.connections, 2)
+	require.Contains(t, c.cache.connections, firstCmd)
+	require.Contains(t, c.cache.connections, thirdCmd)
+	require.Equal(t, connectivity.Shutdown, secondConn.GetState())
+	require.InDelta(t, 2, testutil.ToFloat64(metrics.GitalyCachedConnections.WithLabelValues(firstCmd.Address)), 0.1)
+}
+
+func TestEvictConnectionInUse(t *testing.T) {
+	c := newClient()
+	c.CacheConfig.MaxSize = 1
+
+	cmd := Command{ServiceName: "git-upload-pack", Address: unusedAddress(t)}
+	conn, err := c.GetConnection(context.Background(), cmd)
+	require.NoError(t, err)
+
+	cachedConn := c.cache.connections[cmd]
+	cachedConn.begin()
+
+	otherCmd := Command{ServiceName: "git-receive-pack", Address: cmd.Address}
+	_, err = c.GetConnection(context.Background(), otherCmd)
+	require.NoError(t, err)
+
+	require.NotContains(t, c.cache.connections, cmd)
+	require.NotEqual(t, connectivity.Shutdown, conn.GetState())
+
+	cachedConn.end()
+	require.Equal(t, connectivity.Shutdown, conn.GetState())
+}
+
+func TestEvictHandedOutConnection(t *testing.T) {
+	c := newClient()
+	c.CacheConfig.MaxSize = 1
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cmd := Command{ServiceName: "git-upload-pack", Address: unusedAddress(t)}
+	conn, err := c.GetConnection(ctx, cmd)
+	require.NoError(t, err)
+
+	otherCmd := Command{ServiceName: "git-receive-pack", Address: cmd.Address}
+	_, err = c.GetConnection(context.Background(), otherCmd)
+	require.NoError(t, err)
+
+	require.NotContains(t, c.cache.connections, cmd)
+	require.NotEqual(t, connectivity.Shutdown, conn.GetState())
+
+	cancel()
+	require.Eventually(t, func() bool {
+		return conn.GetState() == connectivity.Shutdown
+	}, 5*time.Second, time.Millisecond)
+}
+
+func TestKeepHandedOutConnectionWhenIdle(t *testing.T) {
+	c := newClient()
+	c.CacheConfig.IdleTTL = time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cmd := Command{ServiceName: "git-upload-pack", Address: unusedAddress(t)}
+	conn, err := c.GetConnection(ctx, cmd)
+	require.NoError(t, err)
+
+	time.Sleep(2 * time.Millisecond)
+
+	otherCmd := Command{ServiceName: "git-upload-pack", Address: unusedAddress(t)}
+	_, err = c.GetConnection(context.Background(), otherCmd)
+	require.NoError(t, err)
+
+	require.Contains(t, c.cache.connections, cmd)
+	require.NotEqual(t, connectivity.Shutdown, conn.GetState())
+}
+
+func unusedAddress(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	require.NoError(t, listener.Close())
+
+	return fmt.Sprintf("tcp://%s", listener.Addr().String())
+}
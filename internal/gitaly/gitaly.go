@@ -5,6 +5,7 @@ import (
 	"context"
 	"fmt"
 	"sync"
+	"time"
 
 	grpc_prometheus "github.com/grpc-ecosystem/go-grpc-prometheus"
 	"google.golang.org/grpc"
@@ -29,14 +30,16 @@ type Command struct {
 type connectionsCache struct {
 	sync.RWMutex
 
-	connections map[Command]*grpc.ClientConn
+	connections map[Command]*cachedConnection
 }
 
 // Client manages connections to Gitaly services and handles sidechannel communication.
 type Client struct {
 	SidechannelRegistry *gitalyclient.SidechannelRegistry
+	CacheConfig         CacheConfig
 
-	cache connectionsCache
+	cacheOnce sync.Once
+	cache     *connectionsCache
 }
 
 // InitSidechannelRegistry initializes the sidechannel registry for gRPC connections.
@@ -44,38 +47,71 @@ func (c *Client) InitSidechannelRegistry(ctx context.Context) {
 	c.SidechannelRegistry = gitalyclient.NewSidechannelRegistry(log.ContextLogger(ctx))
 }
 
+// Share makes c use the sidechannel registry and the cached connections of other, so that
+// they're kept when the configuration is reloaded. It must be called before c is used.
+func (c *Client) Share(other *Client) {
+	c.SidechannelRegistry = other.SidechannelRegistry
+	c.cache = other.connectionsCache()
+}
+
+func (c *Client) connectionsCache() *connectionsCache {
+	c.cacheOnce.Do(func() {
+		if c.cache == nil {
+			c.cache = &connectionsCache{}
+		}
+	})
+
+	return c.cache
+}
+
 // GetConnection returns a gRPC connection for the given command, using a cached connection if available.
+// The connection is counted as in use until ctx is done, so that it isn't closed under the caller when
+// it's evicted from the cache.
 func (c *Client) GetConnection(ctx context.Context, cmd Command) (*grpc.ClientConn, error) {
-	c.cache.RLock()
-	existingConn := c.cache.connections[cmd]
-	c.cache.RUnlock()
+	now := time.Now()
+	cache := c.connectionsCache()
+
+	cache.RLock()
+	cachedConn := cache.connections[cmd]
+	if cachedConn != nil && cachedConn.evictionReason(c.CacheConfig, now) == "" {
+		cachedConn.acquire(ctx)
+		cache.RUnlock()
 
-	if existingConn != nil {
-		return existingConn, nil
+		return cachedConn.conn, nil
 	}
+	cache.RUnlock()
 
-	c.cache.Lock()
-	defer c.cache.Unlock()
+	cache.Lock()
+	defer cache.Unlock()
 
-	if cachedConn := c.cache.connections[cmd]; cachedConn != nil {
-		return cachedConn, nil
+	c.evictConnections(ctx, now)
+
+	if cachedConn := cache.connections[cmd]; cachedConn != nil {
+		cachedConn.acquire(ctx)
+		return cachedConn.conn, nil
 	}
 
-	newConn, err := c.newConnection(ctx, cmd)
+	cachedConn = newCachedConnection(cmd.Address, now)
+	newConn, err := c.newConnection(ctx, cmd, cachedConn.dialOptions()...)
 	if err != nil {
 		return nil, err
 	}
+	cachedConn.conn = newConn
+	go cachedConn.monitor()
 
-	if c.cache.connections == nil {
-		c.cache.connections = make(map[Command]*grpc.ClientConn)
+	c.makeRoom(ctx)
+	if cache.connections == nil {
+		cache.connections = make(map[Command]*cachedConnection)
 	}
 
-	c.cache.connections[cmd] = newConn
+	cache.connections[cmd] = cachedConn
+	metrics.GitalyCachedConnections.WithLabelValues(cmd.Address).Inc()
+	cachedConn.acquire(ctx)
 
 	return newConn, nil
 }
 
-func (c *Client) newConnection(ctx context.Context, cmd Command) (conn *grpc.ClientConn, err error) {
+func (c *Client) newConnection(ctx context.Context, cmd Command, opts ...grpc.DialOption) (conn *grpc.ClientConn, err error) {
 	defer func() {
 		label := "ok"
 		if err != nil {
@@ -133,5 +169,7 @@ func (c *Client) newConnection(ctx context.Context, cmd Command) (conn *grpc.Cli
 		)
 	}
 
+	connOpts = append(connOpts, opts...)
+
 	return gitalyclient.DialSidechannel(ctx, cmd.Address, c.SidechannelRegistry, connOpts)
 }
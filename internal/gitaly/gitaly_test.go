@@ -33,7 +33,7 @@ func TestPrometheusMetrics(t *testing.T) {
 func TestCachedConnections(t *testing.T) {
 	c := newClient()
 
-	require.Empty(t, c.cache.connections)
+	require.Nil(t, c.cache)
 
 	cmd := Command{ServiceName: "git-upload-pack", Address: "tcp://localhost:9999"}
 
@@ -36,6 +36,10 @@ type Request struct {
 	// NamespacePath is the full path of the namespace in which the authenticated
 	// user is allowed to perform operation.
 	NamespacePath string `json:"namespace_path,omitempty"`
+	// ClientEnv holds the accepted environment variables sent by the client
+	ClientEnv map[string]string `json:"client_env,omitempty"`
+	// ProxyTLVs holds the PROXY protocol v2 TLVs sent by the load balancer, like the VPC endpoint ID
+	ProxyTLVs map[string]string `json:"proxy_tlvs,omitempty"`
 }
 
 // Gitaly represents Gitaly server information
@@ -106,6 +110,8 @@ func (c *Client) Verify(ctx context.Context, args *commandargs.Shell, action com
 		Changes:       anyChanges,
 		Protocol:      sshProtocol,
 		NamespacePath: args.Env.NamespacePath,
+		ClientEnv:     args.Env.ClientEnv,
+		ProxyTLVs:     args.Env.ProxyTLVs,
 	}
 
 	switch {
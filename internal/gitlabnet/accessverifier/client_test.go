@@ -240,6 +240,30 @@ func TestCheckIP(t *testing.T) {
 	}
 }
 
+func TestClientEnv(t *testing.T) {
+	clientEnv := map[string]string{"LANG": "en_US.UTF-8", "GL_FEATURE_HINT": "1"}
+
+	client := setupWithAPIInspector(t,
+		func(r *Request) {
+			require.Equal(t, clientEnv, r.ClientEnv)
+		})
+
+	sshEnv := sshenv.Env{ClientEnv: clientEnv}
+	client.Verify(context.Background(), &commandargs.Shell{Env: sshEnv}, uploadPackAction, repo)
+}
+
+func TestProxyTLVs(t *testing.T) {
+	proxyTLVs := map[string]string{"aws_vpc_endpoint_id": "vpce-0123456789abcdef0"}
+
+	client := setupWithAPIInspector(t,
+		func(r *Request) {
+			require.Equal(t, proxyTLVs, r.ProxyTLVs)
+		})
+
+	sshEnv := sshenv.Env{ProxyTLVs: proxyTLVs}
+	client.Verify(context.Background(), &commandargs.Shell{Env: sshEnv}, uploadPackAction, repo)
+}
+
 type testResponse struct {
 	body   []byte
 	status int
@@ -18,6 +18,7 @@ const (
 	repoUnavailableErrMsg = "Remote repository is unavailable"
 	sshUploadPackPath     = "/ssh-upload-pack"
 	sshReceivePackPath    = "/ssh-receive-pack"
+	sshUploadArchivePath  = "/ssh-upload-archive"
 )
 
 // Client represents a client for interacting with Git repositories.
@@ -80,6 +81,16 @@ func (c *Client) SSHReceivePack(ctx context.Context, body io.Reader) (*http.Resp
 	return c.do(request)
 }
 
+// SSHUploadArchive sends a SSH Git archive request to the server.
+func (c *Client) SSHUploadArchive(ctx context.Context, body io.Reader) (*http.Response, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, c.URL+sshUploadArchivePath, body)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.do(request)
+}
+
 func (c *Client) do(request *http.Request) (*http.Response, error) {
 	for k, v := range c.Headers {
 		request.Header.Add(k, v)
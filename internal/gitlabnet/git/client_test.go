@@ -91,6 +91,19 @@ func TestSSHReceivePack(t *testing.T) {
 	require.Equal(t, "ssh-receive-pack: content", string(body))
 }
 
+func TestSSHUploadArchive(t *testing.T) {
+	client := setup(t)
+
+	response, err := client.SSHUploadArchive(context.Background(), bytes.NewReader([]byte("0012argument HEAD\n0000")))
+	require.NoError(t, err)
+	defer response.Body.Close()
+
+	body, err := io.ReadAll(response.Body)
+	require.NoError(t, err)
+
+	require.Equal(t, "ssh-upload-archive: content", string(body))
+}
+
 func TestFailedHTTPRequest(t *testing.T) {
 	requests := []testserver.TestRequestHandler{
 		{
@@ -219,6 +232,19 @@ func setup(t *testing.T) *Client {
 				w.Write([]byte("ssh-receive-pack: content"))
 			},
 		},
+		{
+			Path: sshUploadArchivePath,
+			Handler: func(w http.ResponseWriter, r *http.Request) {
+				assert.Equal(t, customHeaders["Authorization"], r.Header.Get("Authorization"))
+				assert.Equal(t, customHeaders["Header-One"], r.Header.Get("Header-One"))
+
+				_, err := io.ReadAll(r.Body)
+				assert.NoError(t, err)
+				defer r.Body.Close()
+
+				w.Write([]byte("ssh-upload-archive: content"))
+			},
+		},
 	}
 
 	client := &Client{
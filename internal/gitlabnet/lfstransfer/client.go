@@ -9,6 +9,7 @@ import (
 	"io/fs"
 	"net/http"
 	"net/url"
+	"sync"
 	"time"
 
 	"github.com/charmbracelet/git-lfs-transfer/transfer"
@@ -60,6 +61,11 @@ type BatchResponse struct {
 	HashAlgorithm string         `json:"hash_algo,omitempty"`
 }
 
+type verifyRequest struct {
+	Oid  string `json:"oid"`
+	Size int64  `json:"size"`
+}
+
 type lockRequest struct {
 	Path string    `json:"path"`
 	Ref  *batchRef `json:"ref,omitempty"`
@@ -125,11 +131,21 @@ func newHTTPRequest(method string, ref string, reader io.Reader) (*retryablehttp
 	return req, nil
 }
 
+var (
+	httpClient     *retryablehttp.Client
+	httpClientOnce sync.Once
+)
+
+// newHTTPClient returns the client shared by all LFS requests, so that the
+// connections to GitLab and to the object storage are pooled instead of
+// being opened again for every object
 func newHTTPClient() *retryablehttp.Client {
-	client := retryablehttp.NewClient()
-	client.RetryMax = 3
-	client.Logger = nil
-	return client
+	httpClientOnce.Do(func() {
+		httpClient = retryablehttp.NewClient()
+		httpClient.RetryMax = 3
+		httpClient.Logger = nil
+	})
+	return httpClient
 }
 
 // Batch performs a batch operation on objects and returns the result.
@@ -180,33 +196,44 @@ func (c *Client) Batch(operation string, reqObjects []*BatchObject, ref string,
 	return response, nil
 }
 
-// GetObject performs an HTTP GET request for the object
+// GetObject performs an HTTP GET request for the object. If the storage accepts
+// range requests, an interrupted download is resumed from where it stopped.
 func (c *Client) GetObject(_, href string, headers map[string]string) (io.ReadCloser, int64, error) {
-	req, _ := newHTTPRequest(http.MethodGet, href, nil)
-	for key, value := range headers {
-		req.Header.Add(key, value)
-	}
-
-	client := newHTTPClient()
-	// See https://gitlab.com/gitlab-org/gitlab-shell/-/merge_requests/989#note_1891153531 for
-	// discussion on bypassing the linter
-	res, err := client.Do(req) // nolint:bodyclose
+	res, err := getObjectRange(href, headers, 0)
 	if err != nil {
 		return nil, 0, err
 	}
 	if res.StatusCode < 200 || res.StatusCode > 299 {
+		_ = res.Body.Close()
 		return nil, 0, fs.ErrNotExist
 	}
 
-	return res.Body, res.ContentLength, nil
+	return newResumingReader(href, headers, res), res.ContentLength, nil
+}
+
+// PutObject performs an HTTP PUT request for the object, streaming it from r
+// with size as the content length. A negative size is unknown. A failed upload
+// isn't retried, since the object can only be read once.
+func (c *Client) PutObject(_ string, size int64, href string, headers map[string]string, r io.Reader) error {
+	return putObject(href, headers, size, r)
 }
 
-// PutObject performs an HTTP PUT request for the object
-func (c *Client) PutObject(_, href string, headers map[string]string, r io.Reader) error {
-	req, _ := newHTTPRequest(http.MethodPut, href, r)
+// VerifyObject asks GitLab to confirm that the uploaded object has been stored with the expected size
+func (c *Client) VerifyObject(oid string, size int64, href string, headers map[string]string) error {
+	jsonData, err := json.Marshal(&verifyRequest{Oid: oid, Size: size})
+	if err != nil {
+		return err
+	}
+
+	req, err := newHTTPRequest(http.MethodPost, href, bytes.NewReader(jsonData))
+	if err != nil {
+		return err
+	}
 	for key, value := range headers {
 		req.Header.Add(key, value)
 	}
+	req.Header.Set("Content-Type", c.header)
+	req.Header.Set("Accept", c.header)
 
 	client := newHTTPClient()
 	res, err := client.Do(req)
@@ -327,6 +354,8 @@ func (c *Client) Unlock(id string, force bool, refname string) (*Lock, error) {
 		return nil, transfer.ErrForbidden
 	case res.StatusCode == http.StatusNotFound:
 		return nil, transfer.ErrNotFound
+	case res.StatusCode == http.StatusConflict:
+		return nil, transfer.ErrConflict
 	default:
 		return nil, fmt.Errorf("internal error")
 	}
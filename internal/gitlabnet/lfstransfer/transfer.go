@@ -0,0 +1,224 @@
+package lfstransfer
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/charmbracelet/git-lfs-transfer/transfer"
+	"github.com/hashicorp/go-retryablehttp"
+
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/metrics"
+)
+
+const (
+	downloadOperation = "download"
+	uploadOperation   = "upload"
+
+	// maxResumes is the number of times the transfer of a single object is
+	// resumed after it has been interrupted
+	maxResumes = 3
+)
+
+var errNotResumable = errors.New("transfer can't be resumed")
+
+// sizeBucket groups the objects by size in the transfer metrics
+func sizeBucket(size int64) string {
+	switch {
+	case size < 0:
+		return "unknown"
+	case size < 1<<20:
+		return "lt_1MiB"
+	case size < 100<<20:
+		return "lt_100MiB"
+	case size < 1<<30:
+		return "lt_1GiB"
+	default:
+		return "gte_1GiB"
+	}
+}
+
+func observeTransfer(operation string, size int64, start time.Time, err error) {
+	bucket := sizeBucket(size)
+	status := "success"
+	if err != nil {
+		status = "failure"
+	}
+
+	metrics.LfsObjectTransfersTotal.WithLabelValues(operation, bucket, status).Inc()
+	metrics.LfsObjectTransferDuration.WithLabelValues(operation, bucket).Observe(time.Since(start).Seconds())
+}
+
+func getObjectRange(href string, headers map[string]string, offset int64) (*http.Response, error) {
+	req, err := newHTTPRequest(http.MethodGet, href, nil)
+	if err != nil {
+		return nil, err
+	}
+	for key, value := range headers {
+		req.Header.Add(key, value)
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+
+	// See https://gitlab.com/gitlab-org/gitlab-shell/-/merge_requests/989#note_1891153531 for
+	// discussion on bypassing the linter
+	return newHTTPClient().Do(req) // nolint:bodyclose
+}
+
+// resumingReader reads the body of a download and requests the rest of the
+// object with a range request when the body is interrupted
+type resumingReader struct {
+	href      string
+	headers   map[string]string
+	body      io.ReadCloser
+	size      int64
+	offset    int64
+	resumable bool
+	resumes   int
+	start     time.Time
+	done      bool
+}
+
+func newResumingReader(href string, headers map[string]string, res *http.Response) *resumingReader {
+	return &resumingReader{
+		href:      href,
+		headers:   headers,
+		body:      res.Body,
+		size:      res.ContentLength,
+		resumable: res.ContentLength > 0 && res.Header.Get("Accept-Ranges") == "bytes",
+		start:     time.Now(),
+	}
+}
+
+func (r *resumingReader) Read(p []byte) (int, error) {
+	n, err := r.body.Read(p)
+	r.offset += int64(n)
+
+	switch {
+	case err == nil:
+		return n, nil
+	case errors.Is(err, io.EOF):
+		r.finish(nil)
+		return n, err
+	}
+
+	if resumeErr := r.resume(); resumeErr != nil {
+		r.finish(err)
+		return n, err
+	}
+
+	return n, nil
+}
+
+func (r *resumingReader) resume() error {
+	if !r.resumable || r.resumes >= maxResumes {
+		return errNotResumable
+	}
+
+	_ = r.body.Close()
+
+	res, err := getObjectRange(r.href, r.headers, r.offset)
+	if err != nil {
+		return err
+	}
+
+	var start int64
+	_, err = fmt.Sscanf(res.Header.Get("Content-Range"), "bytes %d-", &start)
+	if res.StatusCode != http.StatusPartialContent || err != nil || start != r.offset {
+		_ = res.Body.Close()
+		return errNotResumable
+	}
+
+	r.body = res.Body
+	r.resumes++
+	metrics.LfsObjectTransferResumes.WithLabelValues(downloadOperation, sizeBucket(r.size)).Inc()
+
+	return nil
+}
+
+func (r *resumingReader) finish(err error) {
+	if r.done {
+		return
+	}
+	r.done = true
+
+	observeTransfer(downloadOperation, r.size, r.start, err)
+}
+
+func (r *resumingReader) Close() error {
+	// The object has been closed before it has been read entirely
+	r.finish(io.ErrUnexpectedEOF)
+
+	return r.body.Close()
+}
+
+// putObject streams the object to the storage. A failed upload isn't retried:
+// the data sent by the client is read once, while its size and checksum are
+// verified, and the storage can't resume an upload from an offset.
+func putObject(href string, headers map[string]string, size int64, r io.Reader) (err error) {
+	start := time.Now()
+	defer func() { observeTransfer(uploadOperation, size, start, err) }()
+
+	res, err := sendObject(newHTTPClient(), href, headers, size, r)
+	if err != nil {
+		return err
+	}
+	_ = res.Body.Close()
+
+	switch {
+	case res.StatusCode == http.StatusNotFound:
+		return transfer.ErrNotFound
+	case res.StatusCode < 200 || res.StatusCode > 299:
+		return fmt.Errorf("internal error (%d)", res.StatusCode)
+	}
+
+	return nil
+}
+
+// sendObject sends the object in a single request. The retryable client isn't
+// used to send it, as it reads the whole body in memory when it can't seek it.
+func sendObject(client *retryablehttp.Client, href string, headers map[string]string, size int64, r io.Reader) (*http.Response, error) {
+	body := &objectReader{r: r}
+
+	req, err := http.NewRequest(http.MethodPut, href, body)
+	if err != nil {
+		return nil, err
+	}
+	if size >= 0 {
+		req.ContentLength = size
+	}
+	for key, value := range headers {
+		req.Header.Add(key, value)
+	}
+
+	res, err := client.HTTPClient.Do(req) // nolint:bodyclose
+	if err != nil && body.err != nil {
+		// The object couldn't be read, for instance because it's corrupt,
+		// which is reported as is rather than as a failed request
+		return nil, body.err
+	}
+
+	return res, err
+}
+
+// objectReader keeps the error of the object, which the HTTP client wraps
+type objectReader struct {
+	r   io.Reader
+	err error
+}
+
+func (o *objectReader) Read(p []byte) (int, error) {
+	n, err := o.r.Read(p)
+	if err != nil && !errors.Is(err, io.EOF) {
+		o.err = err
+	}
+
+	return n, err
+}
+
+func (o *objectReader) Close() error {
+	return nil
+}
@@ -0,0 +1,226 @@
+package lfstransfer
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/metrics"
+)
+
+var objectContents = strings.Repeat("0123456789", 1000)
+
+func init() {
+	newHTTPClient().RetryWaitMin = time.Millisecond
+	newHTTPClient().RetryWaitMax = time.Millisecond
+}
+
+func TestSizeBucket(t *testing.T) {
+	testCases := []struct {
+		size     int64
+		expected string
+	}{
+		{size: -1, expected: "unknown"},
+		{size: 0, expected: "lt_1MiB"},
+		{size: 1<<20 - 1, expected: "lt_1MiB"},
+		{size: 1 << 20, expected: "lt_100MiB"},
+		{size: 100 << 20, expected: "lt_1GiB"},
+		{size: 1 << 30, expected: "gte_1GiB"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(strconv.FormatInt(tc.size, 10), func(t *testing.T) {
+			require.Equal(t, tc.expected, sizeBucket(tc.size))
+		})
+	}
+}
+
+func TestGetObject(t *testing.T) {
+	testCases := []struct {
+		desc          string
+		acceptRanges  bool
+		expectedError bool
+	}{
+		{
+			desc:         "resumes an interrupted download",
+			acceptRanges: true,
+		},
+		{
+			desc:          "fails an interrupted download without range support",
+			expectedError: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				assert.Equal(t, "Basic 1234567890", r.Header.Get("Authorization"))
+
+				if tc.acceptRanges {
+					w.Header().Set("Accept-Ranges", "bytes")
+				}
+
+				rangeHeader := r.Header.Get("Range")
+				if rangeHeader == "" {
+					// Send half of the object and drop the connection
+					w.Header().Set("Content-Length", strconv.Itoa(len(objectContents)))
+					w.WriteHeader(http.StatusOK)
+					w.Write([]byte(objectContents[:len(objectContents)/2]))
+					w.(http.Flusher).Flush()
+
+					conn, _, err := w.(http.Hijacker).Hijack()
+					assert.NoError(t, err)
+					conn.Close()
+					return
+				}
+
+				var offset int
+				_, err := fmt.Sscanf(rangeHeader, "bytes=%d-", &offset)
+				assert.NoError(t, err)
+
+				w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, len(objectContents)-1, len(objectContents)))
+				w.WriteHeader(http.StatusPartialContent)
+				w.Write([]byte(objectContents[offset:]))
+			}))
+			defer server.Close()
+
+			resumes := testutil.ToFloat64(metrics.LfsObjectTransferResumes.WithLabelValues("download", "lt_1MiB"))
+
+			client := &Client{}
+			body, size, err := client.GetObject("oid", server.URL, map[string]string{"Authorization": "Basic 1234567890"})
+			require.NoError(t, err)
+			require.Equal(t, int64(len(objectContents)), size)
+
+			data, err := io.ReadAll(body)
+			require.NoError(t, body.Close())
+
+			if tc.expectedError {
+				require.Error(t, err)
+				require.Equal(t, resumes, testutil.ToFloat64(metrics.LfsObjectTransferResumes.WithLabelValues("download", "lt_1MiB")))
+				return
+			}
+
+			require.NoError(t, err)
+			require.Equal(t, objectContents, string(data))
+			require.Equal(t, resumes+1, testutil.ToFloat64(metrics.LfsObjectTransferResumes.WithLabelValues("download", "lt_1MiB")))
+		})
+	}
+}
+
+func TestGetObjectNotFound(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+
+	client := &Client{}
+	_, _, err := client.GetObject("oid", server.URL, nil)
+	require.Error(t, err)
+}
+
+// oneShotReader can only be read once, like the data sent by the client
+type oneShotReader struct {
+	io.Reader
+}
+
+func TestPutObject(t *testing.T) {
+	var contentLength int64
+	var transferEncoding []string
+	var received string
+
+	server := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "Basic 1234567890", r.Header.Get("Authorization"))
+
+		body, err := io.ReadAll(r.Body)
+		assert.NoError(t, err)
+
+		contentLength = r.ContentLength
+		transferEncoding = r.TransferEncoding
+		received = string(body)
+	}))
+	defer server.Close()
+
+	client := &Client{}
+	err := client.PutObject("oid", int64(len(objectContents)), server.URL, map[string]string{"Authorization": "Basic 1234567890"}, oneShotReader{strings.NewReader(objectContents)})
+	require.NoError(t, err)
+	require.Equal(t, int64(len(objectContents)), contentLength)
+	require.Empty(t, transferEncoding)
+	require.Equal(t, objectContents, received)
+}
+
+func TestPutObjectIsNotRetried(t *testing.T) {
+	var mu sync.Mutex
+	calls := 0
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		calls++
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	client := &Client{}
+	err := client.PutObject("oid", int64(len(objectContents)), server.URL, nil, strings.NewReader(objectContents))
+	require.EqualError(t, err, "internal error (503)")
+	require.Equal(t, 1, calls)
+}
+
+func TestPutObjectErrors(t *testing.T) {
+	testCases := []struct {
+		desc          string
+		status        int
+		expectedError string
+		expectedCalls int
+	}{
+		{
+			desc:          "not found",
+			status:        http.StatusNotFound,
+			expectedError: "not found",
+			expectedCalls: 1,
+		},
+		{
+			desc:          "client error",
+			status:        http.StatusForbidden,
+			expectedError: "internal error (403)",
+			expectedCalls: 1,
+		},
+		{
+			desc:          "server error",
+			status:        http.StatusInternalServerError,
+			expectedError: "internal error (500)",
+			expectedCalls: 1,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			var mu sync.Mutex
+			calls := 0
+
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method == http.MethodPut {
+					mu.Lock()
+					calls++
+					mu.Unlock()
+				}
+				w.WriteHeader(tc.status)
+			}))
+			defer server.Close()
+
+			client := &Client{}
+			err := client.PutObject("oid", int64(len(objectContents)), server.URL, nil, strings.NewReader(objectContents))
+			require.EqualError(t, err, tc.expectedError)
+			require.Equal(t, tc.expectedCalls, calls)
+		})
+	}
+}
@@ -0,0 +1,95 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	grpccodes "google.golang.org/grpc/codes"
+	grpcstatus "google.golang.org/grpc/status"
+
+	pb "gitlab.com/gitlab-org/gitaly/v16/proto/go/gitalypb"
+	"gitlab.com/gitlab-org/labkit/log"
+
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/command"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/concurrencylimit"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/console"
+)
+
+const (
+	rootNamespaceScope = "root_namespace"
+	projectScope       = "project"
+)
+
+// concurrencyLimiter is shared by all the Git commands of the process
+var concurrencyLimiter = concurrencylimit.New()
+
+// WaitForConcurrencyLimits waits until the Git command fits in the limits of
+// concurrent Git operations on its root namespace and project. A notice is
+// written to errOut if the command is queued. A command that stays queued
+// for longer than the queue timeout is rejected with a limit error. The
+// returned function must be called once the command is done.
+func (gc *GitalyCommand) WaitForConcurrencyLimits(ctx context.Context, errOut io.Writer) (func(), error) {
+	cfg := gc.Config.ConcurrencyLimits
+	meta := command.NewLogData(gc.Response.Gitaly.Repo.GlProjectPath, gc.Response.Username, gc.Response.ProjectID, gc.Response.RootNamespaceID).Meta
+
+	limits := []concurrencylimit.Limit{
+		{Scope: rootNamespaceScope, Key: meta.RootNamespace, Max: concurrencyLimit(cfg.RootNamespaces, meta.RootNamespace, cfg.RootNamespace)},
+		{Scope: projectScope, Key: meta.Project, Max: concurrencyLimit(cfg.Projects, meta.Project, cfg.Project)},
+	}
+
+	start := time.Now()
+	queued := false
+	release, err := concurrencyLimiter.Acquire(ctx, limits, time.Duration(cfg.QueueTimeout), func() {
+		queued = true
+		log.WithContextFields(ctx, log.Fields{"meta": meta}).Info("Git command queued by concurrency limits")
+		console.DisplayInfoMessage("Too many Git operations are running on this project or group, your request has been queued.", errOut)
+	})
+
+	var timeoutErr *concurrencylimit.QueueTimeoutError
+	if errors.As(err, &timeoutErr) {
+		log.WithContextFields(ctx, log.Fields{"meta": meta, "scope": timeoutErr.Limit.Scope}).Warn("Git command rejected by concurrency limits")
+
+		return nil, queueTimeoutError(timeoutErr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if queued {
+		log.WithContextFields(ctx, log.Fields{"meta": meta, "wait_duration_s": time.Since(start).Seconds()}).Info("Git command dequeued by concurrency limits")
+	}
+
+	return release, nil
+}
+
+// concurrencyLimit returns the limit for key, or the default limit if it isn't overridden
+func concurrencyLimit(overrides map[string]int, key string, defaultLimit int) int {
+	if key == "" {
+		return 0
+	}
+
+	if limit, ok := overrides[key]; ok {
+		return limit
+	}
+
+	return defaultLimit
+}
+
+// queueTimeoutError is a limit error, so that the client is told to try again later
+func queueTimeoutError(err *concurrencylimit.QueueTimeoutError) error {
+	scope := "group"
+	if err.Limit.Scope == projectScope {
+		scope = "project"
+	}
+	message := fmt.Sprintf("GitLab is currently unable to handle this request due to load. Too many Git operations are running on the %s %s.", scope, err.Limit.Key)
+
+	st, stErr := grpcstatus.New(grpccodes.Unavailable, message).WithDetails(&pb.LimitError{ErrorMessage: err.Error()})
+	if stErr != nil {
+		return grpcstatus.Error(grpccodes.Unavailable, message)
+	}
+
+	return st.Err()
+}
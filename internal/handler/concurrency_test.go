@@ -0,0 +1,71 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	grpccodes "google.golang.org/grpc/codes"
+	grpcstatus "google.golang.org/grpc/status"
+
+	pb "gitlab.com/gitlab-org/gitaly/v16/proto/go/gitalypb"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/command/commandargs"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/config"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/gitlabnet/accessverifier"
+)
+
+func newConcurrencyLimitedCommand(limits config.ConcurrencyLimitsConfig, project string) *GitalyCommand {
+	cfg := newConfig()
+	cfg.ConcurrencyLimits = limits
+
+	return NewGitalyCommand(cfg, string(commandargs.UploadPack), &accessverifier.Response{
+		Gitaly: accessverifier.Gitaly{
+			Address: "tcp://localhost:9999",
+			Repo:    pb.Repository{GlProjectPath: project},
+		},
+	})
+}
+
+func TestWaitForConcurrencyLimits(t *testing.T) {
+	limits := config.ConcurrencyLimitsConfig{
+		RootNamespace: 10,
+		Project:       5,
+		Projects:      map[string]int{"limited-group/monorepo": 1},
+		QueueTimeout:  config.YamlDuration(10 * time.Millisecond),
+	}
+
+	gc := newConcurrencyLimitedCommand(limits, "limited-group/monorepo")
+	release, err := gc.WaitForConcurrencyLimits(context.Background(), &bytes.Buffer{})
+	require.NoError(t, err)
+
+	// Another project of the group isn't limited by the override
+	other := newConcurrencyLimitedCommand(limits, "limited-group/other")
+	otherRelease, err := other.WaitForConcurrencyLimits(context.Background(), &bytes.Buffer{})
+	require.NoError(t, err)
+	otherRelease()
+
+	errOut := &bytes.Buffer{}
+	_, err = gc.WaitForConcurrencyLimits(context.Background(), errOut)
+	require.Contains(t, errOut.String(), "remote: Too many Git operations are running on this project or group, your request has been queued.")
+
+	require.True(t, IsLimitError(err))
+	require.Equal(t, grpccodes.Unavailable, grpcstatus.Code(err))
+	require.Equal(t, "GitLab is currently unable to handle this request due to load. Too many Git operations are running on the project limited-group/monorepo.", grpcstatus.Convert(err).Message())
+
+	release()
+
+	release, err = gc.WaitForConcurrencyLimits(context.Background(), &bytes.Buffer{})
+	require.NoError(t, err)
+	release()
+}
+
+func TestConcurrencyLimit(t *testing.T) {
+	overrides := map[string]int{"group": 3, "unlimited": 0}
+
+	require.Equal(t, 3, concurrencyLimit(overrides, "group", 10))
+	require.Equal(t, 0, concurrencyLimit(overrides, "unlimited", 10))
+	require.Equal(t, 10, concurrencyLimit(overrides, "other", 10))
+	require.Equal(t, 0, concurrencyLimit(overrides, "", 10))
+}
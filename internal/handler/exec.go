@@ -4,17 +4,22 @@ package handler
 import (
 	"context"
 	"fmt"
+	"io"
 	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"google.golang.org/grpc"
 	grpccodes "google.golang.org/grpc/codes"
 	"google.golang.org/grpc/metadata"
 	grpcstatus "google.golang.org/grpc/status"
 
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/command/readwriter"
 	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/config"
 	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/gitaly"
 	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/gitlabnet/accessverifier"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/metrics"
 	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/sshenv"
 
 	pb "gitlab.com/gitlab-org/gitaly/v16/proto/go/gitalypb"
@@ -31,6 +36,8 @@ type GitalyCommand struct {
 	Config   *config.Config
 	Response *accessverifier.Response
 	Command  gitaly.Command
+
+	tracker *clientTracker
 }
 
 // NewGitalyCommand creates a new GitalyCommand instance
@@ -44,27 +51,119 @@ func NewGitalyCommand(cfg *config.Config, serviceName string, response *accessve
 	return &GitalyCommand{Config: cfg, Response: response, Command: gc}
 }
 
+// clientEnvMetadataPrefix prefixes the names of the client environment
+// variables in the Gitaly metadata
+const clientEnvMetadataPrefix = "client_env_"
+
+// LimitErrorExitStatus is the exit status of a command that Gitaly rejected
+// because of load. It's EX_TEMPFAIL, so that the client can tell it apart and
+// try again later.
+const LimitErrorExitStatus = 75
+
 // processGitalyError handles errors that come back from Gitaly that may be a
 // LimitError. A LimitError is returned by Gitaly when it is at its limit in
 // handling requests. Since this is a known error, we should print a sensible
-// error message to the end user.
+// error message to the end user, including when to try again if Gitaly
+// suggested it.
 func processGitalyError(statusErr error) error {
+	if limitErr := limitError(statusErr); limitErr != nil {
+		message := "GitLab is currently unable to handle this request due to load."
+		if retryAfter := limitErr.GetRetryAfter().AsDuration(); retryAfter > 0 {
+			seconds := int64((retryAfter + time.Second - 1) / time.Second)
+			message = fmt.Sprintf("%s Please try again in %d second(s).", message, seconds)
+		}
+
+		st, err := grpcstatus.New(grpccodes.Unavailable, message).WithDetails(limitErr)
+		if err != nil {
+			return grpcstatus.Error(grpccodes.Unavailable, message)
+		}
+
+		return st.Err()
+	}
+
+	return grpcstatus.Error(grpccodes.Unavailable, "The git server, Gitaly, is not available at this time. Please contact your administrator.")
+}
+
+// IsLimitError tells whether Gitaly rejected the call because of load
+func IsLimitError(err error) bool {
+	return limitError(err) != nil
+}
+
+func limitError(statusErr error) *pb.LimitError {
 	if st, ok := grpcstatus.FromError(statusErr); ok {
-		details := st.Details()
-		for _, detail := range details {
-			if _, ok := detail.(*pb.LimitError); ok {
-				return grpcstatus.Error(grpccodes.Unavailable, "GitLab is currently unable to handle this request due to load.")
+		for _, detail := range st.Details() {
+			if limitErr, ok := detail.(*pb.LimitError); ok {
+				return limitErr
 			}
 		}
 	}
 
-	return grpcstatus.Error(grpccodes.Unavailable, "The git server, Gitaly, is not available at this time. Please contact your administrator.")
+	return nil
+}
+
+// TrackReadWriter returns a ReadWriter for the handler that records whether
+// the client has been read from or written to. Until then, a call that fails
+// because Gitaly is unavailable is retried by RunGitalyCommand, since the
+// client hasn't seen any part of it.
+func (gc *GitalyCommand) TrackReadWriter(rw *readwriter.ReadWriter) *readwriter.ReadWriter {
+	gc.tracker = &clientTracker{}
+
+	return &readwriter.ReadWriter{
+		In:     &trackedReader{r: rw.In, tracker: gc.tracker},
+		Out:    &trackedWriter{w: rw.Out, tracker: gc.tracker},
+		ErrOut: &trackedWriter{w: rw.ErrOut, tracker: gc.tracker},
+	}
 }
 
 // RunGitalyCommand provides a bootstrap for Gitaly commands executed
 // through GitLab-Shell. It ensures that logging, tracing and other
 // common concerns are configured before executing the `handler`.
 func (gc *GitalyCommand) RunGitalyCommand(ctx context.Context, handler GitalyHandlerFunc) error {
+	retryCfg := gc.Config.Gitaly
+	backoff := time.Duration(retryCfg.RetryInitialBackoff)
+
+	for attempt := 1; ; attempt++ {
+		err := gc.runGitalyCommand(ctx, handler)
+		if grpcstatus.Code(err) != grpccodes.Unavailable {
+			return err
+		}
+
+		if IsLimitError(err) {
+			metrics.GitalyLimitErrorsTotal.WithLabelValues(gc.Command.ServiceName).Inc()
+		}
+
+		if !gc.canRetry(err, attempt) {
+			return processGitalyError(err)
+		}
+
+		log.WithContextFields(ctx, log.Fields{
+			"attempt": attempt,
+			"backoff": backoff.String(),
+		}).Warn("Gitaly is not available, retrying the Git command")
+		metrics.GitalyRetriedCallsTotal.WithLabelValues(gc.Command.ServiceName).Inc()
+
+		select {
+		case <-ctx.Done():
+			return processGitalyError(err)
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if maxBackoff := time.Duration(retryCfg.RetryMaxBackoff); maxBackoff > 0 && backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// canRetry tells whether the failed call can be made again. Calls rejected by
+// Gitaly because of load aren't retried, to not add to it.
+func (gc *GitalyCommand) canRetry(err error, attempt int) bool {
+	return attempt < gc.Config.Gitaly.RetryMaxAttempts &&
+		gc.tracker != nil && !gc.tracker.used.Load() &&
+		!IsLimitError(err)
+}
+
+func (gc *GitalyCommand) runGitalyCommand(ctx context.Context, handler GitalyHandlerFunc) error {
 	// We leave the connection open for future reuse
 	conn, err := gc.getConn(ctx)
 	if err != nil {
@@ -79,10 +178,6 @@ func (gc *GitalyCommand) RunGitalyCommand(ctx context.Context, handler GitalyHan
 
 	if err != nil {
 		ctxlog.WithError(err).WithFields(log.Fields{"exit_status": exitStatus}).Error("Failed to execute Git command")
-
-		if grpcstatus.Code(err) == grpccodes.Unavailable {
-			return processGitalyError(err)
-		}
 	}
 
 	return err
@@ -103,6 +198,9 @@ func (gc *GitalyCommand) PrepareContext(ctx context.Context, repository *pb.Repo
 	md.Append("user_id", gc.Response.UserID)
 	md.Append("username", gc.Response.Username)
 	md.Append("remote_ip", env.RemoteAddr)
+	for name, value := range env.ClientEnv {
+		md.Append(clientEnvMetadataPrefix+strings.ToLower(name), value)
+	}
 	ctx = metadata.NewOutgoingContext(ctx, md)
 
 	return ctx, cancel
@@ -140,3 +238,30 @@ func withOutgoingMetadata(ctx context.Context, features map[string]string) conte
 func (gc *GitalyCommand) getConn(ctx context.Context) (*grpc.ClientConn, error) {
 	return gc.Config.GitalyClient.GetConnection(ctx, gc.Command)
 }
+
+// clientTracker records whether the client has been read from or written to.
+// It's set as soon as a read or a write starts, since a read that blocks may
+// still consume data once the call has been retried.
+type clientTracker struct {
+	used atomic.Bool
+}
+
+type trackedReader struct {
+	r       io.Reader
+	tracker *clientTracker
+}
+
+func (tr *trackedReader) Read(p []byte) (int, error) {
+	tr.tracker.used.Store(true)
+	return tr.r.Read(p)
+}
+
+type trackedWriter struct {
+	w       io.Writer
+	tracker *clientTracker
+}
+
+func (tw *trackedWriter) Write(p []byte) (int, error) {
+	tw.tracker.used.Store(true)
+	return tw.w.Write(p)
+}
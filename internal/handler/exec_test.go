@@ -1,10 +1,14 @@
 package handler
 
 import (
+	"bytes"
 	"context"
 	"errors"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/require"
 	"google.golang.org/grpc"
 	grpccodes "google.golang.org/grpc/codes"
@@ -13,8 +17,10 @@ import (
 
 	pb "gitlab.com/gitlab-org/gitaly/v16/proto/go/gitalypb"
 	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/command/commandargs"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/command/readwriter"
 	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/config"
 	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/gitlabnet/accessverifier"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/metrics"
 	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/sshenv"
 	"google.golang.org/protobuf/proto"
 	"google.golang.org/protobuf/types/known/anypb"
@@ -91,19 +97,148 @@ func TestUnavailableGitalyErr(t *testing.T) {
 	require.Equal(t, err, grpcstatus.Error(grpccodes.Unavailable, "The git server, Gitaly, is not available at this time. Please contact your administrator."))
 }
 
-func TestGitalyLimitErr(t *testing.T) {
-	cmd := NewGitalyCommand(
-		newConfig(),
-		string(commandargs.UploadPack),
-		&accessverifier.Response{
-			Gitaly: accessverifier.Gitaly{Address: "tcp://localhost:9999"},
-		},
-	)
+func TestRetryUnavailableGitalyErr(t *testing.T) {
+	unavailableErr := grpcstatus.Error(grpccodes.Unavailable, "error")
 	limitErr := errWithDetail(t, &pb.LimitError{
 		ErrorMessage: "concurrency queue wait time reached",
 		RetryAfter:   durationpb.New(0)})
-	err := cmd.RunGitalyCommand(context.Background(), makeHandler(t, limitErr))
-	require.Equal(t, err, grpcstatus.Error(grpccodes.Unavailable, "GitLab is currently unable to handle this request due to load."))
+
+	testCases := []struct {
+		desc          string
+		useClient     func(rw *readwriter.ReadWriter)
+		errs          []error
+		expectedCalls int
+		expectedErr   error
+	}{
+		{
+			desc:          "retried until success",
+			errs:          []error{unavailableErr, unavailableErr, nil},
+			expectedCalls: 3,
+		},
+		{
+			desc:          "attempts exhausted",
+			errs:          []error{unavailableErr, unavailableErr, unavailableErr},
+			expectedCalls: 3,
+			expectedErr:   grpcstatus.Error(grpccodes.Unavailable, "The git server, Gitaly, is not available at this time. Please contact your administrator."),
+		},
+		{
+			desc:          "output written",
+			useClient:     func(rw *readwriter.ReadWriter) { rw.Out.Write([]byte("output")) },
+			errs:          []error{unavailableErr, nil},
+			expectedCalls: 1,
+			expectedErr:   grpcstatus.Error(grpccodes.Unavailable, "The git server, Gitaly, is not available at this time. Please contact your administrator."),
+		},
+		{
+			desc:          "input read",
+			useClient:     func(rw *readwriter.ReadWriter) { rw.In.Read(make([]byte, 1)) },
+			errs:          []error{unavailableErr, nil},
+			expectedCalls: 1,
+			expectedErr:   grpcstatus.Error(grpccodes.Unavailable, "The git server, Gitaly, is not available at this time. Please contact your administrator."),
+		},
+		{
+			desc:          "limit error",
+			errs:          []error{limitErr, nil},
+			expectedCalls: 1,
+			expectedErr:   grpcstatus.Error(grpccodes.Unavailable, "GitLab is currently unable to handle this request due to load."),
+		},
+		{
+			desc:          "other error",
+			errs:          []error{grpcstatus.Error(grpccodes.Internal, "error"), nil},
+			expectedCalls: 1,
+			expectedErr:   grpcstatus.Error(grpccodes.Internal, "error"),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			cfg := newConfig()
+			cfg.Gitaly = config.GitalyConfig{
+				RetryMaxAttempts:    3,
+				RetryInitialBackoff: config.YamlDuration(time.Millisecond),
+			}
+			cmd := NewGitalyCommand(
+				cfg,
+				string(commandargs.UploadPack),
+				&accessverifier.Response{
+					Gitaly: accessverifier.Gitaly{Address: "tcp://localhost:9999"},
+				},
+			)
+			rw := cmd.TrackReadWriter(&readwriter.ReadWriter{
+				In:     strings.NewReader("input"),
+				Out:    &bytes.Buffer{},
+				ErrOut: &bytes.Buffer{},
+			})
+
+			retries := testutil.ToFloat64(metrics.GitalyRetriedCallsTotal.WithLabelValues(string(commandargs.UploadPack)))
+
+			calls := 0
+			err := cmd.RunGitalyCommand(context.Background(), func(_ context.Context, _ *grpc.ClientConn) (int32, error) {
+				if tc.useClient != nil {
+					tc.useClient(rw)
+				}
+				err := tc.errs[calls]
+				calls++
+
+				return 0, err
+			})
+
+			if tc.expectedErr == nil {
+				require.NoError(t, err)
+			} else {
+				require.EqualError(t, err, tc.expectedErr.Error())
+			}
+			require.Equal(t, tc.expectedCalls, calls)
+			require.InDelta(t, retries+float64(tc.expectedCalls-1), testutil.ToFloat64(metrics.GitalyRetriedCallsTotal.WithLabelValues(string(commandargs.UploadPack))), 0.1)
+		})
+	}
+}
+
+func TestGitalyLimitErr(t *testing.T) {
+	testCases := []struct {
+		desc            string
+		retryAfter      time.Duration
+		expectedMessage string
+	}{
+		{
+			desc:            "without retry after",
+			expectedMessage: "GitLab is currently unable to handle this request due to load.",
+		},
+		{
+			desc:            "with retry after",
+			retryAfter:      4500 * time.Millisecond,
+			expectedMessage: "GitLab is currently unable to handle this request due to load. Please try again in 5 second(s).",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			cmd := NewGitalyCommand(
+				newConfig(),
+				string(commandargs.UploadPack),
+				&accessverifier.Response{
+					Gitaly: accessverifier.Gitaly{Address: "tcp://localhost:9999"},
+				},
+			)
+			limitErr := errWithDetail(t, &pb.LimitError{
+				ErrorMessage: "concurrency queue wait time reached",
+				RetryAfter:   durationpb.New(tc.retryAfter)})
+
+			limitErrors := testutil.ToFloat64(metrics.GitalyLimitErrorsTotal.WithLabelValues(string(commandargs.UploadPack)))
+
+			err := cmd.RunGitalyCommand(context.Background(), makeHandler(t, limitErr))
+			require.Equal(t, grpccodes.Unavailable, grpcstatus.Code(err))
+			require.Equal(t, tc.expectedMessage, grpcstatus.Convert(err).Message())
+			require.True(t, IsLimitError(err))
+			require.InDelta(t, limitErrors+1, testutil.ToFloat64(metrics.GitalyLimitErrorsTotal.WithLabelValues(string(commandargs.UploadPack))), 0.1)
+		})
+	}
+}
+
+func TestIsLimitError(t *testing.T) {
+	require.False(t, IsLimitError(nil))
+	require.False(t, IsLimitError(errors.New("error")))
+	require.False(t, IsLimitError(grpcstatus.Error(grpccodes.Unavailable, "error")))
+	require.True(t, IsLimitError(errWithDetail(t, &pb.LimitError{})))
 }
 
 func TestRunGitalyCommandMetadata(t *testing.T) {
@@ -203,6 +338,44 @@ func TestPrepareContext(t *testing.T) {
 				"remote_ip": "10.0.0.1",
 			},
 		},
+		{
+			name: "client_env",
+			gc: NewGitalyCommand(
+				&config.Config{},
+				string(commandargs.UploadPack),
+				&accessverifier.Response{
+					KeyID:    1,
+					KeyType:  "key",
+					UserID:   "6",
+					Username: "jane.doe",
+					Gitaly: accessverifier.Gitaly{
+						Address: "tcp://localhost:9999",
+					},
+				},
+			),
+			env: sshenv.Env{
+				IsSSHConnection: true,
+				RemoteAddr:      "10.0.0.1",
+				ClientEnv: map[string]string{
+					"GIT_TRACE2_PARENT_SID": "20241017T000000.000000Z-H1234-P5678",
+					"LANG":                  "en_US.UTF-8",
+				},
+			},
+			repo: &pb.Repository{
+				StorageName:  "default",
+				RelativePath: "@hashed/5f/9c/5f9c4ab08cac7457e9111a30e4664920607ea2c115a1433d7be98e97e64244ca.git",
+				GlRepository: "project-26",
+			},
+			want: map[string]string{
+				"key_id":                           "1",
+				"key_type":                         "key",
+				"user_id":                          "6",
+				"username":                         "jane.doe",
+				"remote_ip":                        "10.0.0.1",
+				"client_env_git_trace2_parent_sid": "20241017T000000.000000Z-H1234-P5678",
+				"client_env_lang":                  "en_US.UTF-8",
+			},
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -0,0 +1,132 @@
+// Package iprules provides allow and deny lists of client IP addresses loaded from a file.
+// The file has one rule per line, "allow" or "deny" followed by an IP address or a CIDR
+// range. Empty lines and lines starting with # are ignored.
+package iprules
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Reasons for which an address is rejected
+const (
+	// ReasonDenied is returned for an address that matches a deny rule
+	ReasonDenied = "denied"
+	// ReasonNotAllowed is returned for an address that doesn't match any allow rule
+	ReasonNotAllowed = "not_allowed"
+)
+
+// Rules are allow and deny lists of IP addresses. They're immutable, so they're
+// safe for concurrent use; the file is read again by loading new rules.
+type Rules struct {
+	allow []netip.Prefix
+	deny  []netip.Prefix
+}
+
+// Load reads the rules from the file at path
+func Load(path string) (*Rules, error) {
+	data, err := os.ReadFile(filepath.Clean(path))
+	if err != nil {
+		return nil, err
+	}
+
+	allow, deny, err := parseRules(data)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Rules{allow: allow, deny: deny}, nil
+}
+
+// Check reports whether the address is rejected, and why. An address that matches
+// a deny rule is rejected. If there are allow rules, an address that doesn't match
+// any of them is rejected too. Nil rules and invalid addresses aren't rejected.
+func (r *Rules) Check(addr netip.Addr) (string, bool) {
+	if r == nil || !addr.IsValid() {
+		return "", false
+	}
+
+	addr = addr.Unmap()
+
+	if containsAddr(r.deny, addr) {
+		return ReasonDenied, true
+	}
+
+	if len(r.allow) > 0 && !containsAddr(r.allow, addr) {
+		return ReasonNotAllowed, true
+	}
+
+	return "", false
+}
+
+func containsAddr(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func parseRules(data []byte) ([]netip.Prefix, []netip.Prefix, error) {
+	var allow, deny []netip.Prefix
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, nil, fmt.Errorf("line %d: expected an action and an address", lineNumber)
+		}
+
+		prefix, err := parsePrefix(fields[1])
+		if err != nil {
+			return nil, nil, fmt.Errorf("line %d: %w", lineNumber, err)
+		}
+
+		switch fields[0] {
+		case "allow":
+			allow = append(allow, prefix)
+		case "deny":
+			deny = append(deny, prefix)
+		default:
+			return nil, nil, fmt.Errorf("line %d: unknown action %q", lineNumber, fields[0])
+		}
+	}
+
+	return allow, deny, scanner.Err()
+}
+
+func parsePrefix(value string) (netip.Prefix, error) {
+	if strings.Contains(value, "/") {
+		prefix, err := netip.ParsePrefix(value)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+
+		// Addresses are unmapped before they're checked
+		if prefix.Addr().Is4In6() && prefix.Bits() >= 96 {
+			return netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96), nil
+		}
+
+		return prefix.Masked(), nil
+	}
+
+	addr, err := netip.ParseAddr(value)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	addr = addr.Unmap()
+
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
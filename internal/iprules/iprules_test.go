@@ -0,0 +1,135 @@
+package iprules
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func writeRules(t *testing.T, filename string, rules string) {
+	require.NoError(t, os.WriteFile(filename, []byte(rules), 0o600))
+}
+
+func TestCheck(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		rules    string
+		addr     string
+		reason   string
+		rejected bool
+	}{
+		{
+			desc:  "no rules",
+			rules: "# Nothing yet\n",
+			addr:  "192.0.2.1",
+		},
+		{
+			desc:     "denied range",
+			rules:    "deny 192.0.2.0/24\n",
+			addr:     "192.0.2.1",
+			reason:   ReasonDenied,
+			rejected: true,
+		},
+		{
+			desc:  "outside of the denied range",
+			rules: "deny 192.0.2.0/24\n",
+			addr:  "198.51.100.1",
+		},
+		{
+			desc:  "allowed range",
+			rules: "allow 10.0.0.0/8\n",
+			addr:  "10.1.2.3",
+		},
+		{
+			desc:     "outside of the allowed ranges",
+			rules:    "allow 10.0.0.0/8\nallow 2001:db8::/32\n",
+			addr:     "198.51.100.1",
+			reason:   ReasonNotAllowed,
+			rejected: true,
+		},
+		{
+			desc:     "deny takes precedence over allow",
+			rules:    "allow 10.0.0.0/8\ndeny 10.1.0.0/16\n",
+			addr:     "10.1.2.3",
+			reason:   ReasonDenied,
+			rejected: true,
+		},
+		{
+			desc:     "single address",
+			rules:    "deny 192.0.2.1\n",
+			addr:     "192.0.2.1",
+			reason:   ReasonDenied,
+			rejected: true,
+		},
+		{
+			desc:  "IPv6 range",
+			rules: "allow 2001:db8::/32\n",
+			addr:  "2001:db8::1",
+		},
+		{
+			desc:     "IPv4-mapped IPv6 address",
+			rules:    "deny 192.0.2.0/24\n",
+			addr:     "::ffff:192.0.2.1",
+			reason:   ReasonDenied,
+			rejected: true,
+		},
+		{
+			desc:     "IPv4-mapped IPv6 range",
+			rules:    "deny ::ffff:192.0.2.0/120\n",
+			addr:     "192.0.2.1",
+			reason:   ReasonDenied,
+			rejected: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			filename := filepath.Join(t.TempDir(), "ip_rules")
+			writeRules(t, filename, tc.rules)
+
+			r, err := Load(filename)
+			require.NoError(t, err)
+
+			reason, rejected := r.Check(netip.MustParseAddr(tc.addr))
+			require.Equal(t, tc.rejected, rejected)
+			require.Equal(t, tc.reason, reason)
+		})
+	}
+}
+
+func TestCheckNilRules(t *testing.T) {
+	var r *Rules
+
+	_, rejected := r.Check(netip.MustParseAddr("192.0.2.1"))
+	require.False(t, rejected)
+}
+
+func TestLoadInvalidRules(t *testing.T) {
+	testCases := []struct {
+		rules string
+		err   string
+	}{
+		{rules: "deny\n", err: "line 1: expected an action and an address"},
+		{rules: "# comment\nblock 192.0.2.1\n", err: "line 2: unknown action \"block\""},
+		{rules: "allow 192.0.2.0/33\n", err: "line 1: netip.ParsePrefix"},
+		{rules: "allow example.com\n", err: "line 1: ParseAddr"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.rules, func(t *testing.T) {
+			filename := filepath.Join(t.TempDir(), "ip_rules")
+			writeRules(t, filename, tc.rules)
+
+			_, err := Load(filename)
+			require.ErrorContains(t, err, tc.err)
+		})
+	}
+}
+
+func TestLoadMissingFile(t *testing.T) {
+	_, err := Load(filepath.Join(t.TempDir(), "missing"))
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
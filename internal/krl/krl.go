@@ -0,0 +1,320 @@
+// Package krl implements parsing of OpenSSH key revocation lists (KRL) as described in
+// https://github.com/openssh/openssh-portable/blob/master/PROTOCOL.krl
+package krl
+
+import (
+	"bytes"
+	"crypto/sha1" //nolint:gosec // SHA1 fingerprints are part of the KRL format
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	magic         = "SSHKRL\n\x00"
+	formatVersion = 1
+
+	sectionCertificates      = 1
+	sectionExplicitKey       = 2
+	sectionFingerprintSHA1   = 3
+	sectionSignature         = 4
+	sectionFingerprintSHA256 = 5
+
+	certSectionSerialList   = 0x20
+	certSectionSerialRange  = 0x21
+	certSectionSerialBitmap = 0x22
+	certSectionKeyID        = 0x23
+)
+
+// ErrInvalidFormat is returned when the data is not a valid KRL
+var ErrInvalidFormat = errors.New("krl: invalid format")
+
+// KRL is a parsed key revocation list
+type KRL struct {
+	Version uint64
+	Comment string
+
+	certs  []*certSection
+	keys   map[string]struct{}
+	sha1   map[string]struct{}
+	sha256 map[string]struct{}
+}
+
+type serialRange struct {
+	min, max uint64
+}
+
+type serialBitmap struct {
+	offset uint64
+	bits   *big.Int
+}
+
+type certSection struct {
+	// caKey is the marshaled CA key, it's empty if the section applies to certificates signed by any CA
+	caKey   []byte
+	serials map[uint64]struct{}
+	ranges  []serialRange
+	bitmaps []serialBitmap
+	keyIDs  map[string]struct{}
+}
+
+// IsKRL reports whether data starts with the KRL magic number
+func IsKRL(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(magic))
+}
+
+// Parse parses a KRL in the binary OpenSSH format. Signature sections are skipped without verification.
+func Parse(data []byte) (*KRL, error) {
+	if !IsKRL(data) {
+		return nil, fmt.Errorf("%w: bad magic", ErrInvalidFormat)
+	}
+
+	r := &reader{data: data[len(magic):]}
+
+	if version := r.uint32(); version != formatVersion {
+		return nil, fmt.Errorf("%w: unsupported format version %d", ErrInvalidFormat, version)
+	}
+
+	k := &KRL{
+		keys:   make(map[string]struct{}),
+		sha1:   make(map[string]struct{}),
+		sha256: make(map[string]struct{}),
+	}
+
+	k.Version = r.uint64()
+	_ = r.uint64() // generated_date
+	_ = r.uint64() // flags
+	_ = r.string() // reserved
+	k.Comment = string(r.string())
+
+	for r.err == nil && len(r.data) > 0 {
+		sectionType := r.byte()
+		sectionData := r.string()
+		if r.err != nil {
+			break
+		}
+
+		var err error
+		switch sectionType {
+		case sectionCertificates:
+			err = k.parseCertificates(sectionData)
+		case sectionExplicitKey:
+			err = parseBlobs(sectionData, k.keys)
+		case sectionFingerprintSHA1:
+			err = parseBlobs(sectionData, k.sha1)
+		case sectionFingerprintSHA256:
+			err = parseBlobs(sectionData, k.sha256)
+		case sectionSignature:
+			// Signatures aren't verified, the file is trusted as a local configuration
+		default:
+			err = fmt.Errorf("%w: unknown section type %d", ErrInvalidFormat, sectionType)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	return k, nil
+}
+
+// IsRevoked reports whether the key is revoked. For certificates, the certificate itself,
+// the certified key and the signing CA key are checked.
+func (k *KRL) IsRevoked(key ssh.PublicKey) bool {
+	cert, ok := key.(*ssh.Certificate)
+	if !ok {
+		return k.isKeyRevoked(key)
+	}
+
+	if k.isKeyRevoked(cert.Key) || k.isKeyRevoked(cert.SignatureKey) {
+		return true
+	}
+
+	caKey := cert.SignatureKey.Marshal()
+	for _, section := range k.certs {
+		if len(section.caKey) > 0 && !bytes.Equal(section.caKey, caKey) {
+			continue
+		}
+
+		if section.isRevoked(cert) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (k *KRL) isKeyRevoked(key ssh.PublicKey) bool {
+	blob := key.Marshal()
+
+	if _, found := k.keys[string(blob)]; found {
+		return true
+	}
+
+	sha1Sum := sha1.Sum(blob) //nolint:gosec // SHA1 fingerprints are part of the KRL format
+	if _, found := k.sha1[string(sha1Sum[:])]; found {
+		return true
+	}
+
+	sha256Sum := sha256.Sum256(blob)
+	_, found := k.sha256[string(sha256Sum[:])]
+
+	return found
+}
+
+func (s *certSection) isRevoked(cert *ssh.Certificate) bool {
+	if _, found := s.keyIDs[cert.KeyId]; found {
+		return true
+	}
+
+	// A zero serial number means the certificate has no serial, so it can only be revoked by key ID
+	if cert.Serial == 0 {
+		return false
+	}
+
+	if _, found := s.serials[cert.Serial]; found {
+		return true
+	}
+
+	for _, r := range s.ranges {
+		if cert.Serial >= r.min && cert.Serial <= r.max {
+			return true
+		}
+	}
+
+	for _, b := range s.bitmaps {
+		if cert.Serial < b.offset {
+			continue
+		}
+
+		bit := cert.Serial - b.offset
+		if bit < uint64(b.bits.BitLen()) && b.bits.Bit(int(bit)) == 1 {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (k *KRL) parseCertificates(data []byte) error {
+	r := &reader{data: data}
+
+	section := &certSection{
+		caKey:   r.string(),
+		serials: make(map[uint64]struct{}),
+		keyIDs:  make(map[string]struct{}),
+	}
+	_ = r.string() // reserved
+
+	for r.err == nil && len(r.data) > 0 {
+		sectionType := r.byte()
+		sr := &reader{data: r.string()}
+		if r.err != nil {
+			break
+		}
+
+		switch sectionType {
+		case certSectionSerialList:
+			for sr.err == nil && len(sr.data) > 0 {
+				section.serials[sr.uint64()] = struct{}{}
+			}
+		case certSectionSerialRange:
+			section.ranges = append(section.ranges, serialRange{min: sr.uint64(), max: sr.uint64()})
+		case certSectionSerialBitmap:
+			offset := sr.uint64()
+			bits := new(big.Int).SetBytes(sr.string())
+			section.bitmaps = append(section.bitmaps, serialBitmap{offset: offset, bits: bits})
+		case certSectionKeyID:
+			for sr.err == nil && len(sr.data) > 0 {
+				section.keyIDs[string(sr.string())] = struct{}{}
+			}
+		default:
+			return fmt.Errorf("%w: unknown certificate section type %d", ErrInvalidFormat, sectionType)
+		}
+
+		if sr.err != nil {
+			return sr.err
+		}
+	}
+
+	if r.err != nil {
+		return r.err
+	}
+
+	k.certs = append(k.certs, section)
+
+	return nil
+}
+
+func parseBlobs(data []byte, blobs map[string]struct{}) error {
+	r := &reader{data: data}
+
+	for r.err == nil && len(r.data) > 0 {
+		blobs[string(r.string())] = struct{}{}
+	}
+
+	return r.err
+}
+
+// reader decodes the SSH wire encoding. The first error is sticky, all the subsequent reads return zero values.
+type reader struct {
+	data []byte
+	err  error
+}
+
+func (r *reader) next(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+
+	if len(r.data) < n {
+		r.err = fmt.Errorf("%w: unexpected end of data", ErrInvalidFormat)
+		return nil
+	}
+
+	b := r.data[:n]
+	r.data = r.data[n:]
+
+	return b
+}
+
+func (r *reader) byte() byte {
+	if b := r.next(1); b != nil {
+		return b[0]
+	}
+
+	return 0
+}
+
+func (r *reader) uint32() uint32 {
+	if b := r.next(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+
+	return 0
+}
+
+func (r *reader) uint64() uint64 {
+	if b := r.next(8); b != nil {
+		return binary.BigEndian.Uint64(b)
+	}
+
+	return 0
+}
+
+func (r *reader) string() []byte {
+	length := r.uint32()
+	if r.err != nil {
+		return nil
+	}
+
+	return r.next(int(length))
+}
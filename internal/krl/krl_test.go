@@ -0,0 +1,163 @@
+package krl
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"math/big"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+type krlBuilder struct {
+	sections []byte
+}
+
+func (b *krlBuilder) section(sectionType byte, data []byte) *krlBuilder {
+	b.sections = append(b.sections, sectionType)
+	b.sections = appendString(b.sections, data)
+
+	return b
+}
+
+func (b *krlBuilder) bytes() []byte {
+	data := []byte(magic)
+	data = binary.BigEndian.AppendUint32(data, formatVersion)
+	data = binary.BigEndian.AppendUint64(data, 3) // krl_version
+	data = binary.BigEndian.AppendUint64(data, 0) // generated_date
+	data = binary.BigEndian.AppendUint64(data, 0) // flags
+	data = appendString(data, nil)                // reserved
+	data = appendString(data, []byte("comment"))
+
+	return append(data, b.sections...)
+}
+
+func certificatesSection(caKey ssh.PublicKey, certSectionType byte, data []byte) []byte {
+	var section []byte
+	if caKey != nil {
+		section = appendString(section, caKey.Marshal())
+	} else {
+		section = appendString(section, nil)
+	}
+	section = appendString(section, nil) // reserved
+	section = append(section, certSectionType)
+
+	return appendString(section, data)
+}
+
+func appendString(data, s []byte) []byte {
+	data = binary.BigEndian.AppendUint32(data, uint32(len(s)))
+
+	return append(data, s...)
+}
+
+func newSigner(t *testing.T) ssh.Signer {
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	signer, err := ssh.NewSignerFromKey(privateKey)
+	require.NoError(t, err)
+
+	return signer
+}
+
+func newCert(t *testing.T, ca ssh.Signer, serial uint64, keyID string) *ssh.Certificate {
+	cert := &ssh.Certificate{
+		Key:         newSigner(t).PublicKey(),
+		Serial:      serial,
+		CertType:    ssh.UserCert,
+		KeyId:       keyID,
+		ValidBefore: ssh.CertTimeInfinity,
+	}
+	require.NoError(t, cert.SignCert(rand.Reader, ca))
+
+	return cert
+}
+
+func TestParseInvalidData(t *testing.T) {
+	_, err := Parse([]byte("ssh-ed25519 AAAA"))
+	require.ErrorIs(t, err, ErrInvalidFormat)
+
+	valid := (&krlBuilder{}).bytes()
+	_, err = Parse(valid[:len(valid)-2])
+	require.ErrorIs(t, err, ErrInvalidFormat)
+
+	_, err = Parse((&krlBuilder{}).section(42, nil).bytes())
+	require.ErrorIs(t, err, ErrInvalidFormat)
+}
+
+func TestParseHeader(t *testing.T) {
+	k, err := Parse((&krlBuilder{}).bytes())
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), k.Version)
+	require.Equal(t, "comment", k.Comment)
+	require.False(t, k.IsRevoked(newSigner(t).PublicKey()))
+}
+
+func TestExplicitKeys(t *testing.T) {
+	revoked := newSigner(t).PublicKey()
+	hashed := newSigner(t).PublicKey()
+	hash := sha256.Sum256(hashed.Marshal())
+
+	k, err := Parse((&krlBuilder{}).
+		section(sectionExplicitKey, appendString(nil, revoked.Marshal())).
+		section(sectionFingerprintSHA256, appendString(nil, hash[:])).
+		bytes())
+	require.NoError(t, err)
+
+	require.True(t, k.IsRevoked(revoked))
+	require.True(t, k.IsRevoked(hashed))
+	require.False(t, k.IsRevoked(newSigner(t).PublicKey()))
+}
+
+func TestCertificates(t *testing.T) {
+	ca := newSigner(t)
+	otherCA := newSigner(t)
+
+	serials := binary.BigEndian.AppendUint64(nil, 42)
+	serialRange := binary.BigEndian.AppendUint64(binary.BigEndian.AppendUint64(nil, 100), 200)
+	bitmap := appendString(binary.BigEndian.AppendUint64(nil, 1000), big.NewInt(0b101).Bytes())
+	keyIDs := appendString(nil, []byte("revoked-id"))
+
+	k, err := Parse((&krlBuilder{}).
+		section(sectionCertificates, certificatesSection(ca.PublicKey(), certSectionSerialList, serials)).
+		section(sectionCertificates, certificatesSection(ca.PublicKey(), certSectionSerialRange, serialRange)).
+		section(sectionCertificates, certificatesSection(ca.PublicKey(), certSectionSerialBitmap, bitmap)).
+		section(sectionCertificates, certificatesSection(nil, certSectionKeyID, keyIDs)).
+		bytes())
+	require.NoError(t, err)
+
+	testCases := []struct {
+		desc    string
+		cert    *ssh.Certificate
+		revoked bool
+	}{
+		{desc: "serial in list", cert: newCert(t, ca, 42, "id"), revoked: true},
+		{desc: "serial in range", cert: newCert(t, ca, 150, "id"), revoked: true},
+		{desc: "serial in bitmap", cert: newCert(t, ca, 1002, "id"), revoked: true},
+		{desc: "serial not in bitmap", cert: newCert(t, ca, 1001, "id"), revoked: false},
+		{desc: "serial not revoked", cert: newCert(t, ca, 43, "id"), revoked: false},
+		{desc: "serial of another CA", cert: newCert(t, otherCA, 42, "id"), revoked: false},
+		{desc: "key ID of any CA", cert: newCert(t, otherCA, 1, "revoked-id"), revoked: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			require.Equal(t, tc.revoked, k.IsRevoked(tc.cert))
+		})
+	}
+}
+
+func TestRevokedCA(t *testing.T) {
+	ca := newSigner(t)
+
+	k, err := Parse((&krlBuilder{}).
+		section(sectionExplicitKey, appendString(nil, ca.PublicKey().Marshal())).
+		bytes())
+	require.NoError(t, err)
+
+	require.True(t, k.IsRevoked(newCert(t, ca, 1, "id")))
+}
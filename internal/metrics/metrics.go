@@ -14,6 +14,9 @@ const (
 	sshdSubsystem   = "sshd"
 	httpSubsystem   = "http"
 	gitalySubsystem = "gitaly"
+	lfsSubsystem    = "lfs"
+
+	concurrencyLimitSubsystem = "concurrency_limit"
 
 	httpInFlightRequestsMetricName       = "in_flight_requests"
 	httpRequestsTotalMetricName          = "requests_total"
@@ -24,6 +27,12 @@ const (
 	sshdSessionDurationSecondsName            = "session_duration_seconds"
 	sshdSessionEstablishedDurationSecondsName = "session_established_duration_seconds"
 	sshdCanceledSessionsName                  = "canceled_sessions"
+	sshdRateLimitedSessionsName               = "rate_limited_sessions_total"
+	sshdAuthCacheRequestsName                 = "auth_cache_requests_total"
+	sshdSessionTransferredBytesName           = "session_transferred_bytes"
+	sshdSessionThroughputName                 = "session_throughput_bytes_per_second"
+	sshdCommandTimeoutsTotalName              = "command_timeouts_total"
+	sshdRejectedConnectionsTotalName          = "rejected_connections_total"
 
 	sliSshdSessionsTotalName       = "gitlab_sli:shell_sshd_sessions:total"
 	sliSshdSessionsErrorsTotalName = "gitlab_sli:shell_sshd_sessions:errors_total"
@@ -31,7 +40,21 @@ const (
 	lfsHTTPConnectionsTotalName = "lfs_http_connections_total"
 	lfsSSHConnectionsTotalName  = "lfs_ssh_connections_total"
 
-	gitalyConnectionsTotalName = "connections_total"
+	lfsObjectTransfersTotalName          = "object_transfers_total"
+	lfsObjectTransferDurationSecondsName = "object_transfer_duration_seconds"
+	lfsObjectTransferResumesTotalName    = "object_transfer_resumes_total"
+
+	gitalyConnectionsTotalName         = "connections_total"
+	gitalyCachedConnectionsName        = "cached_connections"
+	gitalyConnectionEvictionsTotalName = "connection_evictions_total"
+	gitalyRetriedCallsTotalName        = "retried_calls_total"
+	gitalyLimitErrorsTotalName         = "limit_errors_total"
+
+	concurrencyLimitQueuedOperationsName   = "queued_operations"
+	concurrencyLimitQueueWaitDurationName  = "queue_wait_duration_seconds"
+	concurrencyLimitQueueTimeoutsTotalName = "queue_timeouts_total"
+
+	revokedKeysPresentedTotalName = "revoked_keys_presented_total"
 )
 
 var (
@@ -85,6 +108,75 @@ var (
 		},
 	)
 
+	// SshdRateLimitedSessions is the number of connections and sessions rejected by a rate limiter in gitlab-shell sshd.
+	SshdRateLimitedSessions = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: sshdSubsystem,
+			Name:      sshdRateLimitedSessionsName,
+			Help:      "The number of connections (ip limiter) and sessions (user limiter) rejected by a rate limiter in gitlab-shell sshd.",
+		},
+		[]string{"limiter"},
+	)
+
+	// SshdAuthCacheRequests is the number of lookups in the authentication cache of gitlab-shell sshd.
+	SshdAuthCacheRequests = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: sshdSubsystem,
+			Name:      sshdAuthCacheRequestsName,
+			Help:      "The number of lookups in the authentication cache of gitlab-shell sshd.",
+		},
+		[]string{"cache", "result"},
+	)
+
+	// SshdSessionTransferredBytes is a histogram of bytes transferred by a command in gitlab-shell sshd.
+	// The direction is "in" for bytes read from the client and "out" for bytes written to the client.
+	SshdSessionTransferredBytes = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: sshdSubsystem,
+			Name:      sshdSessionTransferredBytesName,
+			Help:      "A histogram of bytes transferred by a command in gitlab-shell sshd.",
+			Buckets:   prometheus.ExponentialBuckets(1024, 4, 10), // 1KiB to 256MiB
+		},
+		[]string{"command_type", "direction"},
+	)
+
+	// SshdSessionThroughput is a histogram of the throughput of a command in gitlab-shell sshd.
+	SshdSessionThroughput = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: sshdSubsystem,
+			Name:      sshdSessionThroughputName,
+			Help:      "A histogram of the throughput of a command in gitlab-shell sshd, in bytes per second.",
+			Buckets:   prometheus.ExponentialBuckets(1024, 4, 10), // 1KiB/s to 256MiB/s
+		},
+		[]string{"command_type", "direction"},
+	)
+
+	// SshdCommandTimeoutsTotal is the number of commands terminated because they ran for too long or were idle, by command type and reason.
+	SshdCommandTimeoutsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: sshdSubsystem,
+			Name:      sshdCommandTimeoutsTotalName,
+			Help:      "Number of commands terminated because they ran for longer than their maximum duration or were idle",
+		},
+		[]string{"command_type", "reason"},
+	)
+
+	// SshdRejectedConnectionsTotal is the number of connections rejected by the IP rules before the SSH handshake, by listener and reason.
+	SshdRejectedConnectionsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: sshdSubsystem,
+			Name:      sshdRejectedConnectionsTotalName,
+			Help:      "The number of connections rejected by the IP rules of gitlab-shell sshd before the SSH handshake.",
+		},
+		[]string{"listener", "reason"},
+	)
+
 	// SliSshdSessionsTotal is the number of SSH sessions that have been established.
 	SliSshdSessionsTotal = promauto.NewCounter(
 		prometheus.CounterOpts{
@@ -112,6 +204,101 @@ var (
 		[]string{"status"},
 	)
 
+	// GitalyCachedConnections is a gauge of the Gitaly connections in the connection cache, by address.
+	GitalyCachedConnections = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: gitalySubsystem,
+			Name:      gitalyCachedConnectionsName,
+			Help:      "Number of Gitaly connections in the connection cache",
+		},
+		[]string{"address"},
+	)
+
+	// GitalyConnectionEvictionsTotal is the number of Gitaly connections that have been evicted from the connection cache.
+	GitalyConnectionEvictionsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: gitalySubsystem,
+			Name:      gitalyConnectionEvictionsTotalName,
+			Help:      "Number of Gitaly connections that have been evicted from the connection cache",
+		},
+		[]string{"reason"},
+	)
+
+	// GitalyRetriedCallsTotal is the number of Gitaly calls that have been retried because Gitaly was unavailable.
+	GitalyRetriedCallsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: gitalySubsystem,
+			Name:      gitalyRetriedCallsTotalName,
+			Help:      "Number of Gitaly calls that have been retried because Gitaly was unavailable",
+		},
+		[]string{"service"},
+	)
+
+	// GitalyLimitErrorsTotal is the number of Gitaly calls that have been rejected because Gitaly was at its limit.
+	GitalyLimitErrorsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: gitalySubsystem,
+			Name:      gitalyLimitErrorsTotalName,
+			Help:      "Number of Gitaly calls that have been rejected because Gitaly was at its limit",
+		},
+		[]string{"service"},
+	)
+
+	// ConcurrencyLimitQueuedOperations is a gauge of the Git operations waiting for a concurrency limit slot, by scope.
+	ConcurrencyLimitQueuedOperations = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: concurrencyLimitSubsystem,
+			Name:      concurrencyLimitQueuedOperationsName,
+			Help:      "Number of Git operations waiting for a concurrency limit slot",
+		},
+		[]string{"scope"},
+	)
+
+	// ConcurrencyLimitQueueWaitDuration is a histogram of the time Git operations wait for a concurrency limit slot.
+	ConcurrencyLimitQueueWaitDuration = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: concurrencyLimitSubsystem,
+			Name:      concurrencyLimitQueueWaitDurationName,
+			Help:      "A histogram of the time Git operations wait for a concurrency limit slot.",
+			Buckets: []float64{
+				0.1,  /* 100ms */
+				1.0,  /* 1s */
+				5.0,  /* 5s */
+				10.0, /* 10s */
+				30.0, /* 30s */
+				60.0, /* 1m */
+			},
+		},
+		[]string{"scope"},
+	)
+
+	// ConcurrencyLimitQueueTimeoutsTotal is the number of Git operations rejected after waiting too long for a concurrency limit slot.
+	ConcurrencyLimitQueueTimeoutsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: concurrencyLimitSubsystem,
+			Name:      concurrencyLimitQueueTimeoutsTotalName,
+			Help:      "Number of Git operations rejected after waiting too long for a concurrency limit slot",
+		},
+		[]string{"scope"},
+	)
+
+	// RevokedKeysPresentedTotal is the number of times a revoked public key has been presented for authentication.
+	RevokedKeysPresentedTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      revokedKeysPresentedTotalName,
+			Help:      "Number of times a revoked public key has been presented for authentication",
+		},
+		[]string{"key_type"},
+	)
+
 	// The metrics and the buckets size are similar to the ones we have for handlers in Labkit
 	// When the MR: https://gitlab.com/gitlab-org/labkit/-/merge_requests/150 is merged,
 	// these metrics can be refactored out of Gitlab Shell code by using the helper function from Labkit
@@ -170,6 +357,47 @@ var (
 			Help: "Number of LFS over SSH connections that have been established",
 		},
 	)
+
+	// LfsObjectTransfersTotal is the number of LFS objects transferred over SSH, by operation, size bucket and status.
+	LfsObjectTransfersTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: lfsSubsystem,
+			Name:      lfsObjectTransfersTotalName,
+			Help:      "Number of LFS objects transferred over SSH",
+		},
+		[]string{"operation", "size_bucket", "status"},
+	)
+
+	// LfsObjectTransferDuration is a histogram of the duration of LFS object transfers over SSH.
+	LfsObjectTransferDuration = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: lfsSubsystem,
+			Name:      lfsObjectTransferDurationSecondsName,
+			Help:      "A histogram of the duration of LFS object transfers over SSH.",
+			Buckets: []float64{
+				0.1,    /* 100ms */
+				1.0,    /* 1s */
+				10.0,   /* 10s */
+				60.0,   /* 1m */
+				300.0,  /* 5m */
+				1800.0, /* 30m */
+			},
+		},
+		[]string{"operation", "size_bucket"},
+	)
+
+	// LfsObjectTransferResumes is the number of times an interrupted LFS object download has been resumed from an offset.
+	LfsObjectTransferResumes = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: lfsSubsystem,
+			Name:      lfsObjectTransferResumesTotalName,
+			Help:      "Number of times an interrupted LFS object download has been resumed from an offset",
+		},
+		[]string{"operation", "size_bucket"},
+	)
 )
 
 // NewRoundTripper wraps an http.RoundTripper to instrument it with Prometheus metrics.
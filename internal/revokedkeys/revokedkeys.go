@@ -0,0 +1,182 @@
+// Package revokedkeys provides a list of revoked SSH public keys loaded from a file.
+// The file is either an OpenSSH key revocation list (KRL) or a plain list of public keys
+// in the authorized_keys format.
+package revokedkeys
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/krl"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/metrics"
+
+	"gitlab.com/gitlab-org/labkit/log"
+)
+
+// checkInterval is how often the file is checked for changes
+var checkInterval = time.Second
+
+// List is a list of revoked keys. The file is checked for changes at most once per
+// checkInterval and reloaded when it changes. It's safe for concurrent use.
+type List struct {
+	path string
+
+	// current is replaced as a whole on reload, so lookups don't take a lock
+	current atomic.Pointer[revokedKeys]
+
+	// reloadMu is held by the goroutine checking the file; others keep using current
+	reloadMu  sync.Mutex
+	lastCheck atomic.Int64
+}
+
+type revokedKeys struct {
+	modTime time.Time
+	size    int64
+	krl     *krl.KRL
+	keys    map[string]struct{}
+}
+
+// Load reads the list of revoked keys from the file at path
+func Load(path string) (*List, error) {
+	l := &List{path: filepath.Clean(path)}
+
+	info, err := os.Stat(l.path)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := l.load(info); err != nil {
+		return nil, err
+	}
+
+	l.lastCheck.Store(time.Now().UnixNano())
+
+	return l, nil
+}
+
+// Check reports whether the key is revoked. A revoked key is logged and counted.
+// A nil list doesn't revoke any key.
+func (l *List) Check(ctx context.Context, key ssh.PublicKey) bool {
+	if l == nil || !l.IsRevoked(key) {
+		return false
+	}
+
+	metrics.RevokedKeysPresentedTotal.WithLabelValues(key.Type()).Inc()
+	log.WithContextFields(ctx, log.Fields{
+		"public_key_fingerprint": ssh.FingerprintSHA256(key),
+		"revoked_key":            true,
+	}).Warn("revoked public key presented")
+
+	return true
+}
+
+// IsRevoked reports whether the key is revoked. If the file has changed since it was
+// loaded, it's reloaded first. If the reload fails, the previously loaded list is used.
+func (l *List) IsRevoked(key ssh.PublicKey) bool {
+	l.reloadIfChanged()
+
+	revoked := l.current.Load()
+
+	if revoked.krl != nil {
+		return revoked.krl.IsRevoked(key)
+	}
+
+	if cert, ok := key.(*ssh.Certificate); ok {
+		return revoked.isKeyRevoked(cert.Key) || revoked.isKeyRevoked(cert.SignatureKey)
+	}
+
+	return revoked.isKeyRevoked(key)
+}
+
+func (r *revokedKeys) isKeyRevoked(key ssh.PublicKey) bool {
+	_, found := r.keys[string(key.Marshal())]
+
+	return found
+}
+
+func (l *List) reloadIfChanged() {
+	now := time.Now().UnixNano()
+	if time.Duration(now-l.lastCheck.Load()) < checkInterval {
+		return
+	}
+
+	// Another goroutine is already checking the file
+	if !l.reloadMu.TryLock() {
+		return
+	}
+	defer l.reloadMu.Unlock()
+
+	l.lastCheck.Store(now)
+
+	info, err := os.Stat(l.path)
+	if err != nil {
+		log.WithError(err).WithFields(log.Fields{"filename": l.path}).Error("failed to check revoked keys file")
+		return
+	}
+
+	if current := l.current.Load(); info.ModTime().Equal(current.modTime) && info.Size() == current.size {
+		return
+	}
+
+	if err := l.load(info); err != nil {
+		log.WithError(err).WithFields(log.Fields{"filename": l.path}).Error("failed to reload revoked keys file, using the previous version")
+		return
+	}
+
+	log.WithFields(log.Fields{"filename": l.path}).Info("revoked keys file reloaded")
+}
+
+func (l *List) load(info os.FileInfo) error {
+	data, err := os.ReadFile(l.path)
+	if err != nil {
+		return err
+	}
+
+	revoked := &revokedKeys{modTime: info.ModTime(), size: info.Size()}
+
+	if krl.IsKRL(data) {
+		revoked.krl, err = krl.Parse(data)
+	} else {
+		revoked.keys, err = parseKeys(data)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	l.current.Store(revoked)
+
+	return nil
+}
+
+// parseKeys parses public keys in the authorized_keys format, one per line.
+// Empty lines and lines starting with # are ignored.
+func parseKeys(data []byte) (map[string]struct{}, error) {
+	keys := make(map[string]struct{})
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+
+		key, _, _, _, err := ssh.ParseAuthorizedKey(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNumber, err)
+		}
+
+		keys[string(key.Marshal())] = struct{}{}
+	}
+
+	return keys, scanner.Err()
+}
@@ -0,0 +1,151 @@
+package revokedkeys
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/metrics"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/testhelper"
+)
+
+func newPublicKey(t *testing.T) ssh.PublicKey {
+	publicKey, _, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	key, err := ssh.NewPublicKey(publicKey)
+	require.NoError(t, err)
+
+	return key
+}
+
+func writeKeys(t *testing.T, filename string, modTime time.Time, keys ...ssh.PublicKey) {
+	data := []byte("# Revoked keys\n\n")
+	for _, key := range keys {
+		data = append(data, ssh.MarshalAuthorizedKey(key)...)
+	}
+
+	require.NoError(t, os.WriteFile(filename, data, 0o600))
+	require.NoError(t, os.Chtimes(filename, modTime, modTime))
+}
+
+func TestLoadPlainList(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "revoked_keys")
+	revoked := newPublicKey(t)
+	writeKeys(t, filename, time.Now(), revoked)
+
+	l, err := Load(filename)
+	require.NoError(t, err)
+
+	require.True(t, l.IsRevoked(revoked))
+	require.False(t, l.IsRevoked(newPublicKey(t)))
+}
+
+func TestLoadKRL(t *testing.T) {
+	testRoot := testhelper.PrepareTestRootDir(t)
+
+	l, err := Load(path.Join(testRoot, "certs/valid/revoked_user_certs.krl"))
+	require.NoError(t, err)
+	require.NotNil(t, l.current.Load().krl)
+
+	caKeyRaw, err := os.ReadFile(path.Join(testRoot, "certs/valid/server.key"))
+	require.NoError(t, err)
+	ca, err := ssh.ParsePrivateKey(caKeyRaw)
+	require.NoError(t, err)
+
+	for keyID, revoked := range map[string]bool{"revoked@example.com": true, "root@example.com": false} {
+		cert := &ssh.Certificate{CertType: ssh.UserCert, Key: newPublicKey(t), KeyId: keyID, ValidBefore: ssh.CertTimeInfinity}
+		require.NoError(t, cert.SignCert(rand.Reader, ca))
+
+		require.Equal(t, revoked, l.IsRevoked(cert), keyID)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	_, err := Load(filepath.Join(t.TempDir(), "missing"))
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	filename := filepath.Join(t.TempDir(), "revoked_keys")
+	require.NoError(t, os.WriteFile(filename, []byte("invalid key\n"), 0o600))
+
+	_, err = Load(filename)
+	require.EqualError(t, err, "line 1: ssh: no key found")
+}
+
+func TestReloadOnChange(t *testing.T) {
+	defer func(interval time.Duration) { checkInterval = interval }(checkInterval)
+	checkInterval = 0
+
+	filename := filepath.Join(t.TempDir(), "revoked_keys")
+	first := newPublicKey(t)
+	second := newPublicKey(t)
+	modTime := time.Now().Add(-time.Hour)
+
+	writeKeys(t, filename, modTime, first)
+
+	l, err := Load(filename)
+	require.NoError(t, err)
+	require.True(t, l.IsRevoked(first))
+	require.False(t, l.IsRevoked(second))
+
+	writeKeys(t, filename, modTime.Add(time.Minute), second)
+
+	require.False(t, l.IsRevoked(first))
+	require.True(t, l.IsRevoked(second))
+
+	// A broken file doesn't replace the previously loaded list
+	require.NoError(t, os.WriteFile(filename, []byte("invalid key\n"), 0o600))
+
+	require.True(t, l.IsRevoked(second))
+}
+
+func TestReloadCheckInterval(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "revoked_keys")
+	first := newPublicKey(t)
+	second := newPublicKey(t)
+	modTime := time.Now().Add(-time.Hour)
+
+	writeKeys(t, filename, modTime, first)
+
+	l, err := Load(filename)
+	require.NoError(t, err)
+
+	writeKeys(t, filename, modTime.Add(time.Minute), second)
+
+	// The file isn't checked again until the interval has passed
+	require.True(t, l.IsRevoked(first))
+	require.False(t, l.IsRevoked(second))
+
+	l.lastCheck.Store(time.Now().Add(-checkInterval).UnixNano())
+
+	require.False(t, l.IsRevoked(first))
+	require.True(t, l.IsRevoked(second))
+}
+
+func TestCheck(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "revoked_keys")
+	revoked := newPublicKey(t)
+	writeKeys(t, filename, time.Now(), revoked)
+
+	l, err := Load(filename)
+	require.NoError(t, err)
+
+	initial := testutil.ToFloat64(metrics.RevokedKeysPresentedTotal.WithLabelValues(ssh.KeyAlgoED25519))
+
+	require.True(t, l.Check(context.Background(), revoked))
+	require.False(t, l.Check(context.Background(), newPublicKey(t)))
+
+	require.InDelta(t, initial+1, testutil.ToFloat64(metrics.RevokedKeysPresentedTotal.WithLabelValues(ssh.KeyAlgoED25519)), 0.1)
+
+	var nilList *List
+	require.False(t, nilList.Check(context.Background(), revoked))
+}
@@ -0,0 +1,185 @@
+package sshd
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gitlab.com/gitlab-org/labkit/correlation"
+	"gitlab.com/gitlab-org/labkit/log"
+)
+
+const (
+	adminConnectionsPath = "/admin/connections"
+	adminSessionsPath    = "/admin/sessions"
+	authCacheFlushPath   = "/admin/auth_cache/flush"
+)
+
+// connectionInfo describes an open connection in the admin API
+type connectionInfo struct {
+	CorrelationID string    `json:"correlation_id"`
+	RemoteAddr    string    `json:"remote_addr"`
+	Started       time.Time `json:"started"`
+	Sessions      int       `json:"sessions"`
+}
+
+type connectionsResponse struct {
+	Connections []connectionInfo `json:"connections"`
+}
+
+type sessionsResponse struct {
+	Sessions []sessionInfo `json:"sessions"`
+}
+
+// registerAdminHandlers adds the endpoints to inspect and terminate the
+// running sessions, and to flush the authentication cache. They are only
+// available when an admin token is configured.
+func (s *Server) registerAdminHandlers(mux *http.ServeMux) {
+	if s.Config.Server.AdminTokenFile == "" {
+		return
+	}
+
+	mux.HandleFunc("GET "+adminConnectionsPath, s.requireAdminToken(func(w http.ResponseWriter, _ *http.Request) {
+		writeJSON(w, connectionsResponse{Connections: s.connectionInfos()})
+	}))
+
+	mux.HandleFunc("GET "+adminSessionsPath, s.requireAdminToken(func(w http.ResponseWriter, _ *http.Request) {
+		writeJSON(w, sessionsResponse{Sessions: s.sessionInfos()})
+	}))
+
+	mux.HandleFunc("DELETE "+adminSessionsPath+"/{correlation_id}", s.requireAdminToken(func(w http.ResponseWriter, r *http.Request) {
+		correlationID := r.PathValue("correlation_id")
+
+		if s.terminateSessions(correlationID) == 0 {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		log.WithContextFields(r.Context(), log.Fields{"session_correlation_id": correlationID}).Info("Session terminated by an administrator")
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	if s.Config.Server.AuthCache.Enabled {
+		mux.HandleFunc("POST "+authCacheFlushPath, s.requireAdminToken(func(w http.ResponseWriter, r *http.Request) {
+			if flush := s.serverConfig.Load().flushAuthCache; flush != nil {
+				flush()
+				log.WithContextFields(r.Context(), log.Fields{}).Info("Authentication cache flushed")
+			}
+
+			w.WriteHeader(http.StatusNoContent)
+		}))
+	}
+}
+
+// requireAdminToken rejects the requests that don't carry the admin token as a bearer token
+func (s *Server) requireAdminToken(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := s.serverConfig.Load().adminToken
+		provided, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+
+		if token == "" || !ok || subtle.ConstantTimeCompare([]byte(provided), []byte(token)) != 1 {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+func (s *Server) registerConnection(ctx context.Context, conn *connection) {
+	s.sessionsMu.Lock()
+	defer s.sessionsMu.Unlock()
+
+	if s.connections == nil {
+		s.connections = make(map[*connection]context.Context)
+	}
+	s.connections[conn] = ctx
+}
+
+func (s *Server) unregisterConnection(conn *connection) {
+	s.sessionsMu.Lock()
+	defer s.sessionsMu.Unlock()
+
+	delete(s.connections, conn)
+}
+
+func (s *Server) connectionInfos() []connectionInfo {
+	s.sessionsMu.Lock()
+	defer s.sessionsMu.Unlock()
+
+	sessions := make(map[string]int)
+	for _, ctx := range s.sessions {
+		sessions[correlation.ExtractFromContext(ctx)]++
+	}
+
+	infos := make([]connectionInfo, 0, len(s.connections))
+	for conn, ctx := range s.connections {
+		correlationID := correlation.ExtractFromContext(ctx)
+
+		infos = append(infos, connectionInfo{
+			CorrelationID: correlationID,
+			RemoteAddr:    conn.remoteAddr,
+			Started:       conn.started,
+			Sessions:      sessions[correlationID],
+		})
+	}
+
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Started.Before(infos[j].Started) })
+
+	return infos
+}
+
+func (s *Server) sessionInfos() []sessionInfo {
+	s.sessionsMu.Lock()
+	defer s.sessionsMu.Unlock()
+
+	infos := make([]sessionInfo, 0, len(s.sessions))
+	for sess, ctx := range s.sessions {
+		infos = append(infos, sess.info(ctx))
+	}
+
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Started.Before(infos[j].Started) })
+
+	return infos
+}
+
+// terminateSessions closes the sessions with the given correlation ID and
+// returns how many have been closed. All the sessions of a connection share
+// its correlation ID. They're terminated concurrently, without holding the
+// sessions lock, since a client may take a while to read the notice.
+func (s *Server) terminateSessions(correlationID string) int {
+	if correlationID == "" {
+		return 0
+	}
+
+	var wg sync.WaitGroup
+
+	terminated := 0
+	for sess, ctx := range s.sessionsSnapshot() {
+		if correlation.ExtractFromContext(ctx) != correlationID {
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			sess.terminate(ctx)
+		}()
+		terminated++
+	}
+
+	wg.Wait()
+
+	return terminated
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,220 @@
+package sshd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"gitlab.com/gitlab-org/labkit/correlation"
+
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/command/commandargs"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/config"
+)
+
+const adminToken = "secret-admin-token"
+
+func setupAdminServer(t *testing.T) *Server {
+	tokenFile := filepath.Join(t.TempDir(), "admin_token")
+	require.NoError(t, os.WriteFile(tokenFile, []byte(adminToken+"\n"), 0o600))
+
+	token, err := readAdminToken(tokenFile)
+	require.NoError(t, err)
+
+	cfg := &config.Config{Server: config.DefaultServerConfig}
+	cfg.Server.AdminTokenFile = tokenFile
+
+	s := &Server{Config: cfg}
+	s.serverConfig.Store(&serverConfig{cfg: cfg, adminToken: token})
+
+	return s
+}
+
+func adminRequest(method, path, token string) *http.Request {
+	r := httptest.NewRequest(method, path, nil)
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	return r
+}
+
+func TestAdminEndpointsAuthentication(t *testing.T) {
+	s := setupAdminServer(t)
+	mux := s.MonitoringServeMux()
+
+	testCases := []struct {
+		desc           string
+		token          string
+		expectedStatus int
+	}{
+		{desc: "missing token", expectedStatus: http.StatusUnauthorized},
+		{desc: "invalid token", token: "invalid", expectedStatus: http.StatusUnauthorized},
+		{desc: "valid token", token: adminToken, expectedStatus: http.StatusOK},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			for _, path := range []string{adminConnectionsPath, adminSessionsPath} {
+				r := httptest.NewRecorder()
+				mux.ServeHTTP(r, adminRequest(http.MethodGet, path, tc.token))
+				require.Equal(t, tc.expectedStatus, r.Result().StatusCode, path)
+			}
+		})
+	}
+}
+
+func TestAdminEndpointsDisabled(t *testing.T) {
+	s := &Server{Config: &config.Config{Server: config.DefaultServerConfig}}
+	mux := s.MonitoringServeMux()
+
+	r := httptest.NewRecorder()
+	mux.ServeHTTP(r, adminRequest(http.MethodGet, adminSessionsPath, adminToken))
+	require.Equal(t, http.StatusNotFound, r.Result().StatusCode)
+}
+
+func TestAdminListSessionsAndConnections(t *testing.T) {
+	s := setupAdminServer(t)
+	mux := s.MonitoringServeMux()
+
+	ctx := correlation.ContextWithCorrelation(context.Background(), "correlation-id")
+	started := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	nconn, _ := net.Pipe()
+	conn := newConnection(s.Config, nconn, nil)
+	conn.started = started
+	s.registerConnection(ctx, conn)
+
+	sess := &session{
+		gitlabKeyID: "1",
+		remoteAddr:  "127.0.0.1:1234",
+		started:     started,
+	}
+	sess.state.Store(sessionExecuting)
+	sess.command = "git-upload-pack group/project.git"
+	sess.commandType, sess.repo = parseCommand(sess.command)
+	sess.bytesWritten.Store(42)
+	s.registerSession(ctx, sess)
+
+	r := httptest.NewRecorder()
+	mux.ServeHTTP(r, adminRequest(http.MethodGet, adminSessionsPath, adminToken))
+	require.Equal(t, http.StatusOK, r.Result().StatusCode)
+	require.Equal(t, "application/json", r.Result().Header.Get("Content-Type"))
+
+	var sessions sessionsResponse
+	require.NoError(t, json.NewDecoder(r.Body).Decode(&sessions))
+	require.Equal(t, []sessionInfo{{
+		CorrelationID: "correlation-id",
+		RemoteAddr:    "127.0.0.1:1234",
+		KeyID:         "1",
+		State:         "executing",
+		Command:       "git-upload-pack group/project.git",
+		CommandType:   string(commandargs.UploadPack),
+		Repo:          "group/project.git",
+		Started:       started,
+		WrittenBytes:  42,
+	}}, sessions.Sessions)
+
+	r = httptest.NewRecorder()
+	mux.ServeHTTP(r, adminRequest(http.MethodGet, adminConnectionsPath, adminToken))
+	require.Equal(t, http.StatusOK, r.Result().StatusCode)
+
+	var connections connectionsResponse
+	require.NoError(t, json.NewDecoder(r.Body).Decode(&connections))
+	require.Equal(t, []connectionInfo{{
+		CorrelationID: "correlation-id",
+		RemoteAddr:    "pipe",
+		Started:       started,
+		Sessions:      1,
+	}}, connections.Connections)
+}
+
+func TestAdminTerminateSession(t *testing.T) {
+	s := setupAdminServer(t)
+	mux := s.MonitoringServeMux()
+
+	ctx, cancel := context.WithCancel(correlation.ContextWithCorrelation(context.Background(), "correlation-id"))
+	defer cancel()
+
+	stdErr := &bytes.Buffer{}
+	sess := &session{
+		channel: &fakeChannel{stdErr: stdErr, stdOut: &bytes.Buffer{}},
+		cancel:  cancel,
+	}
+	sess.state.Store(sessionExecuting)
+	s.registerSession(ctx, sess)
+
+	r := httptest.NewRecorder()
+	mux.ServeHTTP(r, adminRequest(http.MethodDelete, adminSessionsPath+"/unknown", adminToken))
+	require.Equal(t, http.StatusNotFound, r.Result().StatusCode)
+	require.NoError(t, ctx.Err())
+
+	r = httptest.NewRecorder()
+	mux.ServeHTTP(r, adminRequest(http.MethodDelete, adminSessionsPath+"/correlation-id", ""))
+	require.Equal(t, http.StatusUnauthorized, r.Result().StatusCode)
+	require.NoError(t, ctx.Err())
+
+	r = httptest.NewRecorder()
+	mux.ServeHTTP(r, adminRequest(http.MethodDelete, adminSessionsPath+"/correlation-id", adminToken))
+	require.Equal(t, http.StatusNoContent, r.Result().StatusCode)
+	require.ErrorIs(t, ctx.Err(), context.Canceled)
+	require.Contains(t, stdErr.String(), terminationNotice)
+}
+
+func TestAdminTerminateSessionWithStuckClient(t *testing.T) {
+	s := setupAdminServer(t)
+
+	ctx, cancel := context.WithCancel(correlation.ContextWithCorrelation(context.Background(), "correlation-id"))
+	defer cancel()
+
+	channel := newStuckChannel()
+	sess := &session{channel: channel, cancel: cancel}
+	sess.state.Store(sessionExecuting)
+	s.registerSession(ctx, sess)
+
+	terminated := make(chan int)
+	go func() {
+		terminated <- s.terminateSessions("correlation-id")
+	}()
+
+	// The sessions aren't locked while the stuck client is notified
+	s.registerSession(context.Background(), &session{channel: newStuckChannel()})
+
+	select {
+	case n := <-terminated:
+		require.Equal(t, 1, n)
+	case <-time.After(5 * noticeTimeout):
+		require.FailNow(t, "terminateSessions is blocked by the client")
+	}
+
+	require.ErrorIs(t, ctx.Err(), context.Canceled)
+	require.True(t, channel.isClosed())
+}
+
+func TestParseCommand(t *testing.T) {
+	testCases := []struct {
+		execCmd             string
+		expectedCommandType commandargs.CommandType
+		expectedRepo        string
+	}{
+		{execCmd: "git-receive-pack 'group/project.git'", expectedCommandType: commandargs.ReceivePack, expectedRepo: "group/project.git"},
+		{execCmd: "git-lfs-transfer group/project.git upload", expectedCommandType: commandargs.LfsTransfer, expectedRepo: "group/project.git"},
+		{execCmd: "2fa_verify", expectedCommandType: commandargs.TwoFactorVerify},
+		{execCmd: `\`},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.execCmd, func(t *testing.T) {
+			commandType, repo := parseCommand(tc.execCmd)
+			require.Equal(t, tc.expectedCommandType, commandType)
+			require.Equal(t, tc.expectedRepo, repo)
+		})
+	}
+}
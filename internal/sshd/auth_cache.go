@@ -0,0 +1,101 @@
+package sshd
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"gitlab.com/gitlab-org/gitlab-shell/v14/client"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/cache"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/config"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/gitlabnet/authorizedcerts"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/gitlabnet/authorizedkeys"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/metrics"
+)
+
+type authorizedKeysGetter interface {
+	GetByKey(ctx context.Context, key string) (*authorizedkeys.Response, error)
+}
+
+type authorizedCertsGetter interface {
+	GetByKey(ctx context.Context, userID, fingerprint string) (*authorizedcerts.Response, error)
+}
+
+type cachedAuthorizedKeysClient struct {
+	client      authorizedKeysGetter
+	cache       *cache.Cache[*authorizedkeys.Response]
+	ttl         time.Duration
+	negativeTTL time.Duration
+}
+
+type cachedAuthorizedCertsClient struct {
+	client      authorizedCertsGetter
+	cache       *cache.Cache[*authorizedcerts.Response]
+	ttl         time.Duration
+	negativeTTL time.Duration
+}
+
+func newCachedAuthorizedKeysClient(cfg config.AuthCacheConfig, c authorizedKeysGetter) *cachedAuthorizedKeysClient {
+	return &cachedAuthorizedKeysClient{
+		client:      c,
+		cache:       cache.New[*authorizedkeys.Response](cfg.MaxSize),
+		ttl:         time.Duration(cfg.TTL),
+		negativeTTL: time.Duration(cfg.NegativeTTL),
+	}
+}
+
+func newCachedAuthorizedCertsClient(cfg config.AuthCacheConfig, c authorizedCertsGetter) *cachedAuthorizedCertsClient {
+	return &cachedAuthorizedCertsClient{
+		client:      c,
+		cache:       cache.New[*authorizedcerts.Response](cfg.MaxSize),
+		ttl:         time.Duration(cfg.TTL),
+		negativeTTL: time.Duration(cfg.NegativeTTL),
+	}
+}
+
+func (c *cachedAuthorizedKeysClient) GetByKey(ctx context.Context, key string) (*authorizedkeys.Response, error) {
+	if entry, found := c.cache.Get(key); found {
+		metrics.SshdAuthCacheRequests.WithLabelValues("authorized_keys", "hit").Inc()
+
+		return entry.Value, entry.Err
+	}
+
+	metrics.SshdAuthCacheRequests.WithLabelValues("authorized_keys", "miss").Inc()
+
+	res, err := c.client.GetByKey(ctx, key)
+	storeLookup(c.cache, key, res, err, c.ttl, c.negativeTTL)
+
+	return res, err
+}
+
+func (c *cachedAuthorizedCertsClient) GetByKey(ctx context.Context, userID, fingerprint string) (*authorizedcerts.Response, error) {
+	key := userID + "\x00" + fingerprint
+
+	if entry, found := c.cache.Get(key); found {
+		metrics.SshdAuthCacheRequests.WithLabelValues("authorized_certs", "hit").Inc()
+
+		return entry.Value, entry.Err
+	}
+
+	metrics.SshdAuthCacheRequests.WithLabelValues("authorized_certs", "miss").Inc()
+
+	res, err := c.client.GetByKey(ctx, userID, fingerprint)
+	storeLookup(c.cache, key, res, err, c.ttl, c.negativeTTL)
+
+	return res, err
+}
+
+// storeLookup caches successful lookups and the lookups of keys that don't exist.
+// Any other error, for example an unreachable API, is not cached.
+func storeLookup[V any](c *cache.Cache[V], key string, value V, err error, ttl, negativeTTL time.Duration) {
+	if err == nil {
+		c.Set(key, value, nil, ttl)
+		return
+	}
+
+	var apiError *client.APIError
+	if errors.As(err, &apiError) && apiError.StatusCode == http.StatusNotFound {
+		c.Set(key, value, err, negativeTTL)
+	}
+}
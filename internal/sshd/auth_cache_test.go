@@ -0,0 +1,165 @@
+package sshd
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-shell/v14/client"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/config"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/gitlabnet/authorizedcerts"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/gitlabnet/authorizedkeys"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/metrics"
+)
+
+type fakeAuthorizedKeysClient struct {
+	calls int
+	res   *authorizedkeys.Response
+	err   error
+}
+
+func (f *fakeAuthorizedKeysClient) GetByKey(_ context.Context, _ string) (*authorizedkeys.Response, error) {
+	f.calls++
+
+	return f.res, f.err
+}
+
+type fakeAuthorizedCertsClient struct {
+	calls int
+	res   *authorizedcerts.Response
+	err   error
+}
+
+func (f *fakeAuthorizedCertsClient) GetByKey(_ context.Context, _, _ string) (*authorizedcerts.Response, error) {
+	f.calls++
+
+	return f.res, f.err
+}
+
+var authCacheConfig = config.AuthCacheConfig{
+	Enabled:     true,
+	TTL:         config.YamlDuration(time.Minute),
+	NegativeTTL: config.YamlDuration(time.Minute),
+	MaxSize:     10,
+}
+
+func TestCachedAuthorizedKeysClient(t *testing.T) {
+	testCases := []struct {
+		desc          string
+		res           *authorizedkeys.Response
+		err           error
+		expectedCalls int
+	}{
+		{
+			desc:          "found key is cached",
+			res:           &authorizedkeys.Response{ID: 1, Key: "key"},
+			expectedCalls: 1,
+		},
+		{
+			desc:          "missing key is cached",
+			err:           &client.APIError{Msg: "Internal API error (404)", StatusCode: http.StatusNotFound},
+			expectedCalls: 1,
+		},
+		{
+			desc:          "unreachable API is not cached",
+			err:           &client.APIError{Msg: "Internal API unreachable"},
+			expectedCalls: 2,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			fake := &fakeAuthorizedKeysClient{res: tc.res, err: tc.err}
+			c := newCachedAuthorizedKeysClient(authCacheConfig, fake)
+
+			for i := 0; i < 2; i++ {
+				res, err := c.GetByKey(context.Background(), "key")
+				require.Equal(t, tc.res, res)
+				require.Equal(t, tc.err, err)
+			}
+
+			require.Equal(t, tc.expectedCalls, fake.calls)
+		})
+	}
+}
+
+func TestCachedAuthorizedCertsClient(t *testing.T) {
+	initialHits := testutil.ToFloat64(metrics.SshdAuthCacheRequests.WithLabelValues("authorized_certs", "hit"))
+	initialMisses := testutil.ToFloat64(metrics.SshdAuthCacheRequests.WithLabelValues("authorized_certs", "miss"))
+
+	fake := &fakeAuthorizedCertsClient{res: &authorizedcerts.Response{Username: "root", Namespace: "namespace"}}
+	c := newCachedAuthorizedCertsClient(authCacheConfig, fake)
+
+	for i := 0; i < 2; i++ {
+		res, err := c.GetByKey(context.Background(), "root", "fingerprint")
+		require.NoError(t, err)
+		require.Equal(t, fake.res, res)
+	}
+
+	_, err := c.GetByKey(context.Background(), "another-user", "fingerprint")
+	require.NoError(t, err)
+
+	require.Equal(t, 2, fake.calls)
+	require.InDelta(t, initialHits+1, testutil.ToFloat64(metrics.SshdAuthCacheRequests.WithLabelValues("authorized_certs", "hit")), 0.1)
+	require.InDelta(t, initialMisses+2, testutil.ToFloat64(metrics.SshdAuthCacheRequests.WithLabelValues("authorized_certs", "miss")), 0.1)
+}
+
+func TestAuthCacheFlushEndpoint(t *testing.T) {
+	s := setupAdminServer(t)
+	s.Config.Server.AuthCache = authCacheConfig
+
+	fake := &fakeAuthorizedKeysClient{res: &authorizedkeys.Response{ID: 1, Key: "key"}}
+	cachedClient := newCachedAuthorizedKeysClient(authCacheConfig, fake)
+
+	srvCfg := s.serverConfig.Load()
+	srvCfg.authorizedKeysClient = cachedClient
+	srvCfg.flushAuthCache = cachedClient.cache.Flush
+
+	_, err := cachedClient.GetByKey(context.Background(), "key")
+	require.NoError(t, err)
+	require.Equal(t, 1, cachedClient.cache.Len())
+
+	mux := s.MonitoringServeMux()
+
+	testCases := []struct {
+		desc   string
+		method string
+		token  string
+		status int
+	}{
+		{desc: "without a token", method: http.MethodPost, status: http.StatusUnauthorized},
+		{desc: "with an invalid token", method: http.MethodPost, token: "invalid", status: http.StatusUnauthorized},
+		{desc: "with another method", method: http.MethodGet, token: adminToken, status: http.StatusMethodNotAllowed},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			r := httptest.NewRecorder()
+			mux.ServeHTTP(r, adminRequest(tc.method, authCacheFlushPath, tc.token))
+			require.Equal(t, tc.status, r.Result().StatusCode)
+			require.Equal(t, 1, cachedClient.cache.Len())
+		})
+	}
+
+	r := httptest.NewRecorder()
+	mux.ServeHTTP(r, adminRequest(http.MethodPost, authCacheFlushPath, adminToken))
+	require.Equal(t, http.StatusNoContent, r.Result().StatusCode)
+	require.Equal(t, 0, cachedClient.cache.Len())
+}
+
+func TestAuthCacheFlushEndpointWithoutAdminToken(t *testing.T) {
+	cfg := &config.Config{Server: config.DefaultServerConfig}
+	cfg.Server.AuthCache = authCacheConfig
+
+	s := &Server{Config: cfg}
+	s.serverConfig.Store(&serverConfig{cfg: cfg})
+
+	r := httptest.NewRecorder()
+	s.MonitoringServeMux().ServeHTTP(r, httptest.NewRequest(http.MethodPost, authCacheFlushPath, nil))
+	require.Equal(t, http.StatusNotFound, r.Result().StatusCode)
+}
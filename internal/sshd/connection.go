@@ -39,11 +39,15 @@ type connection struct {
 	nconn              net.Conn
 	maxSessions        int64
 	remoteAddr         string
+	started            time.Time
+	rateLimiters       *rateLimiters
+	// shuttingDown reports whether the server is shutting down
+	shuttingDown func() bool
 }
 
 type channelHandler func(context.Context, *ssh.ServerConn, ssh.Channel, <-chan *ssh.Request) error
 
-func newConnection(cfg *config.Config, nconn net.Conn) *connection {
+func newConnection(cfg *config.Config, nconn net.Conn, limiters *rateLimiters) *connection {
 	maxSessions := cfg.Server.ConcurrentSessionsLimit
 
 	return &connection{
@@ -52,6 +56,8 @@ func newConnection(cfg *config.Config, nconn net.Conn) *connection {
 		concurrentSessions: semaphore.NewWeighted(maxSessions),
 		nconn:              nconn,
 		remoteAddr:         nconn.RemoteAddr().String(),
+		started:            time.Now(),
+		rateLimiters:       limiters,
 	}
 }
 
@@ -111,6 +117,19 @@ func (c *connection) handleRequests(ctx context.Context, sconn *ssh.ServerConn,
 			continue
 		}
 
+		// The sessions opened after the server has started draining would be left running
+		if c.shuttingDown != nil && c.shuttingDown() {
+			ctxlog.Info("connection: handleRequests: server is shutting down")
+			_ = newChannel.Reject(ssh.ResourceShortage, shutdownNotice)
+			continue
+		}
+
+		if reason := c.rateLimited(sconn); reason != "" {
+			ctxlog.WithField("reason", reason).Info("connection: handleRequests: rate limited")
+			_ = newChannel.Reject(ssh.ResourceShortage, reason)
+			continue
+		}
+
 		if !c.concurrentSessions.TryAcquire(1) {
 			ctxlog.Info("connection: handleRequests: too many concurrent sessions")
 			_ = newChannel.Reject(ssh.ResourceShortage, "too many concurrent sessions")
@@ -158,6 +177,33 @@ func (c *connection) handleRequests(ctx context.Context, sconn *ssh.ServerConn,
 	_ = c.concurrentSessions.Acquire(ctx, c.maxSessions)
 }
 
+// rateLimited returns the reason of the rejection if a new session exceeds
+// the rate limit configured for the user. The rate limit of the client IP
+// address is checked before the SSH handshake.
+func (c *connection) rateLimited(sconn *ssh.ServerConn) string {
+	if c.rateLimiters == nil {
+		return ""
+	}
+
+	if sconn != nil && sconn.Permissions != nil && !c.rateLimiters.user.Allow(userRateLimitKey(sconn.Permissions.Extensions)) {
+		metrics.SshdRateLimitedSessions.WithLabelValues(c.rateLimiters.user.name).Inc()
+
+		return "too many sessions for this user, please try again later"
+	}
+
+	return ""
+}
+
+func userRateLimitKey(extensions map[string]string) string {
+	for _, name := range []string{"key-id", "username", "krb5principal"} {
+		if value := extensions[name]; value != "" {
+			return name + ":" + value
+		}
+	}
+
+	return ""
+}
+
 func (c *connection) sendKeepAliveMsg(ctx context.Context, sconn *ssh.ServerConn, ticker *time.Ticker) {
 	ctxlog := log.WithContextFields(ctx, log.Fields{"remote_addr": c.remoteAddr})
 
@@ -191,6 +237,12 @@ func (c *connection) trackError(ctxlog *logrus.Entry, err error) {
 		return
 	}
 
+	// Timeouts are tracked by their own metric
+	var timeoutErr *commandTimeoutError
+	if errors.As(err, &timeoutErr) {
+		return
+	}
+
 	grpcCode := grpcstatus.Code(err)
 	if grpcCode == grpccodes.Canceled || grpcCode == grpccodes.Unavailable {
 		return
@@ -146,6 +146,48 @@ func TestTooManySessions(t *testing.T) {
 	require.Equal(t, rejectCall{reason: ssh.ResourceShortage, message: "too many concurrent sessions"}, <-rejectCh)
 }
 
+func TestRateLimitedSessions(t *testing.T) {
+	rejectCh := make(chan rejectCall)
+	defer close(rejectCh)
+
+	newChannel := &fakeNewChannel{channelType: "session", rejectCh: rejectCh}
+	conn, chans := setup(newChannel)
+	conn.rateLimiters = &rateLimiters{
+		user: newRateLimiter("user", config.RateLimitConfig{Rate: 0.001, Burst: 1}),
+	}
+	conn.rateLimiters.user.Allow("key-id:1") // Exhaust the bucket
+
+	sconn := &ssh.ServerConn{Permissions: &ssh.Permissions{Extensions: map[string]string{"key-id": "1"}}}
+	initialRateLimited := testutil.ToFloat64(metrics.SshdRateLimitedSessions.WithLabelValues("user"))
+
+	go func() {
+		conn.handleRequests(context.Background(), sconn, chans, nil)
+	}()
+
+	expectedRejection := rejectCall{reason: ssh.ResourceShortage, message: "too many sessions for this user, please try again later"}
+	require.Equal(t, expectedRejection, <-rejectCh)
+	require.InDelta(t, initialRateLimited+1, testutil.ToFloat64(metrics.SshdRateLimitedSessions.WithLabelValues("user")), 0.1)
+
+	close(chans)
+}
+
+func TestSessionsRejectedOnShutdown(t *testing.T) {
+	rejectCh := make(chan rejectCall)
+	defer close(rejectCh)
+
+	newChannel := &fakeNewChannel{channelType: "session", rejectCh: rejectCh}
+	conn, chans := setup(newChannel)
+	conn.shuttingDown = func() bool { return true }
+
+	go func() {
+		conn.handleRequests(context.Background(), nil, chans, nil)
+	}()
+
+	require.Equal(t, rejectCall{reason: ssh.ResourceShortage, message: shutdownNotice}, <-rejectCh)
+
+	close(chans)
+}
+
 func TestAcceptSessionSucceeds(t *testing.T) {
 	newChannel := &fakeNewChannel{channelType: "session"}
 	conn, chans := setup(newChannel)
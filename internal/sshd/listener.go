@@ -0,0 +1,325 @@
+package sshd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	proxyproto "github.com/pires/go-proxyproto"
+
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/config"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/iprules"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/metrics"
+
+	"gitlab.com/gitlab-org/labkit/log"
+)
+
+// SSH authentication methods that can be allowed on a listener
+const (
+	authMethodPublicKey = "publickey"
+	authMethodGSSAPI    = "gssapi-with-mic"
+)
+
+// Prefixes of the listen addresses that aren't TCP addresses
+const (
+	unixAddressPrefix    = "unix:"
+	systemdAddressPrefix = "systemd:"
+)
+
+// listener accepts the connections of a configured listener. All the
+// listeners share the same session handling.
+type listener struct {
+	net.Listener
+
+	cfg config.ListenerConfig
+	// raw is the socket, without the PROXY protocol
+	raw net.Listener
+	// inherited is set when the socket has been passed by systemd or by the
+	// previous process of an upgrade
+	inherited bool
+}
+
+type listenerStatus struct {
+	Name      string `json:"name"`
+	Address   string `json:"address"`
+	Inherited bool   `json:"inherited"`
+}
+
+func (l *listener) status() listenerStatus {
+	return listenerStatus{
+		Name:      l.cfg.Name,
+		Address:   l.Addr().String(),
+		Inherited: l.inherited,
+	}
+}
+
+func validateListeners(listeners []config.ListenerConfig) error {
+	names := make(map[string]bool, len(listeners))
+
+	for _, lc := range listeners {
+		if names[lc.Name] {
+			return fmt.Errorf("listener %q is configured more than once", lc.Name)
+		}
+		names[lc.Name] = true
+
+		if _, err := parseSocketMode(lc.SocketMode); err != nil {
+			return fmt.Errorf("listener %q: %w", lc.Name, err)
+		}
+
+		for _, method := range lc.AuthMethods {
+			if method != authMethodPublicKey && method != authMethodGSSAPI {
+				return fmt.Errorf("listener %q: unknown auth method %q", lc.Name, method)
+			}
+		}
+	}
+
+	return nil
+}
+
+func parseSocketMode(mode string) (os.FileMode, error) {
+	if mode == "" {
+		return 0, nil
+	}
+
+	perm, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil || perm > uint64(os.ModePerm) {
+		return 0, fmt.Errorf("invalid socket mode %q", mode)
+	}
+
+	return os.FileMode(perm), nil
+}
+
+func (s *Server) listen(ctx context.Context) error {
+	var listeners []*listener
+
+	for _, lc := range s.Config.Server.ListenerConfigs() {
+		l, err := s.newListener(ctx, lc)
+		if err != nil {
+			for _, l := range listeners {
+				_ = l.Close()
+			}
+			return err
+		}
+
+		listeners = append(listeners, l)
+	}
+
+	s.statusMu.Lock()
+	s.listeners = listeners
+	s.statusMu.Unlock()
+
+	return nil
+}
+
+func (s *Server) getListeners() []*listener {
+	s.statusMu.RLock()
+	defer s.statusMu.RUnlock()
+
+	return s.listeners
+}
+
+// openListener opens the socket of the listener, or takes it from the ones
+// passed by the previous process of an upgrade or by systemd
+func openListener(lc config.ListenerConfig) (net.Listener, bool, error) {
+	if f, ok := takeUpgradeSocket(lc.Name); ok {
+		defer func() { _ = f.Close() }()
+
+		l, err := net.FileListener(f)
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to use the socket %q passed by the previous process: %w", lc.Name, err)
+		}
+
+		return l, true, nil
+	}
+
+	switch {
+	case strings.HasPrefix(lc.Listen, systemdAddressPrefix):
+		name := strings.TrimPrefix(lc.Listen, systemdAddressPrefix)
+
+		f, ok := takeSystemdSocket(name)
+		if !ok {
+			return nil, false, fmt.Errorf("no socket named %q has been passed by systemd", name)
+		}
+		defer func() { _ = f.Close() }()
+
+		l, err := net.FileListener(f)
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to use the socket %q passed by systemd: %w", name, err)
+		}
+
+		return l, true, nil
+	case strings.HasPrefix(lc.Listen, unixAddressPrefix):
+		l, err := listenUnix(strings.TrimPrefix(lc.Listen, unixAddressPrefix), lc.SocketMode)
+		return l, false, err
+	default:
+		l, err := net.Listen("tcp", lc.Listen)
+		return l, false, err
+	}
+}
+
+func listenUnix(path, socketMode string) (net.Listener, error) {
+	mode, err := parseSocketMode(socketMode)
+	if err != nil {
+		return nil, err
+	}
+
+	// A socket left behind by a process that didn't exit cleanly would make listen fail
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		_ = os.Remove(path)
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	if mode != 0 {
+		if err := os.Chmod(path, mode); err != nil {
+			_ = l.Close()
+			return nil, fmt.Errorf("failed to change the mode of %s: %w", path, err)
+		}
+	}
+
+	return l, nil
+}
+
+func (s *Server) newListener(ctx context.Context, lc config.ListenerConfig) (*listener, error) {
+	sshListener, inherited, err := openListener(lc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for connection: %w", err)
+	}
+
+	rawListener := sshListener
+
+	fields := log.Fields{
+		"listener":  lc.Name,
+		"inherited": inherited,
+	}
+
+	addr := sshListener.Addr()
+	if addr.Network() == "tcp" {
+		fields["tcp_address"] = addr.String()
+	} else {
+		fields["address"] = addr.String()
+		fields["network"] = addr.Network()
+	}
+
+	if lc.ProxyProtocol {
+		policy, err := proxyPolicy(lc)
+		if err != nil {
+			_ = sshListener.Close()
+			return nil, fmt.Errorf("invalid policy configuration: %w", err)
+		}
+
+		sshListener = &proxyproto.Listener{
+			Listener:          sshListener,
+			Policy:            policy,
+			ReadHeaderTimeout: time.Duration(s.Config.Server.ProxyHeaderTimeout),
+		}
+
+		fields["proxy_protocol"] = true
+	}
+
+	if algorithms := s.serverConfig.Load().publicKeyAlgorithms(lc); len(algorithms) > 0 {
+		fields["supported_public_key_algorithms"] = algorithms
+	}
+
+	if len(lc.AuthMethods) > 0 {
+		fields["auth_methods"] = lc.AuthMethods
+	}
+
+	log.WithContextFields(ctx, fields).Info("Listening for SSH connections")
+
+	return &listener{Listener: sshListener, cfg: lc, raw: rawListener, inherited: inherited}, nil
+}
+
+func (s *Server) acceptConnections(ctx context.Context, l *listener) {
+	for {
+		nconn, err := l.Accept()
+		if err != nil {
+			if s.getStatus() == StatusOnShutdown {
+				return
+			}
+
+			log.WithContextFields(ctx, log.Fields{"listener": l.cfg.Name}).WithError(err).Warn("Failed to accept connection")
+			continue
+		}
+
+		// The client IP of a PROXY connection is only known once its header
+		// is read, so those are checked when the connection is handled
+		if !l.cfg.ProxyProtocol && rejectConn(ctx, s.serverConfig.Load().ipRules, l, nconn) {
+			_ = nconn.Close()
+			continue
+		}
+
+		s.wg.Add(1)
+		go s.handleConn(ctx, l, nconn)
+	}
+}
+
+// rejectConn reports whether the client IP of the connection is rejected by the
+// IP rules. Connections without an IP address, like the ones of a Unix domain
+// socket without the PROXY protocol, aren't rejected.
+func rejectConn(ctx context.Context, rules *iprules.Rules, l *listener, nconn net.Conn) bool {
+	if rules == nil {
+		return false
+	}
+
+	tcpAddr, ok := nconn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+
+	reason, rejected := rules.Check(tcpAddr.AddrPort().Addr())
+	if !rejected {
+		return false
+	}
+
+	metrics.SshdRejectedConnectionsTotal.WithLabelValues(l.cfg.Name, reason).Inc()
+	log.WithContextFields(ctx, log.Fields{
+		"remote_addr": tcpAddr.String(),
+		"listener":    l.cfg.Name,
+		"reason":      reason,
+	}).Debug("Connection rejected by the IP rules")
+
+	return true
+}
+
+func (s *Server) closeListeners() error {
+	var errs []error
+	for _, l := range s.getListeners() {
+		errs = append(errs, l.Close())
+	}
+
+	return errors.Join(errs...)
+}
+
+func proxyPolicy(lc config.ListenerConfig) (proxyproto.PolicyFunc, error) {
+	if len(lc.ProxyAllowed) > 0 {
+		return proxyproto.StrictWhiteListPolicy(lc.ProxyAllowed)
+	}
+
+	// Set the Policy value based on config
+	// Values are taken from https://github.com/pires/go-proxyproto/blob/195fedcfbfc1be163f3a0d507fac1709e9d81fed/policy.go#L20
+	switch strings.ToLower(lc.ProxyPolicy) {
+	case "require":
+		return staticProxyPolicy(proxyproto.REQUIRE), nil
+	case "ignore":
+		return staticProxyPolicy(proxyproto.IGNORE), nil
+	case "reject":
+		return staticProxyPolicy(proxyproto.REJECT), nil
+	default:
+		return staticProxyPolicy(proxyproto.USE), nil
+	}
+}
+
+func staticProxyPolicy(policy proxyproto.Policy) proxyproto.PolicyFunc {
+	return func(_ net.Addr) (proxyproto.Policy, error) {
+		return policy, nil
+	}
+}
@@ -0,0 +1,122 @@
+package sshd
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+
+	proxyproto "github.com/pires/go-proxyproto"
+	"github.com/pires/go-proxyproto/tlvparse"
+
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/config"
+)
+
+type proxyTLVsContextKey struct{}
+
+// proxyTLV extracts the value of a PROXY protocol v2 TLV
+type proxyTLV struct {
+	name    string
+	extract func([]proxyproto.TLV) (string, bool)
+}
+
+// wellKnownProxyTLVs are the TLVs whose value is decoded, the other TLV types
+// are configured by number
+var wellKnownProxyTLVs = map[string]func([]proxyproto.TLV) (string, bool){
+	"authority": func(tlvs []proxyproto.TLV) (string, bool) {
+		return findProxyTLV(tlvs, proxyproto.PP2_TYPE_AUTHORITY)
+	},
+	"aws_vpc_endpoint_id": func(tlvs []proxyproto.TLV) (string, bool) {
+		id := tlvparse.FindAWSVPCEndpointID(tlvs)
+		return id, id != ""
+	},
+	"azure_private_endpoint_link_id": func(tlvs []proxyproto.TLV) (string, bool) {
+		id, ok := tlvparse.FindAzurePrivateEndpointLinkID(tlvs)
+		return strconv.FormatUint(uint64(id), 10), ok
+	},
+	"gcp_psc_connection_id": func(tlvs []proxyproto.TLV) (string, bool) {
+		id, ok := tlvparse.ExtractPSCConnectionID(tlvs)
+		return strconv.FormatUint(id, 10), ok
+	},
+}
+
+func parseProxyTLVs(cfgs []config.ProxyTLVConfig) ([]proxyTLV, error) {
+	var tlvs []proxyTLV
+
+	for _, cfg := range cfgs {
+		name := cfg.Name
+		if name == "" {
+			name = cfg.Type
+		}
+
+		if extract, ok := wellKnownProxyTLVs[cfg.Type]; ok {
+			tlvs = append(tlvs, proxyTLV{name: name, extract: extract})
+			continue
+		}
+
+		tlvType, err := strconv.ParseUint(cfg.Type, 0, 8)
+		if err != nil {
+			return nil, fmt.Errorf("invalid PROXY protocol TLV type %q", cfg.Type)
+		}
+
+		tlvs = append(tlvs, proxyTLV{
+			name: name,
+			extract: func(tlvs []proxyproto.TLV) (string, bool) {
+				return findProxyTLV(tlvs, proxyproto.PP2Type(tlvType))
+			},
+		})
+	}
+
+	return tlvs, nil
+}
+
+// findProxyTLV returns the value of the first TLV of the type. Values that
+// aren't printable ASCII are hex-encoded.
+func findProxyTLV(tlvs []proxyproto.TLV, tlvType proxyproto.PP2Type) (string, bool) {
+	for _, tlv := range tlvs {
+		if tlv.Type != tlvType {
+			continue
+		}
+
+		for _, c := range tlv.Value {
+			if c < ' ' || c > '~' {
+				return hex.EncodeToString(tlv.Value), true
+			}
+		}
+
+		return string(tlv.Value), true
+	}
+
+	return "", false
+}
+
+// extractProxyTLVs returns the configured TLVs of the PROXY protocol header
+func extractProxyTLVs(header *proxyproto.Header, configured []proxyTLV) map[string]string {
+	if header == nil || len(configured) == 0 {
+		return nil
+	}
+
+	tlvs, err := header.TLVs()
+	if err != nil || len(tlvs) == 0 {
+		return nil
+	}
+
+	values := make(map[string]string)
+	for _, tlv := range configured {
+		if value, ok := tlv.extract(tlvs); ok {
+			values[tlv.name] = value
+		}
+	}
+
+	if len(values) == 0 {
+		return nil
+	}
+
+	return values
+}
+
+func proxyTLVsFromContext(ctx context.Context) map[string]string {
+	tlvs, _ := ctx.Value(proxyTLVsContextKey{}).(map[string]string)
+
+	return tlvs
+}
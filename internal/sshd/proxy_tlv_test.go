@@ -0,0 +1,129 @@
+package sshd
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"testing"
+
+	proxyproto "github.com/pires/go-proxyproto"
+	"github.com/pires/go-proxyproto/tlvparse"
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/config"
+)
+
+func TestParseProxyTLVs(t *testing.T) {
+	tlvs, err := parseProxyTLVs([]config.ProxyTLVConfig{
+		{Type: "aws_vpc_endpoint_id"},
+		{Name: "tenant", Type: "0xE5"},
+		{Name: "custom", Type: "230"},
+	})
+	require.NoError(t, err)
+	require.Len(t, tlvs, 3)
+	require.Equal(t, "aws_vpc_endpoint_id", tlvs[0].name)
+	require.Equal(t, "tenant", tlvs[1].name)
+	require.Equal(t, "custom", tlvs[2].name)
+
+	for _, tlvType := range []string{"unknown", "0x100", "-1", ""} {
+		_, err := parseProxyTLVs([]config.ProxyTLVConfig{{Type: tlvType}})
+		require.EqualError(t, err, "invalid PROXY protocol TLV type \""+tlvType+"\"", tlvType)
+	}
+}
+
+func TestExtractProxyTLVs(t *testing.T) {
+	configured, err := parseProxyTLVs([]config.ProxyTLVConfig{
+		{Type: "authority"},
+		{Name: "vpce", Type: "aws_vpc_endpoint_id"},
+		{Type: "azure_private_endpoint_link_id"},
+		{Type: "gcp_psc_connection_id"},
+		{Name: "tenant", Type: "0xE5"},
+		{Name: "binary", Type: "0xE6"},
+		{Name: "missing", Type: "0xE7"},
+	})
+	require.NoError(t, err)
+
+	azureLinkID := make([]byte, 5)
+	azureLinkID[0] = 0x01 // PP2_SUBTYPE_AZURE_PRIVATEENDPOINT_LINKID
+	binary.LittleEndian.PutUint32(azureLinkID[1:], 42)
+
+	pscConnectionID := binary.BigEndian.AppendUint64(nil, 1234)
+
+	header := newProxyTLVHeader(t, []proxyproto.TLV{
+		{Type: proxyproto.PP2_TYPE_AUTHORITY, Value: []byte("gitlab.example.com")},
+		{Type: tlvparse.PP2_TYPE_AWS, Value: append([]byte{tlvparse.PP2_SUBTYPE_AWS_VPCE_ID}, "vpce-0123456789abcdef0"...)},
+		{Type: tlvparse.PP2_TYPE_AZURE, Value: azureLinkID},
+		{Type: tlvparse.PP2_TYPE_GCP, Value: pscConnectionID},
+		{Type: 0xE5, Value: []byte("tenant-1")},
+		{Type: 0xE6, Value: []byte{0x00, 0xff}},
+	})
+
+	require.Equal(t, map[string]string{
+		"authority":                      "gitlab.example.com",
+		"vpce":                           "vpce-0123456789abcdef0",
+		"azure_private_endpoint_link_id": "42",
+		"gcp_psc_connection_id":          "1234",
+		"tenant":                         "tenant-1",
+		"binary":                         "00ff",
+	}, extractProxyTLVs(header, configured))
+
+	require.Nil(t, extractProxyTLVs(nil, configured))
+	require.Nil(t, extractProxyTLVs(header, nil))
+	require.Nil(t, extractProxyTLVs(newProxyTLVHeader(t, nil), configured))
+}
+
+func TestContextWithProxyTLVs(t *testing.T) {
+	configured, err := parseProxyTLVs([]config.ProxyTLVConfig{{Name: "tenant", Type: "0xE5"}})
+	require.NoError(t, err)
+
+	header := newProxyTLVHeader(t, []proxyproto.TLV{{Type: 0xE5, Value: []byte("tenant-1")}})
+
+	testCases := []struct {
+		desc       string
+		configured []proxyTLV
+		expected   map[string]string
+	}{
+		{
+			desc:       "configured TLVs",
+			configured: configured,
+			expected:   map[string]string{"tenant": "tenant-1"},
+		},
+		{
+			desc:       "no configured TLVs",
+			configured: nil,
+			expected:   nil,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			serverConn, clientConn := net.Pipe()
+			defer serverConn.Close()
+			defer clientConn.Close()
+
+			go func() {
+				_, _ = header.WriteTo(clientConn)
+			}()
+
+			conn := proxyproto.NewConn(serverConn)
+			ctx := contextWithValues(context.Background(), conn, tc.configured)
+
+			require.Equal(t, tc.expected, proxyTLVsFromContext(ctx))
+		})
+	}
+}
+
+func newProxyTLVHeader(t *testing.T, tlvs []proxyproto.TLV) *proxyproto.Header {
+	t.Helper()
+
+	header := &proxyproto.Header{
+		Version:           2,
+		Command:           proxyproto.PROXY,
+		TransportProtocol: proxyproto.TCPv4,
+		SourceAddr:        &net.TCPAddr{IP: net.ParseIP("10.1.1.1"), Port: 1000},
+		DestinationAddr:   &net.TCPAddr{IP: net.ParseIP("10.1.1.2"), Port: 22},
+	}
+	require.NoError(t, header.SetTLVs(tlvs))
+
+	return header
+}
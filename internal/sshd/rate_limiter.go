@@ -0,0 +1,116 @@
+package sshd
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/config"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/gitlabnet"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/metrics"
+)
+
+// rateLimiterSweepInterval defines how often the limiters that are no longer in use are removed
+var rateLimiterSweepInterval = time.Minute
+
+// rateLimiter is a token bucket rate limiter keyed by an arbitrary string, for example
+// the IP address of a client or the identity of an authenticated user
+type rateLimiter struct {
+	name  string
+	limit rate.Limit
+	burst int
+
+	mu        sync.Mutex
+	limiters  map[string]*rateLimiterEntry
+	lastSweep time.Time
+}
+
+type rateLimiterEntry struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+type rateLimiters struct {
+	ip   *rateLimiter
+	user *rateLimiter
+}
+
+func newRateLimiters(cfg *config.Config) *rateLimiters {
+	return &rateLimiters{
+		ip:   newRateLimiter("ip", cfg.Server.IPRateLimit),
+		user: newRateLimiter("user", cfg.Server.UserRateLimit),
+	}
+}
+
+// allowConn reports whether a new connection from the remote address is allowed
+// by the IP rate limiter. The remote address of a PROXY protocol connection is
+// the address of the original client.
+func (r *rateLimiters) allowConn(remoteAddr string) bool {
+	if r == nil || r.ip.Allow(gitlabnet.ParseIP(remoteAddr)) {
+		return true
+	}
+
+	metrics.SshdRateLimitedSessions.WithLabelValues(r.ip.name).Inc()
+
+	return false
+}
+
+// newRateLimiter returns nil when rate limiting is disabled
+func newRateLimiter(name string, cfg config.RateLimitConfig) *rateLimiter {
+	if cfg.Rate <= 0 {
+		return nil
+	}
+
+	burst := cfg.Burst
+	if burst <= 0 {
+		burst = 1
+	}
+
+	return &rateLimiter{
+		name:      name,
+		limit:     rate.Limit(cfg.Rate),
+		burst:     burst,
+		limiters:  make(map[string]*rateLimiterEntry),
+		lastSweep: time.Now(),
+	}
+}
+
+// Allow reports whether a new session for the key is allowed. A nil limiter allows everything.
+func (r *rateLimiter) Allow(key string) bool {
+	if r == nil || key == "" {
+		return true
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	r.sweep(now)
+
+	entry, ok := r.limiters[key]
+	if !ok {
+		entry = &rateLimiterEntry{limiter: rate.NewLimiter(r.limit, r.burst)}
+		r.limiters[key] = entry
+	}
+	entry.lastSeen = now
+
+	return entry.limiter.AllowN(now, 1)
+}
+
+// sweep removes the limiters whose buckets have been refilled completely,
+// because they are indistinguishable from newly created ones
+func (r *rateLimiter) sweep(now time.Time) {
+	if now.Sub(r.lastSweep) < rateLimiterSweepInterval {
+		return
+	}
+	r.lastSweep = now
+
+	refillDuration := time.Duration(float64(r.burst) / float64(r.limit) * float64(time.Second))
+
+	for key, entry := range r.limiters {
+		if now.Sub(entry.lastSeen) > refillDuration {
+			delete(r.limiters, key)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package sshd
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/config"
+)
+
+func TestRateLimiterDisabled(t *testing.T) {
+	limiter := newRateLimiter("ip", config.RateLimitConfig{})
+	require.Nil(t, limiter)
+
+	for i := 0; i < 100; i++ {
+		require.True(t, limiter.Allow("127.0.0.1"))
+	}
+}
+
+func TestRateLimiterAllow(t *testing.T) {
+	limiter := newRateLimiter("ip", config.RateLimitConfig{Rate: 0.001, Burst: 2})
+
+	require.True(t, limiter.Allow("127.0.0.1"))
+	require.True(t, limiter.Allow("127.0.0.1"))
+	require.False(t, limiter.Allow("127.0.0.1"))
+
+	// Other keys have their own buckets
+	require.True(t, limiter.Allow("127.0.0.2"))
+
+	// Empty keys are never limited
+	require.True(t, limiter.Allow(""))
+}
+
+func TestRateLimiterSweep(t *testing.T) {
+	defer func(interval time.Duration) { rateLimiterSweepInterval = interval }(rateLimiterSweepInterval)
+	rateLimiterSweepInterval = 0
+
+	limiter := newRateLimiter("user", config.RateLimitConfig{Rate: 1000, Burst: 1})
+
+	require.True(t, limiter.Allow("key-id:1"))
+	require.Len(t, limiter.limiters, 1)
+
+	require.Eventually(t, func() bool {
+		limiter.Allow("key-id:2")
+
+		limiter.mu.Lock()
+		defer limiter.mu.Unlock()
+
+		_, found := limiter.limiters["key-id:1"]
+		return !found
+	}, time.Second, time.Millisecond)
+}
+
+func TestUserRateLimitKey(t *testing.T) {
+	require.Equal(t, "key-id:1", userRateLimitKey(map[string]string{"key-id": "1"}))
+	require.Equal(t, "username:alex", userRateLimitKey(map[string]string{"username": "alex", "namespace": "group"}))
+	require.Equal(t, "krb5principal:alex@EXAMPLE.COM", userRateLimitKey(map[string]string{"krb5principal": "alex@EXAMPLE.COM"}))
+	require.Empty(t, userRateLimitKey(nil))
+}
@@ -5,6 +5,7 @@ import (
 	"context"
 	"encoding/base64"
 	"fmt"
+	"net"
 	"os"
 	"path/filepath"
 	"strconv"
@@ -14,19 +15,39 @@ import (
 	"golang.org/x/crypto/ssh"
 
 	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/config"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/gitlabnet"
 	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/gitlabnet/authorizedcerts"
 	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/gitlabnet/authorizedkeys"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/iprules"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/krl"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/revokedkeys"
 
 	"gitlab.com/gitlab-org/labkit/fips"
 	"gitlab.com/gitlab-org/labkit/log"
 )
 
+const (
+	forceCommandOption  = "force-command"
+	sourceAddressOption = "source-address"
+)
+
+// keyFingerprintExtension is the permissions extension with the fingerprint of the
+// public key or certificate used for authentication
+const keyFingerprintExtension = "key-fingerprint"
+
 type serverConfig struct {
 	cfg                   *config.Config
 	hostKeys              []ssh.Signer
 	hostKeyToCertMap      map[string]*ssh.Certificate
-	authorizedKeysClient  *authorizedkeys.Client
-	authorizedCertsClient *authorizedcerts.Client
+	authorizedKeysClient  authorizedKeysGetter
+	authorizedCertsClient authorizedCertsGetter
+	flushAuthCache        func()
+	userCertsKRL          *krl.KRL
+	revokedKeys           *revokedkeys.List
+	adminToken            string
+	listeners             map[string]config.ListenerConfig
+	proxyTLVs             []proxyTLV
+	ipRules               *iprules.Rules
 }
 
 func parseHostKeys(keyFiles []string) []ssh.Signer {
@@ -96,6 +117,37 @@ func parseHostCerts(hostKeys []ssh.Signer, certFiles []string) map[string]*ssh.C
 	return keyToCertMap
 }
 
+func parseKRL(filename string) (*krl.KRL, error) {
+	if filename == "" {
+		return nil, nil
+	}
+
+	data, err := os.ReadFile(filepath.Clean(filename))
+	if err != nil {
+		return nil, err
+	}
+
+	return krl.Parse(data)
+}
+
+func readAdminToken(filename string) (string, error) {
+	if filename == "" {
+		return "", nil
+	}
+
+	data, err := os.ReadFile(filepath.Clean(filename))
+	if err != nil {
+		return "", err
+	}
+
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return "", fmt.Errorf("%s is empty", filename)
+	}
+
+	return token, nil
+}
+
 func newServerConfig(cfg *config.Config) (*serverConfig, error) {
 	authorizedKeysClient, err := authorizedkeys.NewClient(cfg)
 	if err != nil {
@@ -114,13 +166,74 @@ func newServerConfig(cfg *config.Config) (*serverConfig, error) {
 
 	hostKeyToCertMap := parseHostCerts(hostKeys, cfg.Server.HostCertFiles)
 
-	return &serverConfig{
+	userCertsKRL, err := parseKRL(cfg.Server.UserCertificates.KRLFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load user certificates KRL: %w", err)
+	}
+
+	var revokedKeys *revokedkeys.List
+	if cfg.RevokedKeysFile != "" {
+		revokedKeys, err = revokedkeys.Load(cfg.RevokedKeysFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load revoked keys: %w", err)
+		}
+	}
+
+	var ipRules *iprules.Rules
+	if cfg.Server.IPRulesFile != "" {
+		ipRules, err = iprules.Load(cfg.Server.IPRulesFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load IP rules: %w", err)
+		}
+	}
+
+	listenerConfigs := cfg.Server.ListenerConfigs()
+	if err := validateListeners(listenerConfigs); err != nil {
+		return nil, err
+	}
+
+	listeners := make(map[string]config.ListenerConfig, len(listenerConfigs))
+	for _, lc := range listenerConfigs {
+		listeners[lc.Name] = lc
+	}
+
+	proxyTLVs, err := parseProxyTLVs(cfg.Server.ProxyTLVs)
+	if err != nil {
+		return nil, err
+	}
+
+	adminToken, err := readAdminToken(cfg.Server.AdminTokenFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load admin token: %w", err)
+	}
+
+	srvCfg := &serverConfig{
 		cfg:                   cfg,
 		authorizedKeysClient:  authorizedKeysClient,
 		authorizedCertsClient: authorizedCertsClient,
 		hostKeys:              hostKeys,
 		hostKeyToCertMap:      hostKeyToCertMap,
-	}, nil
+		userCertsKRL:          userCertsKRL,
+		revokedKeys:           revokedKeys,
+		adminToken:            adminToken,
+		listeners:             listeners,
+		proxyTLVs:             proxyTLVs,
+		ipRules:               ipRules,
+	}
+
+	if cfg.Server.AuthCache.Enabled {
+		cachedKeysClient := newCachedAuthorizedKeysClient(cfg.Server.AuthCache, authorizedKeysClient)
+		cachedCertsClient := newCachedAuthorizedCertsClient(cfg.Server.AuthCache, authorizedCertsClient)
+
+		srvCfg.authorizedKeysClient = cachedKeysClient
+		srvCfg.authorizedCertsClient = cachedCertsClient
+		srvCfg.flushAuthCache = func() {
+			cachedKeysClient.cache.Flush()
+			cachedCertsClient.cache.Flush()
+		}
+	}
+
+	return srvCfg, nil
 }
 
 func (s *serverConfig) handleUserKey(ctx context.Context, user string, key ssh.PublicKey) (*ssh.Permissions, error) {
@@ -130,6 +243,9 @@ func (s *serverConfig) handleUserKey(ctx context.Context, user string, key ssh.P
 	if key.Type() == ssh.KeyAlgoDSA {
 		return nil, fmt.Errorf("DSA is prohibited")
 	}
+	if s.revokedKeys.Check(ctx, key) {
+		return nil, fmt.Errorf("public key is revoked")
+	}
 
 	res, err := s.authorizedKeysClient.GetByKey(ctx, base64.RawStdEncoding.EncodeToString(key.Marshal()))
 	if err != nil {
@@ -144,8 +260,13 @@ func (s *serverConfig) handleUserKey(ctx context.Context, user string, key ssh.P
 	}, nil
 }
 
-func (s *serverConfig) handleUserCertificate(ctx context.Context, user string, cert *ssh.Certificate) (*ssh.Permissions, error) {
-	if os.Getenv("FF_GITLAB_SHELL_SSH_CERTIFICATES") != "1" {
+func (s *serverConfig) userCertificatesEnabled() bool {
+	// The environment variable is kept for backwards compatibility, prefer the user_certificates setting
+	return s.cfg.Server.UserCertificates.Enabled || os.Getenv("FF_GITLAB_SHELL_SSH_CERTIFICATES") == "1"
+}
+
+func (s *serverConfig) handleUserCertificate(ctx context.Context, user string, remoteAddr net.Addr, cert *ssh.Certificate) (*ssh.Permissions, error) {
+	if !s.userCertificatesEnabled() {
 		return nil, fmt.Errorf("handleUserCertificate: feature is disabled")
 	}
 
@@ -155,7 +276,13 @@ func (s *serverConfig) handleUserCertificate(ctx context.Context, user string, c
 		return nil, fmt.Errorf("handleUserCertificate: cert has type %d", cert.CertType)
 	}
 
-	certChecker := &ssh.CertChecker{}
+	if s.revokedKeys.Check(ctx, cert) {
+		return nil, fmt.Errorf("handleUserCertificate: certificate is revoked")
+	}
+
+	// CheckCert verifies that the user is one of the principals of the certificate.
+	// The source-address option is always accepted by CheckCert, it's enforced below.
+	certChecker := &ssh.CertChecker{SupportedCriticalOptions: []string{forceCommandOption}}
 	if err := certChecker.CheckCert(user, cert); err != nil {
 		return nil, err
 	}
@@ -169,6 +296,18 @@ func (s *serverConfig) handleUserCertificate(ctx context.Context, user string, c
 		},
 	)
 
+	if err := checkSourceAddress(remoteAddr, cert.CriticalOptions[sourceAddressOption]); err != nil {
+		logger.WithError(err).Warn("user certificate is not allowed from the remote address")
+
+		return nil, err
+	}
+
+	if s.userCertsKRL != nil && s.userCertsKRL.IsRevoked(cert) {
+		logger.Warn("user certificate is revoked")
+
+		return nil, fmt.Errorf("handleUserCertificate: certificate is revoked")
+	}
+
 	res, err := s.authorizedCertsClient.GetByKey(ctx, cert.KeyId, strings.TrimPrefix(fingerprint, "SHA256:"))
 	if err != nil {
 		logger.WithError(err).Warn("user certificate is not signed by a trusted key")
@@ -183,17 +322,73 @@ func (s *serverConfig) handleUserCertificate(ctx context.Context, user string, c
 		},
 	).Info("user certificate is signed by a trusted key")
 
-	return &ssh.Permissions{
+	permissions := &ssh.Permissions{
 		Extensions: map[string]string{
 			"username":  res.Username,
 			"namespace": res.Namespace,
 		},
-	}, nil
+	}
+
+	// The critical options are passed on, so the force-command option is enforced by the session
+	if len(cert.CriticalOptions) > 0 {
+		permissions.CriticalOptions = cert.CriticalOptions
+	}
+
+	return permissions, nil
 }
 
-func (s *serverConfig) get(parentCtx context.Context) *ssh.ServerConfig {
+// checkSourceAddress verifies that the remote address matches one of the comma-separated
+// addresses or CIDR ranges of the source-address critical option
+func checkSourceAddress(remoteAddr net.Addr, sourceAddrs string) error {
+	if sourceAddrs == "" {
+		return nil
+	}
+
+	if remoteAddr == nil {
+		return fmt.Errorf("no remote address known, but source-address match required")
+	}
+
+	ip := net.ParseIP(gitlabnet.ParseIP(remoteAddr.String()))
+	if ip == nil {
+		return fmt.Errorf("remote address %v is not an IP address", remoteAddr)
+	}
+
+	for _, sourceAddr := range strings.Split(sourceAddrs, ",") {
+		if allowedIP := net.ParseIP(sourceAddr); allowedIP != nil {
+			if allowedIP.Equal(ip) {
+				return nil
+			}
+
+			continue
+		}
+
+		_, ipNet, err := net.ParseCIDR(sourceAddr)
+		if err != nil {
+			return fmt.Errorf("invalid source-address restriction %q: %w", sourceAddr, err)
+		}
+
+		if ipNet.Contains(ip) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("remote address %v is not allowed because of source-address restriction", remoteAddr)
+}
+
+// listenerConfig returns the reloaded configuration of the listener. A listener
+// that has been removed from the configuration keeps its initial configuration,
+// since listeners aren't reopened on reload.
+func (s *serverConfig) listenerConfig(lc config.ListenerConfig) config.ListenerConfig {
+	if reloaded, ok := s.listeners[lc.Name]; ok {
+		return reloaded
+	}
+
+	return lc
+}
+
+func (s *serverConfig) get(parentCtx context.Context, lc config.ListenerConfig) *ssh.ServerConfig {
 	var gssapiWithMICConfig *ssh.GSSAPIWithMICConfig
-	if s.cfg.Server.GSSAPI.Enabled {
+	if s.cfg.Server.GSSAPI.Enabled && lc.AllowsAuthMethod(authMethodGSSAPI) {
 		gssAPIServer, _ := NewGSSAPIServer(&s.cfg.Server.GSSAPI)
 
 		if gssAPIServer != nil {
@@ -216,21 +411,36 @@ func (s *serverConfig) get(parentCtx context.Context) *ssh.ServerConfig {
 	}
 
 	sshCfg := &ssh.ServerConfig{
-		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+		GSSAPIWithMICConfig: gssapiWithMICConfig,
+		ServerVersion:       "SSH-2.0-GitLab-SSHD",
+	}
+
+	if lc.AllowsAuthMethod(authMethodPublicKey) {
+		sshCfg.PublicKeyCallback = func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
 			ctx, cancel := context.WithTimeout(parentCtx, 10*time.Second)
 			defer cancel()
 
 			log.WithContextFields(ctx, log.Fields{"ssh_key_type": key.Type()}).Info("public key authentication")
 
+			var permissions *ssh.Permissions
+			var err error
+
 			cert, ok := key.(*ssh.Certificate)
 			if ok {
-				return s.handleUserCertificate(ctx, conn.User(), cert)
+				permissions, err = s.handleUserCertificate(ctx, conn.User(), conn.RemoteAddr(), cert)
+			} else {
+				permissions, err = s.handleUserKey(ctx, conn.User(), key)
 			}
 
-			return s.handleUserKey(ctx, conn.User(), key)
-		},
-		GSSAPIWithMICConfig: gssapiWithMICConfig,
-		ServerVersion:       "SSH-2.0-GitLab-SSHD",
+			if err != nil {
+				return nil, err
+			}
+
+			// Record the fingerprint of the key used for authentication for the audit log.
+			permissions.Extensions[keyFingerprintExtension] = ssh.FingerprintSHA256(key)
+
+			return permissions, nil
+		}
 	}
 
 	// Only set this for FIPS because by default to preserve backwards compatibility
@@ -251,10 +461,10 @@ func (s *serverConfig) get(parentCtx context.Context) *ssh.ServerConfig {
 		sshCfg.MACs = algorithms.MACs
 	}
 
-	s.configureMACs(sshCfg)
-	s.configureKeyExchanges(sshCfg)
-	s.configureCiphers(sshCfg)
-	s.configurePublicKeyAlgorithms(sshCfg)
+	s.configureMACs(sshCfg, lc)
+	s.configureKeyExchanges(sshCfg, lc)
+	s.configureCiphers(sshCfg, lc)
+	s.configurePublicKeyAlgorithms(sshCfg, lc)
 
 	for _, key := range s.hostKeys {
 		sshCfg.AddHostKey(key)
@@ -265,26 +475,40 @@ func (s *serverConfig) get(parentCtx context.Context) *ssh.ServerConfig {
 	return sshCfg
 }
 
-func (s *serverConfig) configurePublicKeyAlgorithms(sshCfg *ssh.ServerConfig) {
-	if len(s.cfg.Server.PublicKeyAlgorithms) > 0 {
-		sshCfg.PublicKeyAuthAlgorithms = s.cfg.Server.PublicKeyAlgorithms
+// publicKeyAlgorithms returns the public key algorithms of the listener,
+// which default to the sshd ones
+func (s *serverConfig) publicKeyAlgorithms(lc config.ListenerConfig) []string {
+	return listenerOrServerAlgorithms(lc.PublicKeyAlgorithms, s.cfg.Server.PublicKeyAlgorithms)
+}
+
+func (s *serverConfig) configurePublicKeyAlgorithms(sshCfg *ssh.ServerConfig, lc config.ListenerConfig) {
+	if algorithms := s.publicKeyAlgorithms(lc); len(algorithms) > 0 {
+		sshCfg.PublicKeyAuthAlgorithms = algorithms
+	}
+}
+
+func (s *serverConfig) configureCiphers(sshCfg *ssh.ServerConfig, lc config.ListenerConfig) {
+	if ciphers := listenerOrServerAlgorithms(lc.Ciphers, s.cfg.Server.Ciphers); len(ciphers) > 0 {
+		sshCfg.Ciphers = ciphers
 	}
 }
 
-func (s *serverConfig) configureCiphers(sshCfg *ssh.ServerConfig) {
-	if len(s.cfg.Server.Ciphers) > 0 {
-		sshCfg.Ciphers = s.cfg.Server.Ciphers
+func (s *serverConfig) configureKeyExchanges(sshCfg *ssh.ServerConfig, lc config.ListenerConfig) {
+	if kexAlgorithms := listenerOrServerAlgorithms(lc.KexAlgorithms, s.cfg.Server.KexAlgorithms); len(kexAlgorithms) > 0 {
+		sshCfg.KeyExchanges = kexAlgorithms
 	}
 }
 
-func (s *serverConfig) configureKeyExchanges(sshCfg *ssh.ServerConfig) {
-	if len(s.cfg.Server.KexAlgorithms) > 0 {
-		sshCfg.KeyExchanges = s.cfg.Server.KexAlgorithms
+func (s *serverConfig) configureMACs(sshCfg *ssh.ServerConfig, lc config.ListenerConfig) {
+	if macs := listenerOrServerAlgorithms(lc.MACs, s.cfg.Server.MACs); len(macs) > 0 {
+		sshCfg.MACs = macs
 	}
 }
 
-func (s *serverConfig) configureMACs(sshCfg *ssh.ServerConfig) {
-	if len(s.cfg.Server.MACs) > 0 {
-		sshCfg.MACs = s.cfg.Server.MACs
+func listenerOrServerAlgorithms(listenerAlgorithms, serverAlgorithms []string) []string {
+	if len(listenerAlgorithms) > 0 {
+		return listenerAlgorithms
 	}
+
+	return serverAlgorithms
 }
@@ -7,6 +7,7 @@ import (
 	"crypto/rsa"
 	"encoding/base64"
 	"errors"
+	"net"
 	"net/http"
 	"os"
 	"path"
@@ -155,6 +156,43 @@ func TestUserKeyHandling(t *testing.T) {
 	}
 }
 
+func TestRevokedUserKey(t *testing.T) {
+	testRoot := testhelper.PrepareTestRootDir(t)
+
+	revokedKey := rsaPublicKey(t)
+	revokedKeysFile := path.Join(t.TempDir(), "revoked_keys")
+	require.NoError(t, os.WriteFile(revokedKeysFile, ssh.MarshalAuthorizedKey(revokedKey), 0o600))
+
+	requests := []testserver.TestRequestHandler{
+		{
+			Path: "/api/v4/internal/authorized_keys",
+			Handler: func(w http.ResponseWriter, _ *http.Request) {
+				w.Write([]byte(`{ "id": 1, "key": "key" }`))
+			},
+		},
+	}
+
+	url := testserver.StartSocketHTTPServer(t, requests)
+
+	cfg, err := newServerConfig(&config.Config{
+		GitlabUrl:       url,
+		User:            "user",
+		RevokedKeysFile: revokedKeysFile,
+		Server:          config.ServerConfig{HostKeyFiles: []string{path.Join(testRoot, "certs/valid/server.key")}},
+	})
+	require.NoError(t, err)
+
+	permissions, err := cfg.handleUserKey(context.Background(), "user", revokedKey)
+	require.EqualError(t, err, "public key is revoked")
+	require.Nil(t, permissions)
+
+	permissions, err = cfg.handleUserKey(context.Background(), "user", rsaPublicKey(t))
+	require.NoError(t, err)
+	require.Equal(t, &ssh.Permissions{Extensions: map[string]string{"key-id": "1"}}, permissions)
+}
+
+var remoteAddr = &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1234}
+
 func TestUserCertificateHandling(t *testing.T) {
 	testRoot := testhelper.PrepareTestRootDir(t)
 
@@ -240,20 +278,213 @@ func TestUserCertificateHandling(t *testing.T) {
 	for _, tc := range testCases {
 		t.Run(tc.desc, func(t *testing.T) {
 			t.Setenv("FF_GITLAB_SHELL_SSH_CERTIFICATES", tc.featureFlagValue)
-			permissions, err := cfg.handleUserCertificate(context.Background(), "user", tc.cert)
+			permissions, err := cfg.handleUserCertificate(context.Background(), "user", remoteAddr, tc.cert)
 			require.Equal(t, tc.expectedErr, err)
 			require.Equal(t, tc.expectedPermissions, permissions)
 		})
 	}
 }
 
+func TestUserCertificateOptions(t *testing.T) {
+	testRoot := testhelper.PrepareTestRootDir(t)
+
+	caKeyRaw, err := os.ReadFile(path.Join(testRoot, "certs/valid/server.key"))
+	require.NoError(t, err)
+	ca, err := ssh.ParsePrivateKey(caKeyRaw)
+	require.NoError(t, err)
+
+	requests := []testserver.TestRequestHandler{
+		{
+			Path: "/api/v4/internal/authorized_certs",
+			Handler: func(w http.ResponseWriter, r *http.Request) {
+				key := strings.TrimPrefix(ssh.FingerprintSHA256(ca.PublicKey()), "SHA256:")
+				if key == r.URL.Query().Get("key") {
+					w.Write([]byte(`{ "username": "root", "namespace": "namespace" }`))
+				} else {
+					w.WriteHeader(http.StatusInternalServerError)
+				}
+			},
+		},
+	}
+
+	url := testserver.StartSocketHTTPServer(t, requests)
+
+	srvCfg := config.ServerConfig{
+		HostKeyFiles: []string{path.Join(testRoot, "certs/valid/server.key")},
+		UserCertificates: config.UserCertificatesConfig{
+			Enabled: true,
+			KRLFile: path.Join(testRoot, "certs/valid/revoked_user_certs.krl"),
+		},
+	}
+
+	cfg, err := newServerConfig(&config.Config{GitlabUrl: url, User: "git", Server: srvCfg})
+	require.NoError(t, err)
+
+	testCases := []struct {
+		desc                string
+		keyID               string
+		principals          []string
+		options             map[string]string
+		expectedErr         string
+		expectedPermissions *ssh.Permissions
+	}{
+		{
+			desc:  "no options",
+			keyID: "root@example.com",
+			expectedPermissions: &ssh.Permissions{
+				Extensions: map[string]string{"username": "root", "namespace": "namespace"},
+			},
+		}, {
+			desc:       "matching principal",
+			keyID:      "root@example.com",
+			principals: []string{"git"},
+			expectedPermissions: &ssh.Permissions{
+				Extensions: map[string]string{"username": "root", "namespace": "namespace"},
+			},
+		}, {
+			desc:        "mismatching principal",
+			keyID:       "root@example.com",
+			principals:  []string{"root"},
+			expectedErr: `ssh: principal "git" not in the set of valid principals for given certificate: ["root"]`,
+		}, {
+			desc:    "matching source address",
+			keyID:   "root@example.com",
+			options: map[string]string{"source-address": "192.168.0.1,10.0.0.0/8"},
+			expectedPermissions: &ssh.Permissions{
+				CriticalOptions: map[string]string{"source-address": "192.168.0.1,10.0.0.0/8"},
+				Extensions:      map[string]string{"username": "root", "namespace": "namespace"},
+			},
+		}, {
+			desc:        "mismatching source address",
+			keyID:       "root@example.com",
+			options:     map[string]string{"source-address": "192.168.0.1,10.1.0.0/16"},
+			expectedErr: "remote address 10.0.0.1:1234 is not allowed because of source-address restriction",
+		}, {
+			desc:        "invalid source address",
+			keyID:       "root@example.com",
+			options:     map[string]string{"source-address": "invalid"},
+			expectedErr: `invalid source-address restriction "invalid": invalid CIDR address: invalid`,
+		}, {
+			desc:    "force command",
+			keyID:   "root@example.com",
+			options: map[string]string{"force-command": "git-upload-pack group/project.git"},
+			expectedPermissions: &ssh.Permissions{
+				CriticalOptions: map[string]string{"force-command": "git-upload-pack group/project.git"},
+				Extensions:      map[string]string{"username": "root", "namespace": "namespace"},
+			},
+		}, {
+			desc:        "unsupported option",
+			keyID:       "root@example.com",
+			options:     map[string]string{"verify-required": ""},
+			expectedErr: `ssh: unsupported critical option "verify-required" in certificate`,
+		}, {
+			desc:        "revoked certificate",
+			keyID:       "revoked@example.com",
+			expectedErr: "handleUserCertificate: certificate is revoked",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			cert := &ssh.Certificate{
+				CertType:        ssh.UserCert,
+				Key:             rsaPublicKey(t),
+				KeyId:           tc.keyID,
+				ValidPrincipals: tc.principals,
+				ValidBefore:     ssh.CertTimeInfinity,
+				Permissions:     ssh.Permissions{CriticalOptions: tc.options},
+			}
+			require.NoError(t, cert.SignCert(rand.Reader, ca))
+
+			permissions, err := cfg.handleUserCertificate(context.Background(), "git", remoteAddr, cert)
+			if tc.expectedErr != "" {
+				require.EqualError(t, err, tc.expectedErr)
+			} else {
+				require.NoError(t, err)
+			}
+			require.Equal(t, tc.expectedPermissions, permissions)
+		})
+	}
+}
+
+func TestInvalidUserCertificatesKRL(t *testing.T) {
+	testRoot := testhelper.PrepareTestRootDir(t)
+
+	srvCfg := config.ServerConfig{
+		HostKeyFiles: []string{path.Join(testRoot, "certs/valid/server.key")},
+		UserCertificates: config.UserCertificatesConfig{
+			Enabled: true,
+			KRLFile: path.Join(testRoot, "certs/valid/server.pub"),
+		},
+	}
+
+	_, err := newServerConfig(&config.Config{GitlabUrl: "http://localhost", Server: srvCfg})
+	require.EqualError(t, err, "failed to load user certificates KRL: krl: invalid format: bad magic")
+}
+
+func TestInvalidListeners(t *testing.T) {
+	testRoot := testhelper.PrepareTestRootDir(t)
+
+	testCases := []struct {
+		desc          string
+		listeners     []config.ListenerConfig
+		expectedError string
+	}{
+		{
+			desc: "duplicate name",
+			listeners: []config.ListenerConfig{
+				{Name: "external", Listen: "[::]:22"},
+				{Name: "external", Listen: "[::]:2222"},
+			},
+			expectedError: `listener "external" is configured more than once`,
+		},
+		{
+			desc: "unknown auth method",
+			listeners: []config.ListenerConfig{
+				{Listen: "[::]:22", AuthMethods: []string{"password"}},
+			},
+			expectedError: `listener "[::]:22": unknown auth method "password"`,
+		},
+		{
+			desc: "invalid socket mode",
+			listeners: []config.ListenerConfig{
+				{Listen: "unix:/run/gitlab-sshd.sock", SocketMode: "rw-rw----"},
+			},
+			expectedError: `listener "unix:/run/gitlab-sshd.sock": invalid socket mode "rw-rw----"`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			srvCfg := config.ServerConfig{
+				HostKeyFiles: []string{path.Join(testRoot, "certs/valid/server.key")},
+				Listeners:    tc.listeners,
+			}
+
+			_, err := newServerConfig(&config.Config{GitlabUrl: "http://localhost", Server: srvCfg})
+			require.EqualError(t, err, tc.expectedError)
+		})
+	}
+}
+
+func TestListenerConfigOnReload(t *testing.T) {
+	internal := config.ListenerConfig{Name: "internal", Listen: "127.0.0.1:22"}
+	reloaded := config.ListenerConfig{Name: "internal", Listen: "127.0.0.1:22", Ciphers: []string{"aes256-gcm@openssh.com"}}
+	removed := config.ListenerConfig{Name: "removed", Listen: "127.0.0.1:2222"}
+
+	srvCfg := &serverConfig{listeners: map[string]config.ListenerConfig{"internal": reloaded}}
+
+	require.Equal(t, reloaded, srvCfg.listenerConfig(internal))
+	require.Equal(t, removed, srvCfg.listenerConfig(removed))
+}
+
 func TestFipsDefaultAlgorithms(t *testing.T) {
 	if !fips.Enabled() {
 		t.Skip()
 	}
 
 	srvCfg := &serverConfig{cfg: &config.Config{}}
-	sshServerConfig := srvCfg.get(context.Background())
+	sshServerConfig := srvCfg.get(context.Background(), config.ListenerConfig{})
 
 	algorithms := fips.DefaultAlgorithms()
 
@@ -288,7 +519,7 @@ func TestNonFipsDefaultAlgorithms(t *testing.T) {
 	}
 
 	srvCfg := &serverConfig{cfg: &config.Config{}}
-	sshServerConfig := srvCfg.get(context.Background())
+	sshServerConfig := srvCfg.get(context.Background(), config.ListenerConfig{})
 
 	defaultCfg := ssh.ServerConfig{}
 	defaultCfg.SetDefaults()
@@ -315,7 +546,7 @@ func TestCustomAlgorithms(t *testing.T) {
 			},
 		},
 	}
-	sshServerConfig := srvCfg.get(context.Background())
+	sshServerConfig := srvCfg.get(context.Background(), config.ListenerConfig{})
 
 	require.Equal(t, customMACs, sshServerConfig.MACs)
 	require.Equal(t, customKexAlgos, sshServerConfig.KeyExchanges)
@@ -340,7 +571,7 @@ func TestGSSAPIWithMIC(t *testing.T) {
 			},
 		},
 	}
-	sshServerConfig := srvCfg.get(context.Background())
+	sshServerConfig := srvCfg.get(context.Background(), config.ListenerConfig{})
 	server := sshServerConfig.GSSAPIWithMICConfig.Server.(*OSGSSAPIServer)
 
 	require.NotNil(t, sshServerConfig.GSSAPIWithMICConfig)
@@ -366,7 +597,7 @@ func TestGSSAPIWithMICDisabled(t *testing.T) {
 			},
 		},
 	}
-	sshServerConfig := srvCfg.get(context.Background())
+	sshServerConfig := srvCfg.get(context.Background(), config.ListenerConfig{})
 
 	require.Nil(t, sshServerConfig.GSSAPIWithMICConfig)
 
@@ -375,6 +606,48 @@ func TestGSSAPIWithMICDisabled(t *testing.T) {
 	require.Nil(t, sshServerConfig.GSSAPIWithMICConfig)
 }
 
+func TestListenerAlgorithms(t *testing.T) {
+	serverMACs := []string{"hmac-sha2-256-etm@openssh.com"}
+	listenerMACs := []string{"hmac-sha2-512-etm@openssh.com"}
+	listenerCiphers := []string{"aes256-gcm@openssh.com"}
+
+	srvCfg := &serverConfig{
+		cfg: &config.Config{
+			Server: config.ServerConfig{
+				MACs: serverMACs,
+			},
+		},
+	}
+
+	sshServerConfig := srvCfg.get(context.Background(), config.ListenerConfig{Ciphers: listenerCiphers})
+	require.Equal(t, serverMACs, sshServerConfig.MACs)
+	require.Equal(t, listenerCiphers, sshServerConfig.Ciphers)
+
+	sshServerConfig = srvCfg.get(context.Background(), config.ListenerConfig{MACs: listenerMACs})
+	require.Equal(t, listenerMACs, sshServerConfig.MACs)
+}
+
+func TestListenerAuthMethods(t *testing.T) {
+	srvCfg := &serverConfig{
+		cfg: &config.Config{
+			Server: config.ServerConfig{
+				GSSAPI: config.GSSAPIConfig{
+					Enabled:              true,
+					ServicePrincipalName: "host/test@TEST.TEST",
+				},
+			},
+		},
+	}
+
+	sshServerConfig := srvCfg.get(context.Background(), config.ListenerConfig{AuthMethods: []string{"publickey"}})
+	require.NotNil(t, sshServerConfig.PublicKeyCallback)
+	require.Nil(t, sshServerConfig.GSSAPIWithMICConfig)
+
+	sshServerConfig = srvCfg.get(context.Background(), config.ListenerConfig{AuthMethods: []string{"gssapi-with-mic"}})
+	require.Nil(t, sshServerConfig.PublicKeyCallback)
+	require.NotNil(t, sshServerConfig.GSSAPIWithMICConfig)
+}
+
 func rsaPublicKey(t *testing.T) ssh.PublicKey {
 	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
 	require.NoError(t, err)
@@ -5,20 +5,28 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"reflect"
+	"slices"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"gitlab.com/gitlab-org/labkit/correlation"
 	"gitlab.com/gitlab-org/labkit/log"
 	"golang.org/x/crypto/ssh"
 	grpccodes "google.golang.org/grpc/codes"
 	grpcstatus "google.golang.org/grpc/status"
 
 	shellCmd "gitlab.com/gitlab-org/gitlab-shell/v14/cmd/gitlab-shell/command"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/auditlog"
 	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/command"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/command/commandargs"
 	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/command/readwriter"
 	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/command/shared/disallowedcommand"
 	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/config"
 	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/console"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/handler"
 	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/metrics"
 	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/sshenv"
 )
@@ -32,13 +40,71 @@ type session struct {
 	gitlabUsername      string
 	namespace           string
 	remoteAddr          string
+	forceCommand        string
+	keyFingerprint      string
+	proxyTLVs           map[string]string
+	cancel              context.CancelFunc
+	shuttingDown        func() bool
 
 	// State managed by the session
 	execCmd            string
 	gitProtocolVersion string
+	clientEnv          map[string]string
 	started            time.Time
+	state              atomic.Int32
+	commandType        commandargs.CommandType
+	readBytes          int64
+	writtenBytes       int64
+	exitStatus         uint32
+
+	// State exposed to the admin API while the session is running
+	infoMu       sync.Mutex
+	command      string
+	repo         string
+	bytesWritten atomic.Int64
 }
 
+// sessionInfo describes a running session in the admin API
+type sessionInfo struct {
+	CorrelationID string    `json:"correlation_id"`
+	RemoteAddr    string    `json:"remote_addr"`
+	KeyID         string    `json:"key_id,omitempty"`
+	Username      string    `json:"username,omitempty"`
+	Krb5Principal string    `json:"krb5_principal,omitempty"`
+	State         string    `json:"state"`
+	Command       string    `json:"command,omitempty"`
+	CommandType   string    `json:"command_type,omitempty"`
+	Repo          string    `json:"repo,omitempty"`
+	Started       time.Time `json:"started"`
+	WrittenBytes  int64     `json:"written_bytes"`
+}
+
+const (
+	// sessionIdle means the session is still negotiating: no command has been started yet
+	sessionIdle int32 = iota
+	// sessionExecuting means a command is being executed within the session
+	sessionExecuting
+	// sessionDraining means the server is shutting down and the session won't execute a command
+	sessionDraining
+)
+
+const (
+	shutdownNotice    = "The server is shutting down. Please try again in a few moments."
+	terminationNotice = "The session has been terminated by an administrator."
+
+	// noticeTimeout bounds how long a notice may delay closing a session. A
+	// client that doesn't read its channel may have exhausted the window, which
+	// stderr shares with stdout, so writing to it would block.
+	noticeTimeout = 500 * time.Millisecond
+)
+
+const (
+	// maxClientEnv is the maximum number of accepted environment variables per session
+	maxClientEnv = 32
+	// maxClientEnvValueLength is the maximum length of an accepted environment variable
+	maxClientEnvValueLength = 1024
+)
+
 type execRequest struct {
 	Command string
 }
@@ -48,6 +114,10 @@ type envRequest struct {
 	Value string
 }
 
+type subsystemRequest struct {
+	Name string
+}
+
 type exitStatusReq struct {
 	ExitStatus uint32
 }
@@ -83,6 +153,8 @@ func (s *session) handle(ctx context.Context, requests <-chan *ssh.Request) (con
 			var status uint32
 			ctxWithLogData, status, err = s.handleShell(ctx, req)
 			s.exit(ctx, status)
+		case "subsystem":
+			shouldContinue, ctxWithLogData, err = s.handleSubsystem(ctx, req)
 		default:
 			// Ignore unknown requests but don't terminate the session
 			shouldContinue = true
@@ -116,10 +188,16 @@ func (s *session) handleEnv(ctx context.Context, req *ssh.Request) (bool, error)
 		return false, err
 	}
 
-	switch envReq.Name {
-	case sshenv.GitProtocolEnv:
+	switch {
+	case envReq.Name == sshenv.GitProtocolEnv:
 		s.gitProtocolVersion = envReq.Value
 		accepted = true
+	case s.acceptsEnv(envReq):
+		if s.clientEnv == nil {
+			s.clientEnv = make(map[string]string)
+		}
+		s.clientEnv[envReq.Name] = envReq.Value
+		accepted = true
 	default:
 		// Client requested a forbidden envvar, nothing to do
 	}
@@ -137,6 +215,47 @@ func (s *session) handleEnv(ctx context.Context, req *ssh.Request) (bool, error)
 	return true, nil
 }
 
+// acceptsEnv tells whether the variable is in the accepted list. Only
+// printable ASCII values are accepted, so that they can be sent as Gitaly
+// metadata, and the number of variables is limited.
+func (s *session) acceptsEnv(envReq envRequest) bool {
+	if s.cfg == nil || !isValidEnvName(envReq.Name) || !sshenv.IsAccepted(s.cfg.Server.AcceptedEnv, envReq.Name) {
+		return false
+	}
+
+	if _, ok := s.clientEnv[envReq.Name]; !ok && len(s.clientEnv) >= maxClientEnv {
+		return false
+	}
+
+	if len(envReq.Value) > maxClientEnvValueLength {
+		return false
+	}
+
+	for _, c := range envReq.Value {
+		if c < ' ' || c > '~' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// isValidEnvName tells whether the name is made of ASCII letters, digits and
+// underscores only. Accepted variables are passed on as gRPC metadata keys.
+func isValidEnvName(name string) bool {
+	if name == "" {
+		return false
+	}
+
+	for _, c := range name {
+		if (c < 'a' || c > 'z') && (c < 'A' || c > 'Z') && (c < '0' || c > '9') && c != '_' {
+			return false
+		}
+	}
+
+	return true
+}
+
 func (s *session) handleExec(ctx context.Context, req *ssh.Request) (context.Context, error) {
 	var execReq execRequest
 
@@ -152,29 +271,97 @@ func (s *session) handleExec(ctx context.Context, req *ssh.Request) (context.Con
 	return ctxWithLogData, err
 }
 
+// handleSubsystem executes the command that implements the requested
+// subsystem. Unknown subsystems are rejected without terminating the session.
+func (s *session) handleSubsystem(ctx context.Context, req *ssh.Request) (bool, context.Context, error) {
+	var subsystemReq subsystemRequest
+
+	if err := ssh.Unmarshal(req.Payload, &subsystemReq); err != nil {
+		return false, ctx, err
+	}
+
+	if subsystemReq.Name != string(commandargs.Browse) {
+		log.WithContextFields(ctx, log.Fields{"subsystem": subsystemReq.Name}).Info("session: handleSubsystem: unknown subsystem")
+
+		if req.WantReply {
+			if err := req.Reply(false, []byte{}); err != nil {
+				log.ContextLogger(ctx).WithError(err).Debug("session: handleSubsystem: Failed to reply")
+			}
+		}
+
+		return true, ctx, nil
+	}
+
+	s.execCmd = subsystemReq.Name
+
+	ctxWithLogData, status, err := s.handleShell(ctx, req)
+	s.exit(ctxWithLogData, status)
+
+	return false, ctxWithLogData, err
+}
+
 func (s *session) handleShell(ctx context.Context, req *ssh.Request) (context.Context, uint32, error) {
 	ctxlog := log.ContextLogger(ctx)
 
+	// A session registered after the server has drained its sessions is drained here
+	if s.shuttingDown != nil && s.shuttingDown() && s.state.CompareAndSwap(sessionIdle, sessionDraining) {
+		s.notify(ctx, "%s\n", shutdownNotice)
+	}
+
+	if !s.state.CompareAndSwap(sessionIdle, sessionExecuting) {
+		ctxlog.Info("session: handleShell: server is shutting down, command is not executed")
+
+		if req.WantReply {
+			if err := req.Reply(false, []byte{}); err != nil {
+				ctxlog.WithError(err).Debug("session: handleShell: Failed to reply")
+			}
+		}
+
+		return ctx, 1, nil
+	}
+
 	if req.WantReply {
 		if err := req.Reply(true, []byte{}); err != nil {
 			ctxlog.WithError(err).Debug("session: handleShell: Failed to reply")
 		}
 	}
 
+	if s.forceCommand != "" {
+		ctxlog.WithFields(log.Fields{"original_command": s.execCmd}).Info("session: handleShell: command is forced by the certificate")
+		s.execCmd = s.forceCommand
+	}
+
+	commandType, repo := parseCommand(s.execCmd)
+	s.infoMu.Lock()
+	s.command = s.execCmd
+	s.commandType = commandType
+	s.repo = repo
+	s.infoMu.Unlock()
+
 	env := sshenv.Env{
 		IsSSHConnection:    true,
 		OriginalCommand:    s.execCmd,
 		GitProtocolVersion: s.gitProtocolVersion,
 		RemoteAddr:         s.remoteAddr,
 		NamespacePath:      s.namespace,
+		ClientEnv:          s.clientEnv,
+		ProxyTLVs:          s.proxyTLVs,
 	}
 
-	countingWriter := &readwriter.CountingWriter{W: s.channel}
+	cmdCtx, cancelCmd := context.WithCancel(ctx)
+	defer cancelCmd()
+
+	watchdog := newCommandWatchdog(s.cfg.Server.CommandTimeouts, s.commandType, func(timeoutErr *commandTimeoutError) {
+		s.terminateCommand(ctx, cancelCmd, timeoutErr)
+	})
+
+	countingWriter := &readwriter.CountingWriter{W: watchdog.writer(&progressWriter{w: s.channel, n: &s.bytesWritten})}
+	countingReader := &readwriter.CountingReader{R: watchdog.reader(s.channel)}
 
 	rw := &readwriter.ReadWriter{
 		Out:    countingWriter,
-		In:     s.channel,
-		ErrOut: s.channel.Stderr(),
+		In:     countingReader,
+		ErrOut: watchdog.writer(s.channel.Stderr()),
 	}
 
 	cmd, err := s.getCommand(env, rw)
@@ -191,20 +378,38 @@ func (s *session) handleShell(ctx context.Context, req *ssh.Request) (context.Co
 	}).Info("session: handleShell: executing command")
 	metrics.SshdSessionEstablishedDuration.Observe(establishSessionDuration)
 
-	ctxWithLogData, err := cmd.Execute(ctx)
+	executionStarted := time.Now()
+	watchdog.start()
+	ctxWithLogData, err := cmd.Execute(cmdCtx)
+	watchdog.stop()
 
-	logData := extractLogDataFromContext(ctxWithLogData)
+	s.readBytes = countingReader.N
+	s.writtenBytes = countingWriter.N
+	observeTransfer(s.commandType, "in", countingReader.N, time.Since(executionStarted))
+	observeTransfer(s.commandType, "out", countingWriter.N, time.Since(executionStarted))
+
+	logData := extractDataFromContext(ctxWithLogData)
 	logData.WrittenBytes = countingWriter.N
+	logData.ReadBytes = countingReader.N
 
 	ctxWithLogData = context.WithValue(ctx, logInfo{}, logData)
 
+	if timeoutErr := watchdog.err(); timeoutErr != nil {
+		// The client has already been told why the command has been terminated
+		return ctxWithLogData, 1, timeoutErr
+	}
+
 	if err != nil {
 		grpcStatus := grpcstatus.Convert(err)
 		if grpcStatus.Code() != grpccodes.Internal {
 			s.toStderr(ctx, "ERROR: %v\n", grpcStatus.Message())
 		}
 
-		return ctx, 1, err
+		if handler.IsLimitError(err) {
+			return ctxWithLogData, handler.LimitErrorExitStatus, err
+		}
+
+		return ctxWithLogData, 1, err
 	}
 
 	ctxlog.Info("session: handleShell: command executed successfully")
@@ -237,14 +442,175 @@ func (s *session) getCommand(env sshenv.Env, rw *readwriter.ReadWriter) (command
 	return cmd, err
 }
 
+// drain notifies the session that the server is shutting down. A session that
+// hasn't started executing a command yet receives a warning and is closed, while
+// a session that is executing a command is left to complete. It reports whether
+// the session has been closed.
+func (s *session) drain(ctx context.Context) bool {
+	if !s.state.CompareAndSwap(sessionIdle, sessionDraining) {
+		return false
+	}
+
+	s.notify(ctx, "%s\n", shutdownNotice)
+	_ = s.channel.Close()
+
+	return true
+}
+
+// terminate closes the session on behalf of an administrator, whether it's
+// executing a command or not
+func (s *session) terminate(ctx context.Context) {
+	s.state.CompareAndSwap(sessionIdle, sessionDraining)
+
+	s.notify(ctx, "%s\n", terminationNotice)
+	if s.cancel != nil {
+		s.cancel()
+	}
+	_ = s.channel.Close()
+}
+
+// terminateCommand stops a command that has timed out. The channel is closed
+// as well, since the command may be blocked on the client.
+func (s *session) terminateCommand(ctx context.Context, cancel context.CancelFunc, timeoutErr *commandTimeoutError) {
+	log.WithContextFields(ctx, log.Fields{
+		"command_type": s.commandType,
+		"reason":       timeoutErr.reason,
+		"timeout":      timeoutErr.timeout.String(),
+	}).Warn("session: terminateCommand: command timed out")
+	metrics.SshdCommandTimeoutsTotal.WithLabelValues(string(s.commandType), timeoutErr.reason).Inc()
+
+	s.notify(ctx, "ERROR: %v\n", timeoutErr)
+	cancel()
+	_ = s.channel.Close()
+}
+
+// info describes the session for the admin API
+func (s *session) info(ctx context.Context) sessionInfo {
+	info := sessionInfo{
+		CorrelationID: correlation.ExtractFromContext(ctx),
+		RemoteAddr:    s.remoteAddr,
+		KeyID:         s.gitlabKeyID,
+		Username:      s.gitlabUsername,
+		Krb5Principal: s.gitlabKrb5Principal,
+		Started:       s.started,
+		WrittenBytes:  s.bytesWritten.Load(),
+	}
+
+	switch s.state.Load() {
+	case sessionIdle:
+		info.State = "idle"
+	case sessionExecuting:
+		info.State = "executing"
+	case sessionDraining:
+		info.State = "closing"
+	}
+
+	s.infoMu.Lock()
+	info.Command = s.command
+	info.CommandType = string(s.commandType)
+	info.Repo = s.repo
+	s.infoMu.Unlock()
+
+	return info
+}
+
+// auditRecord describes the session for the audit log once it has completed
+func (s *session) auditRecord(ctx context.Context, logData command.LogData) auditlog.Record {
+	authMethod := auditlog.AuthMethodKey
+	switch {
+	case s.gitlabKrb5Principal != "":
+		authMethod = auditlog.AuthMethodKrb5
+	case s.gitlabUsername != "":
+		authMethod = auditlog.AuthMethodCertificate
+	}
+
+	username := logData.Username
+	if username == "" {
+		username = s.gitlabUsername
+	}
+
+	return auditlog.Record{
+		Time:           time.Now().UTC(),
+		CorrelationID:  correlation.ExtractFromContext(ctx),
+		RemoteAddr:     s.remoteAddr,
+		AuthMethod:     authMethod,
+		KeyFingerprint: s.keyFingerprint,
+		KeyID:          s.gitlabKeyID,
+		Krb5Principal:  s.gitlabKrb5Principal,
+		Username:       username,
+		CommandType:    string(s.commandType),
+		Project:        logData.Meta.Project,
+		ExitStatus:     s.exitStatus,
+		ReadBytes:      s.readBytes,
+		WrittenBytes:   s.writtenBytes,
+		DurationS:      time.Since(s.started).Seconds(),
+	}
+}
+
+// observeTransfer records the bytes transferred by a command in the given direction and its throughput
+func observeTransfer(commandType commandargs.CommandType, direction string, n int64, duration time.Duration) {
+	metrics.SshdSessionTransferredBytes.WithLabelValues(string(commandType), direction).Observe(float64(n))
+
+	if duration > 0 {
+		metrics.SshdSessionThroughput.WithLabelValues(string(commandType), direction).Observe(float64(n) / duration.Seconds())
+	}
+}
+
+// parseCommand returns the type of the command and the repository it accesses,
+// or empty values if the command can't be parsed
+func parseCommand(execCmd string) (commandargs.CommandType, string) {
+	args := &commandargs.Shell{}
+	if err := args.ParseCommand(execCmd); err != nil {
+		return "", ""
+	}
+
+	var repo string
+	if len(args.SSHArgs) > 1 && (args.CommandType == commandargs.LfsTransfer || slices.Contains(commandargs.GitCommands, args.CommandType)) {
+		repo = args.SSHArgs[1]
+	}
+
+	return args.CommandType, repo
+}
+
+// progressWriter counts the bytes written so far, so that they can be read
+// while the command is still being executed
+type progressWriter struct {
+	w io.Writer
+	n *atomic.Int64
+}
+
+func (pw *progressWriter) Write(p []byte) (int, error) {
+	n, err := pw.w.Write(p)
+	pw.n.Add(int64(n))
+
+	return n, err
+}
+
 func (s *session) toStderr(ctx context.Context, format string, args ...interface{}) {
 	out := fmt.Sprintf(format, args...)
 	log.WithContextFields(ctx, log.Fields{"stderr": out}).Debug("session: toStderr: output")
 	console.DisplayWarningMessage(out, s.channel.Stderr())
 }
 
+// notify writes a message to stderr, but waits for it for noticeTimeout at most,
+// so that the session can be closed even if the client doesn't read it
+func (s *session) notify(ctx context.Context, format string, args ...interface{}) {
+	written := make(chan struct{})
+	go func() {
+		defer close(written)
+		s.toStderr(ctx, format, args...)
+	}()
+
+	select {
+	case <-written:
+	case <-time.After(noticeTimeout):
+		log.WithContextFields(ctx, log.Fields{}).Info("session: notify: the client doesn't read the notice")
+	}
+}
+
 func (s *session) exit(ctx context.Context, status uint32) {
 	log.WithContextFields(ctx, log.Fields{"exit_status": status}).Info("session: exit: exiting")
+	s.exitStatus = status
 	req := exitStatusReq{ExitStatus: status}
 
 	_ = s.channel.CloseWrite()
@@ -6,14 +6,22 @@ import (
 	"errors"
 	"io"
 	"net/http"
+	"path/filepath"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/stretchr/testify/require"
 	"golang.org/x/crypto/ssh"
 
 	"gitlab.com/gitlab-org/gitlab-shell/v14/client/testserver"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/command/commandargs"
 	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/config"
 	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/console"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/metrics"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/testhelper/requesthandlers"
 )
 
 type fakeChannel struct {
@@ -50,6 +58,45 @@ func (f *fakeChannel) Stderr() io.ReadWriter {
 	return f.stdErr
 }
 
+// stuckChannel is the channel of a client that doesn't read it: writes to
+// stderr block until the channel is closed
+type stuckChannel struct {
+	fakeChannel
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func newStuckChannel() *stuckChannel {
+	return &stuckChannel{closed: make(chan struct{})}
+}
+
+func (c *stuckChannel) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return nil
+}
+
+func (c *stuckChannel) Stderr() io.ReadWriter {
+	return c
+}
+
+func (c *stuckChannel) Read(_ []byte) (int, error) {
+	return 0, io.EOF
+}
+
+func (c *stuckChannel) Write(_ []byte) (int, error) {
+	<-c.closed
+	return 0, io.EOF
+}
+
+func (c *stuckChannel) isClosed() bool {
+	select {
+	case <-c.closed:
+		return true
+	default:
+		return false
+	}
+}
+
 var requests = []testserver.TestRequestHandler{
 	{
 		Path: "/api/v4/internal/discover",
@@ -66,6 +113,7 @@ func TestHandleEnv(t *testing.T) {
 		expectedErr             error
 		expectedProtocolVersion string
 		expectedResult          bool
+		expectedClientEnv       map[string]string
 	}{
 		{
 			desc:                    "invalid payload",
@@ -85,12 +133,39 @@ func TestHandleEnv(t *testing.T) {
 			expectedErr:             nil,
 			expectedProtocolVersion: "1",
 			expectedResult:          true,
+		}, {
+			desc:                    "valid payload with accepted env var",
+			payload:                 ssh.Marshal(envRequest{Name: "GL_FEATURE_HINT", Value: "enabled"}),
+			expectedErr:             nil,
+			expectedProtocolVersion: "1",
+			expectedResult:          true,
+			expectedClientEnv:       map[string]string{"GL_FEATURE_HINT": "enabled"},
+		}, {
+			desc:                    "accepted env var with a non-printable value",
+			payload:                 ssh.Marshal(envRequest{Name: "LANG", Value: "en_US\n"}),
+			expectedErr:             nil,
+			expectedProtocolVersion: "1",
+			expectedResult:          true,
+		}, {
+			desc:                    "accepted env var with an invalid name",
+			payload:                 ssh.Marshal(envRequest{Name: "GL_FEATURE-HINT", Value: "enabled"}),
+			expectedErr:             nil,
+			expectedProtocolVersion: "1",
+			expectedResult:          true,
+		}, {
+			desc:                    "accepted env var with a non-ASCII name",
+			payload:                 ssh.Marshal(envRequest{Name: "GL_FÉATURE", Value: "enabled"}),
+			expectedErr:             nil,
+			expectedProtocolVersion: "1",
+			expectedResult:          true,
 		},
 	}
 
+	cfg := &config.Config{Server: config.ServerConfig{AcceptedEnv: []string{"LANG", "GL_*"}}}
+
 	for _, tc := range testCases {
 		t.Run(tc.desc, func(t *testing.T) {
-			s := &session{gitProtocolVersion: "1"}
+			s := &session{gitProtocolVersion: "1", cfg: cfg}
 			r := &ssh.Request{Payload: tc.payload}
 
 			shouldContinue, err := s.handleEnv(context.Background(), r)
@@ -98,6 +173,7 @@ func TestHandleEnv(t *testing.T) {
 			require.Equal(t, tc.expectedErr, err)
 			require.Equal(t, tc.expectedResult, shouldContinue)
 			require.Equal(t, tc.expectedProtocolVersion, s.gitProtocolVersion)
+			require.Equal(t, tc.expectedClientEnv, s.clientEnv)
 		})
 	}
 }
@@ -164,6 +240,49 @@ func TestHandleExec(t *testing.T) {
 	}
 }
 
+func TestHandleSubsystem(t *testing.T) {
+	testCases := []struct {
+		desc                string
+		name                string
+		expectedContinue    bool
+		expectedSentRequest string
+		expectedCommandType commandargs.CommandType
+	}{
+		{
+			desc:             "unknown subsystem",
+			name:             "sftp",
+			expectedContinue: true,
+		},
+		{
+			desc:                "browse subsystem",
+			name:                "gitlab-browse",
+			expectedContinue:    false,
+			expectedSentRequest: "exit-status",
+			expectedCommandType: commandargs.Browse,
+		},
+	}
+
+	url := testserver.StartHTTPServer(t, requests)
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			f := &fakeChannel{stdErr: &bytes.Buffer{}, stdOut: &bytes.Buffer{}}
+			s := &session{
+				gitlabKeyID: "root",
+				channel:     f,
+				cfg:         &config.Config{GitlabUrl: url},
+			}
+			r := &ssh.Request{Payload: ssh.Marshal(subsystemRequest{Name: tc.name})}
+
+			shouldContinue, _, _ := s.handleSubsystem(context.Background(), r)
+
+			require.Equal(t, tc.expectedContinue, shouldContinue)
+			require.Equal(t, tc.expectedSentRequest, f.sentRequestName)
+			require.Equal(t, tc.expectedCommandType, s.commandType)
+		})
+	}
+}
+
 func TestHandleShell(t *testing.T) {
 	testCases := []struct {
 		desc                 string
@@ -239,6 +358,7 @@ func TestHandleShell(t *testing.T) {
 
 			require.Equal(t, tc.expectedExitCode, exitCode)
 			require.Equal(t, tc.expectedWrittenBytes, logInfo.WrittenBytes)
+			require.Zero(t, logInfo.ReadBytes)
 
 			formattedErr := &bytes.Buffer{}
 			if tc.errMsg != "" {
@@ -250,3 +370,91 @@ func TestHandleShell(t *testing.T) {
 		})
 	}
 }
+
+func TestHandleShellWithForceCommand(t *testing.T) {
+	url := testserver.StartHTTPServer(t, requests)
+
+	stdOut := &bytes.Buffer{}
+	stdErr := &bytes.Buffer{}
+	s := &session{
+		gitlabKeyID:  "root",
+		execCmd:      "unknown-command",
+		forceCommand: "discover",
+		channel:      &fakeChannel{stdErr: stdErr, stdOut: stdOut},
+		cfg:          &config.Config{GitlabUrl: url},
+	}
+
+	_, exitCode, err := s.handleShell(context.Background(), &ssh.Request{})
+	require.NoError(t, err)
+	require.Equal(t, uint32(0), exitCode)
+	require.Equal(t, "Welcome to GitLab, @test-user!\n", stdOut.String())
+	require.Empty(t, stdErr.String())
+}
+
+func TestHandleShellOnShutdown(t *testing.T) {
+	stdOut := &bytes.Buffer{}
+	stdErr := &bytes.Buffer{}
+	s := &session{
+		gitlabKeyID:  "root",
+		execCmd:      "discover",
+		channel:      &fakeChannel{stdErr: stdErr, stdOut: stdOut},
+		cfg:          &config.Config{},
+		shuttingDown: func() bool { return true },
+	}
+
+	_, exitCode, err := s.handleShell(context.Background(), &ssh.Request{})
+	require.NoError(t, err)
+	require.Equal(t, uint32(1), exitCode)
+	require.Equal(t, sessionDraining, s.state.Load())
+	require.Empty(t, stdOut.String())
+	require.Contains(t, stdErr.String(), "remote: "+shutdownNotice+"\n")
+}
+
+func TestHandleShellWithFailedCommand(t *testing.T) {
+	requests := requesthandlers.BuildAllowedWithGitalyHandlers(t, "unix:"+filepath.Join(t.TempDir(), "missing.socket"))
+	url := testserver.StartHTTPServer(t, requests)
+
+	s := &session{
+		gitlabKeyID: "root",
+		execCmd:     "git-upload-pack group/repo",
+		channel:     &fakeChannel{stdErr: &bytes.Buffer{}, stdOut: &bytes.Buffer{}},
+		cfg:         &config.Config{GitlabUrl: url},
+	}
+	s.cfg.GitalyClient.InitSidechannelRegistry(context.Background())
+
+	ctxWithLogData, exitCode, err := s.handleShell(context.Background(), &ssh.Request{})
+	require.Error(t, err)
+	require.Equal(t, uint32(1), exitCode)
+
+	// The log data of the command is kept for the access and audit logs
+	logData := extractLogDataFromContext(ctxWithLogData)
+	require.Equal(t, "alex-doe", logData.Username)
+	require.Equal(t, "group/project-path", logData.Meta.Project)
+}
+
+func TestObserveTransfer(t *testing.T) {
+	observeTransfer("test-command", "in", 4096, 2*time.Second)
+	observeTransfer("test-command", "out", 1024, 0)
+
+	in := histogram(t, metrics.SshdSessionTransferredBytes, "test-command", "in")
+	require.Equal(t, uint64(1), in.GetSampleCount())
+	require.InDelta(t, 4096, in.GetSampleSum(), 0.1)
+
+	out := histogram(t, metrics.SshdSessionTransferredBytes, "test-command", "out")
+	require.Equal(t, uint64(1), out.GetSampleCount())
+	require.InDelta(t, 1024, out.GetSampleSum(), 0.1)
+
+	throughput := histogram(t, metrics.SshdSessionThroughput, "test-command", "in")
+	require.Equal(t, uint64(1), throughput.GetSampleCount())
+	require.InDelta(t, 2048, throughput.GetSampleSum(), 0.1)
+
+	// The throughput isn't observed when the command didn't take any time
+	require.Zero(t, histogram(t, metrics.SshdSessionThroughput, "test-command", "out").GetSampleCount())
+}
+
+func histogram(t *testing.T, vec *prometheus.HistogramVec, labels ...string) *dto.Histogram {
+	m := &dto.Metric{}
+	require.NoError(t, vec.WithLabelValues(labels...).(prometheus.Histogram).Write(m))
+
+	return m.GetHistogram()
+}
@@ -3,17 +3,20 @@ package sshd
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"maps"
 	"net"
 	"net/http"
-	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	proxyproto "github.com/pires/go-proxyproto"
 	"golang.org/x/crypto/ssh"
 
 	"gitlab.com/gitlab-org/gitlab-shell/v14/client"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/auditlog"
 	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/command"
 	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/config"
 	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/gitlabnet"
@@ -46,8 +49,25 @@ type Server struct {
 	status       status
 	statusMu     sync.RWMutex
 	wg           sync.WaitGroup
-	listener     net.Listener
-	serverConfig *serverConfig
+	listeners    []*listener
+	serverConfig atomic.Pointer[serverConfig]
+	rateLimiters *rateLimiters
+	auditLog     *auditlog.Logger
+
+	// monitoringListener is passed on to the new process of an upgrade
+	monitoringListener net.Listener
+	upgrading          atomic.Bool
+	upgraded           atomic.Bool
+
+	sessionsMu      sync.Mutex
+	sessions        map[*session]context.Context
+	connections     map[*connection]context.Context
+	sessionsChanged chan struct{}
+}
+
+type drainStatus struct {
+	Draining          bool `json:"draining"`
+	RemainingSessions int  `json:"remaining_sessions"`
 }
 
 type logInfo struct{}
@@ -59,7 +79,49 @@ func NewServer(cfg *config.Config) (*Server, error) {
 		return nil, err
 	}
 
-	return &Server{Config: cfg, serverConfig: serverConfig}, nil
+	auditLog, err := auditlog.New(cfg.Server.AuditLog.Output)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{
+		Config:          cfg,
+		rateLimiters:    newRateLimiters(cfg),
+		auditLog:        auditLog,
+		sessionsChanged: make(chan struct{}, 1),
+	}
+	s.serverConfig.Store(serverConfig)
+
+	return s, nil
+}
+
+// Reload uses cfg for new connections: the host keys, host certificates,
+// algorithm and authentication settings, and the settings of the connections
+// and sessions, like the GitLab API, timeouts and limits. Established
+// connections keep using the configuration they were accepted with. The
+// listeners, the monitoring endpoints and the rate limiters keep the settings
+// the server was started with. The Gitaly connections are kept. The audit log
+// is reopened with the output of cfg, so it can be rotated or changed.
+func (s *Server) Reload(cfg *config.Config) error {
+	// The Gitaly connections and the sidechannel registry are kept
+	if current := s.serverConfig.Load().cfg; current != cfg {
+		cfg.GitalyClient.Share(&current.GitalyClient)
+	}
+
+	serverConfig, err := newServerConfig(cfg)
+	if err != nil {
+		return err
+	}
+
+	// The configuration is only used once everything has been reloaded, so that
+	// the current one is kept on failure
+	if err := s.auditLog.Reopen(cfg.Server.AuditLog.Output); err != nil {
+		return fmt.Errorf("failed to reopen audit log: %w", err)
+	}
+
+	s.serverConfig.Store(serverConfig)
+
+	return nil
 }
 
 // ListenAndServe starts listening for SSH connections and serves them
@@ -67,7 +129,7 @@ func (s *Server) ListenAndServe(ctx context.Context) error {
 	if err := s.listen(ctx); err != nil {
 		return err
 	}
-	defer func() { _ = s.listener.Close() }()
+	defer func() { _ = s.closeListeners() }()
 
 	s.serve(ctx)
 
@@ -76,13 +138,33 @@ func (s *Server) ListenAndServe(ctx context.Context) error {
 
 // Shutdown gracefully shuts down the SSH server
 func (s *Server) Shutdown() error {
-	if s.listener == nil {
+	if len(s.getListeners()) == 0 {
 		return nil
 	}
 
 	s.changeStatus(StatusOnShutdown)
 
-	return s.listener.Close()
+	err := s.closeListeners()
+
+	s.drainSessions()
+
+	return err
+}
+
+// WaitForSessions blocks until all the active sessions have completed or ctx is done.
+// It reports whether all the sessions have completed.
+func (s *Server) WaitForSessions(ctx context.Context) bool {
+	for {
+		if s.remainingSessions() == 0 {
+			return true
+		}
+
+		select {
+		case <-ctx.Done():
+			return false
+		case <-s.sessionsChanged:
+		}
+	}
 }
 
 // MonitoringServeMux returns the ServeMux for monitoring endpoints
@@ -90,76 +172,66 @@ func (s *Server) MonitoringServeMux() *http.ServeMux {
 	mux := http.NewServeMux()
 
 	mux.HandleFunc(s.Config.Server.ReadinessProbe, func(w http.ResponseWriter, _ *http.Request) {
-		if s.getStatus() == StatusReady {
-			w.WriteHeader(http.StatusOK)
-		} else {
+		// Once the sockets have been passed on by an upgrade, the new process
+		// accepts the connections while this one drains its sessions
+		if s.getStatus() != StatusReady && !s.upgraded.Load() {
 			w.WriteHeader(http.StatusServiceUnavailable)
+			return
 		}
+
+		// The listeners are listed, so that it's visible whether the sockets
+		// have been opened or passed by systemd
+		listeners := []listenerStatus{}
+		for _, l := range s.getListeners() {
+			listeners = append(listeners, l.status())
+		}
+
+		writeJSON(w, struct {
+			Listeners []listenerStatus `json:"listeners"`
+		}{listeners})
 	})
 
 	mux.HandleFunc(s.Config.Server.LivenessProbe, func(w http.ResponseWriter, _ *http.Request) {
 		w.WriteHeader(http.StatusOK)
 	})
 
-	return mux
-}
-
-func (s *Server) listen(ctx context.Context) error {
-	sshListener, err := net.Listen("tcp", s.Config.Server.Listen)
-	if err != nil {
-		return fmt.Errorf("failed to listen for connection: %w", err)
-	}
-
-	if s.Config.Server.ProxyProtocol {
-		policy, err := s.proxyPolicy()
-		if err != nil {
-			return fmt.Errorf("invalid policy configuration: %w", err)
-		}
-
-		sshListener = &proxyproto.Listener{
-			Listener:          sshListener,
-			Policy:            policy,
-			ReadHeaderTimeout: time.Duration(s.Config.Server.ProxyHeaderTimeout),
-		}
+	s.registerAdminHandlers(mux)
 
-		log.ContextLogger(ctx).Info("Proxy protocol is enabled")
-	}
-
-	fields := log.Fields{
-		"tcp_address": sshListener.Addr().String(),
-	}
+	if s.Config.Server.DrainProbe != "" {
+		mux.HandleFunc(s.Config.Server.DrainProbe, func(w http.ResponseWriter, _ *http.Request) {
+			status := drainStatus{
+				Draining:          s.getStatus() >= StatusOnShutdown,
+				RemainingSessions: s.remainingSessions(),
+			}
 
-	if len(s.serverConfig.cfg.Server.PublicKeyAlgorithms) > 0 {
-		fields["supported_public_key_algorithms"] = s.serverConfig.cfg.Server.PublicKeyAlgorithms
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(status)
+		})
 	}
 
-	log.WithContextFields(ctx, fields).Info("Listening for SSH connections")
-
-	s.listener = sshListener
-
-	return nil
+	return mux
 }
 
 func (s *Server) serve(ctx context.Context) {
 	s.changeStatus(StatusReady)
-
-	for {
-		nconn, err := s.listener.Accept()
-		if err != nil {
-			if s.getStatus() == StatusOnShutdown {
-				break
-			}
-
-			log.ContextLogger(ctx).WithError(err).Warn("Failed to accept connection")
-			continue
-		}
-
-		s.wg.Add(1)
-		go s.handleConn(ctx, nconn)
+	notifyUpgradeParent(ctx)
+
+	var accepting sync.WaitGroup
+	for _, l := range s.getListeners() {
+		accepting.Add(1)
+		go func() {
+			defer accepting.Done()
+			s.acceptConnections(ctx, l)
+		}()
 	}
+	accepting.Wait()
 
 	s.wg.Wait()
 
+	if err := s.auditLog.Close(); err != nil {
+		log.ContextLogger(ctx).WithError(err).Warn("Failed to close audit log")
+	}
+
 	s.changeStatus(StatusClosed)
 }
 
@@ -176,7 +248,62 @@ func (s *Server) getStatus() status {
 	return s.status
 }
 
-func contextWithValues(parent context.Context, nconn net.Conn) context.Context {
+func (s *Server) registerSession(ctx context.Context, sess *session) {
+	s.sessionsMu.Lock()
+	defer s.sessionsMu.Unlock()
+
+	if s.sessions == nil {
+		s.sessions = make(map[*session]context.Context)
+	}
+	s.sessions[sess] = ctx
+}
+
+func (s *Server) unregisterSession(sess *session) {
+	s.sessionsMu.Lock()
+	delete(s.sessions, sess)
+	s.sessionsMu.Unlock()
+
+	select {
+	case s.sessionsChanged <- struct{}{}:
+	default:
+	}
+}
+
+func (s *Server) remainingSessions() int {
+	s.sessionsMu.Lock()
+	defer s.sessionsMu.Unlock()
+
+	return len(s.sessions)
+}
+
+// drainSessions closes the idle sessions. The lock isn't held while they're
+// notified, and they're notified concurrently, so that clients that don't read
+// their channel delay the shutdown by noticeTimeout at most.
+func (s *Server) drainSessions() {
+	var wg sync.WaitGroup
+
+	for sess, ctx := range s.sessionsSnapshot() {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			if sess.drain(ctx) {
+				log.ContextLogger(ctx).Info("server: drainSessions: idle session closed")
+			}
+		}()
+	}
+
+	wg.Wait()
+}
+
+func (s *Server) sessionsSnapshot() map[*session]context.Context {
+	s.sessionsMu.Lock()
+	defer s.sessionsMu.Unlock()
+
+	return maps.Clone(s.sessions)
+}
+
+func contextWithValues(parent context.Context, nconn net.Conn, proxyTLVs []proxyTLV) context.Context {
 	ctx := correlation.ContextWithCorrelation(parent, correlation.SafeRandomID())
 
 	// If we're dealing with a PROXY connection, register the original requester's IP
@@ -184,18 +311,33 @@ func contextWithValues(parent context.Context, nconn net.Conn) context.Context {
 	if ok {
 		ip := gitlabnet.ParseIP(mconn.Raw().RemoteAddr().String())
 		ctx = context.WithValue(ctx, client.OriginalRemoteIPContextKey{}, ip)
+
+		// Reading the header waits for it, so it's only done when TLVs are configured
+		if len(proxyTLVs) > 0 {
+			if tlvs := extractProxyTLVs(mconn.ProxyHeader(), proxyTLVs); tlvs != nil {
+				ctx = context.WithValue(ctx, proxyTLVsContextKey{}, tlvs)
+			}
+		}
 	}
 
 	return ctx
 }
 
-func (s *Server) handleConn(ctx context.Context, nconn net.Conn) {
+func (s *Server) handleConn(ctx context.Context, l *listener, nconn net.Conn) {
 	defer s.wg.Done()
 
+	srvCfg := s.serverConfig.Load()
+
+	// The IP rules of the other connections are checked in the accept loop
+	if l.cfg.ProxyProtocol && rejectConn(ctx, srvCfg.ipRules, l, nconn) {
+		_ = nconn.Close()
+		return
+	}
+
 	metrics.SshdConnectionsInFlight.Inc()
 	defer metrics.SshdConnectionsInFlight.Dec()
 
-	ctx, cancel := context.WithCancel(contextWithValues(ctx, nconn))
+	ctx, cancel := context.WithCancel(contextWithValues(ctx, nconn, srvCfg.proxyTLVs))
 	defer cancel()
 	go func() {
 		<-ctx.Done()
@@ -203,7 +345,13 @@ func (s *Server) handleConn(ctx context.Context, nconn net.Conn) {
 	}()
 
 	remoteAddr := nconn.RemoteAddr().String()
-	ctxlog := log.WithContextFields(ctx, log.Fields{"remote_addr": remoteAddr})
+	ctxlog := log.WithContextFields(ctx, log.Fields{"remote_addr": remoteAddr, "listener": l.cfg.Name})
+
+	// The connection is rejected before the key exchange and the authentication
+	if !s.rateLimiters.allowConn(remoteAddr) {
+		ctxlog.Info("server: handleConn: too many connections from this IP address")
+		return
+	}
 
 	// Prevent a panic in a single connection from taking out the whole server
 	defer func() {
@@ -214,55 +362,69 @@ func (s *Server) handleConn(ctx context.Context, nconn net.Conn) {
 		}
 	}()
 
-	started := time.Now()
-	conn := newConnection(s.Config, nconn)
+	shuttingDown := func() bool { return s.getStatus() >= StatusOnShutdown }
+
+	conn := newConnection(srvCfg.cfg, nconn, s.rateLimiters)
+	conn.shuttingDown = shuttingDown
+	s.registerConnection(ctx, conn)
+	defer s.unregisterConnection(conn)
 
+	// The sessions of the connection run concurrently, and the last one to
+	// complete provides the data of the access log
+	var logDataMu sync.Mutex
 	var ctxWithLogData context.Context
 
-	conn.handle(ctx, s.serverConfig.get(ctx), func(ctx context.Context, sconn *ssh.ServerConn, channel ssh.Channel, requests <-chan *ssh.Request) error {
+	conn.handle(ctx, srvCfg.get(ctx, srvCfg.listenerConfig(l.cfg)), func(ctx context.Context, sconn *ssh.ServerConn, channel ssh.Channel, requests <-chan *ssh.Request) error {
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
 		session := &session{
-			cfg:                 s.Config,
+			cfg:                 srvCfg.cfg,
 			channel:             channel,
 			gitlabKeyID:         sconn.Permissions.Extensions["key-id"],
 			gitlabKrb5Principal: sconn.Permissions.Extensions["krb5principal"],
 			gitlabUsername:      sconn.Permissions.Extensions["username"],
 			namespace:           sconn.Permissions.Extensions["namespace"],
+			forceCommand:        sconn.Permissions.CriticalOptions[forceCommandOption],
+			keyFingerprint:      sconn.Permissions.Extensions[keyFingerprintExtension],
 			remoteAddr:          remoteAddr,
+			proxyTLVs:           proxyTLVsFromContext(ctx),
+			cancel:              cancel,
+			shuttingDown:        shuttingDown,
 			started:             time.Now(),
 		}
 
-		var err error
-		ctxWithLogData, err = session.handle(ctx, requests)
+		s.registerSession(ctx, session)
+		defer s.unregisterSession(session)
+
+		sessionCtx, err := session.handle(ctx, requests)
+
+		logDataMu.Lock()
+		ctxWithLogData = sessionCtx
+		logDataMu.Unlock()
+
+		if auditErr := s.auditLog.Log(session.auditRecord(ctx, extractLogDataFromContext(sessionCtx))); auditErr != nil {
+			log.ContextLogger(ctx).WithError(auditErr).Error("Failed to write audit log record")
+		}
 
 		return err
 	})
 
+	logDataMu.Lock()
 	logData := extractLogDataFromContext(ctxWithLogData)
+	logDataMu.Unlock()
 
-	ctxlog.WithFields(log.Fields{
-		"duration_s":    time.Since(started).Seconds(),
+	fields := log.Fields{
+		"duration_s":    time.Since(conn.started).Seconds(),
 		"written_bytes": logData.WrittenBytes,
+		"read_bytes":    logData.ReadBytes,
 		"meta":          logData.Meta,
-	}).Info("access: finish")
-}
-
-func (s *Server) proxyPolicy() (proxyproto.PolicyFunc, error) {
-	if len(s.Config.Server.ProxyAllowed) > 0 {
-		return proxyproto.StrictWhiteListPolicy(s.Config.Server.ProxyAllowed)
 	}
-
-	// Set the Policy value based on config
-	// Values are taken from https://github.com/pires/go-proxyproto/blob/195fedcfbfc1be163f3a0d507fac1709e9d81fed/policy.go#L20
-	switch strings.ToLower(s.Config.Server.ProxyPolicy) {
-	case "require":
-		return staticProxyPolicy(proxyproto.REQUIRE), nil
-	case "ignore":
-		return staticProxyPolicy(proxyproto.IGNORE), nil
-	case "reject":
-		return staticProxyPolicy(proxyproto.REJECT), nil
-	default:
-		return staticProxyPolicy(proxyproto.USE), nil
+	if tlvs := proxyTLVsFromContext(ctx); tlvs != nil {
+		fields["proxy_tlvs"] = tlvs
 	}
+
+	ctxlog.WithFields(fields).Info("access: finish")
 }
 
 func extractDataFromContext(ctx context.Context) command.LogData {
@@ -292,9 +454,3 @@ func extractLogDataFromContext(ctx context.Context) command.LogData {
 
 	return logData
 }
-
-func staticProxyPolicy(policy proxyproto.Policy) proxyproto.PolicyFunc {
-	return func(_ net.Addr) (proxyproto.Policy, error) {
-		return policy, nil
-	}
-}
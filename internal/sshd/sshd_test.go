@@ -2,7 +2,9 @@ package sshd
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"net/http/httptest"
@@ -12,14 +14,19 @@ import (
 	"time"
 
 	"github.com/pires/go-proxyproto"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"golang.org/x/crypto/ssh"
 
 	"gitlab.com/gitlab-org/gitlab-shell/v14/client/testserver"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/auditlog"
 	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/command"
 	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/config"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/iprules"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/metrics"
 	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/testhelper"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/testhelper/requesthandlers"
 )
 
 const (
@@ -42,7 +49,9 @@ func TestListenAndServe(t *testing.T) {
 	require.NoError(t, s.Shutdown())
 	verifyStatus(t, s, StatusOnShutdown)
 
-	holdSession(t, client)
+	// The established connection can't open sessions that the shutdown wouldn't drain
+	_, err = client.NewSession()
+	require.EqualError(t, err, "ssh: rejected: resource shortage (The server is shutting down. Please try again in a few moments.)")
 
 	_, err = ssh.Dial("tcp", serverURL, clientConfig(t, testRoot))
 	require.Equal(t, "dial tcp 127.0.0.1:50000: connect: connection refused", err.Error())
@@ -215,6 +224,470 @@ func TestListenAndServe_proxyProtocolEnabled(t *testing.T) {
 	}
 }
 
+func TestListenAndServe_ipRules(t *testing.T) {
+	testRoot := testhelper.PrepareTestRootDir(t)
+
+	target, err := net.ResolveTCPAddr("tcp", serverURL)
+	require.NoError(t, err)
+
+	header := &proxyproto.Header{
+		Version:           2,
+		Command:           proxyproto.PROXY,
+		TransportProtocol: proxyproto.TCPv4,
+		SourceAddr: &net.TCPAddr{
+			IP:   net.ParseIP("10.1.1.1"),
+			Port: 1000,
+		},
+		DestinationAddr: target,
+	}
+
+	testCases := []struct {
+		desc          string
+		rules         string
+		proxyProtocol bool
+		reason        string
+	}{
+		{
+			desc:   "denied address",
+			rules:  "deny 127.0.0.0/8\n",
+			reason: iprules.ReasonDenied,
+		},
+		{
+			desc:  "allowed address",
+			rules: "allow 127.0.0.1\n",
+		},
+		{
+			desc:          "denied PROXY address",
+			rules:         "deny 10.1.1.0/24\n",
+			proxyProtocol: true,
+			reason:        iprules.ReasonDenied,
+		},
+		{
+			desc:          "allowed PROXY address",
+			rules:         "allow 10.0.0.0/8\n",
+			proxyProtocol: true,
+		},
+		{
+			desc:          "PROXY address outside of the allowed ranges",
+			rules:         "allow 127.0.0.1\n",
+			proxyProtocol: true,
+			reason:        iprules.ReasonNotAllowed,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			rulesFile := path.Join(t.TempDir(), "ip_rules")
+			require.NoError(t, os.WriteFile(rulesFile, []byte(tc.rules), 0o600))
+
+			if tc.proxyProtocol {
+				xForwardedFor = "127.0.0.1"
+				defer func() { xForwardedFor = "" }()
+			}
+
+			setupServerWithConfig(t, &config.Config{
+				Server: config.ServerConfig{
+					ProxyProtocol: tc.proxyProtocol,
+					IPRulesFile:   rulesFile,
+				},
+			})
+
+			rejected := metrics.SshdRejectedConnectionsTotal.WithLabelValues(serverURL, tc.reason)
+			initialRejected := testutil.ToFloat64(rejected)
+
+			conn, err := net.DialTCP("tcp", nil, target)
+			require.NoError(t, err)
+
+			if tc.proxyProtocol {
+				_, err := header.WriteTo(conn)
+				require.NoError(t, err)
+			}
+
+			sshConn, sshChans, sshRequs, err := ssh.NewClientConn(conn, serverURL, clientConfig(t, testRoot))
+			if sshConn != nil {
+				defer sshConn.Close()
+			}
+
+			if tc.reason != "" {
+				require.Error(t, err)
+				require.InDelta(t, initialRejected+1, testutil.ToFloat64(rejected), 0.1)
+			} else {
+				require.NoError(t, err)
+				client := ssh.NewClient(sshConn, sshChans, sshRequs)
+				defer client.Close()
+
+				holdSession(t, client)
+			}
+		})
+	}
+}
+
+func TestListenAndServe_ipRateLimit(t *testing.T) {
+	_, testRoot := setupServerWithConfig(t, &config.Config{
+		Server: config.ServerConfig{IPRateLimit: config.RateLimitConfig{Rate: 0.001, Burst: 1}},
+	})
+
+	client, err := ssh.Dial("tcp", serverURL, clientConfig(t, testRoot))
+	require.NoError(t, err)
+	defer client.Close()
+
+	initialRateLimited := testutil.ToFloat64(metrics.SshdRateLimitedSessions.WithLabelValues("ip"))
+
+	conn, err := net.Dial("tcp", serverURL)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// The connection is closed before the server sends its version
+	data, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	require.Empty(t, data)
+	require.InDelta(t, initialRateLimited+1, testutil.ToFloat64(metrics.SshdRateLimitedSessions.WithLabelValues("ip")), 0.1)
+}
+
+func TestListenAndServe_multipleListeners(t *testing.T) {
+	const keysOnlyURL = "127.0.0.1:50001"
+
+	s, testRoot := setupServerWithConfig(t, &config.Config{
+		Server: config.ServerConfig{
+			Listeners: []config.ListenerConfig{
+				{Name: "internal", Listen: serverURL},
+				{Name: "kerberos-only", Listen: keysOnlyURL, AuthMethods: []string{"gssapi-with-mic"}},
+			},
+		},
+	})
+
+	client, err := ssh.Dial("tcp", serverURL, clientConfig(t, testRoot))
+	require.NoError(t, err)
+	defer client.Close()
+
+	holdSession(t, client)
+
+	// The key isn't accepted by the listener that only allows Kerberos
+	_, err = ssh.Dial("tcp", keysOnlyURL, clientConfig(t, testRoot))
+	require.ErrorContains(t, err, "ssh: handshake failed")
+
+	require.NoError(t, s.Shutdown())
+
+	for _, addr := range []string{serverURL, keysOnlyURL} {
+		_, err = net.Dial("tcp", addr)
+		require.ErrorContains(t, err, "connection refused")
+	}
+}
+
+func TestListenAndServe_unixSocket(t *testing.T) {
+	socketPath := path.Join(t.TempDir(), "sshd.sock")
+
+	// A socket left behind by a previous process is replaced
+	stale, err := net.Listen("unix", socketPath)
+	require.NoError(t, err)
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	require.NoError(t, stale.Close())
+
+	s, testRoot := setupServerWithConfig(t, &config.Config{
+		Server: config.ServerConfig{
+			Listeners: []config.ListenerConfig{
+				{Name: "haproxy", Listen: "unix:" + socketPath, SocketMode: "0660"},
+			},
+		},
+	})
+
+	fi, err := os.Stat(socketPath)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0o660), fi.Mode().Perm())
+
+	conn, err := net.Dial("unix", socketPath)
+	require.NoError(t, err)
+
+	sshConn, sshChans, sshRequs, err := ssh.NewClientConn(conn, socketPath, clientConfig(t, testRoot))
+	require.NoError(t, err)
+	client := ssh.NewClient(sshConn, sshChans, sshRequs)
+	defer client.Close()
+
+	holdSession(t, client)
+
+	require.NoError(t, s.Shutdown())
+	_, err = os.Stat(socketPath)
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestListenAndServe_systemdSocket(t *testing.T) {
+	tcpListener, err := net.Listen("tcp", serverURL)
+	require.NoError(t, err)
+	f, err := tcpListener.(*net.TCPListener).File()
+	require.NoError(t, err)
+	require.NoError(t, tcpListener.Close())
+
+	systemdSocketsOnce.Do(func() {})
+	systemdSocketsMu.Lock()
+	systemdSockets = map[string]*os.File{"gitlab-sshd": f}
+	systemdSocketsMu.Unlock()
+
+	s, testRoot := setupServerWithConfig(t, &config.Config{
+		Server: config.ServerConfig{
+			Listeners: []config.ListenerConfig{
+				{Name: "activated", Listen: "systemd:gitlab-sshd"},
+			},
+			ReadinessProbe: "/start",
+			LivenessProbe:  "/health",
+		},
+	})
+
+	client, err := ssh.Dial("tcp", serverURL, clientConfig(t, testRoot))
+	require.NoError(t, err)
+	defer client.Close()
+
+	holdSession(t, client)
+
+	r := httptest.NewRecorder()
+	s.MonitoringServeMux().ServeHTTP(r, httptest.NewRequest("GET", "/start", nil))
+	require.Equal(t, http.StatusOK, r.Code)
+	require.JSONEq(t, `{"listeners": [{"name": "activated", "address": "127.0.0.1:50000", "inherited": true}]}`, r.Body.String())
+}
+
+func TestListenAndServe_missingSystemdSocket(t *testing.T) {
+	testRoot := testhelper.PrepareTestRootDir(t)
+
+	cfg := &config.Config{
+		GitlabUrl: "http://localhost",
+		Server: config.ServerConfig{
+			HostKeyFiles: []string{path.Join(testRoot, "certs/valid/server.key")},
+			Listeners:    []config.ListenerConfig{{Listen: "systemd:missing"}},
+		},
+	}
+
+	s, err := NewServer(cfg)
+	require.NoError(t, err)
+
+	err = s.ListenAndServe(context.Background())
+	require.EqualError(t, err, `failed to listen for connection: no socket named "missing" has been passed by systemd`)
+}
+
+func TestReload(t *testing.T) {
+	s, testRoot := setupServer(t)
+
+	client, err := ssh.Dial("tcp", serverURL, clientConfig(t, testRoot))
+	require.NoError(t, err)
+	defer client.Close()
+
+	cfg := &config.Config{GitlabUrl: s.Config.GitlabUrl, User: user, Server: s.Config.Server}
+	cfg.Server.HostKeyFiles = []string{path.Join(testRoot, "certs/valid/server2.key")}
+	require.NoError(t, s.Reload(cfg))
+
+	// Established connections are not affected by the reload
+	holdSession(t, client)
+
+	_, err = ssh.Dial("tcp", serverURL, clientConfig(t, testRoot))
+	require.ErrorContains(t, err, "ssh: host key mismatch")
+
+	keyRaw, err := os.ReadFile(path.Join(testRoot, "certs/valid/server2.pub"))
+	require.NoError(t, err)
+	pKey, _, _, _, err := ssh.ParseAuthorizedKey(keyRaw) //nolint:dogsled
+	require.NoError(t, err)
+
+	clientCfg := clientConfig(t, testRoot)
+	clientCfg.HostKeyCallback = ssh.FixedHostKey(pKey)
+
+	client, err = ssh.Dial("tcp", serverURL, clientCfg)
+	require.NoError(t, err)
+	defer client.Close()
+
+	holdSession(t, client)
+}
+
+func TestReloadWithAuditLogFailure(t *testing.T) {
+	auditLogDir := t.TempDir()
+
+	cfg := &config.Config{}
+	cfg.Server.AuditLog.Output = path.Join(auditLogDir, "audit.log")
+	s, testRoot := setupServerWithConfig(t, cfg)
+
+	// The audit log can't be reopened once its directory is gone
+	require.NoError(t, os.RemoveAll(auditLogDir))
+
+	cfg = &config.Config{GitlabUrl: s.Config.GitlabUrl, User: user, Server: s.Config.Server}
+	cfg.Server.HostKeyFiles = []string{path.Join(testRoot, "certs/valid/server2.key")}
+	require.ErrorContains(t, s.Reload(cfg), "failed to reopen audit log")
+
+	// The current configuration is kept
+	client, err := ssh.Dial("tcp", serverURL, clientConfig(t, testRoot))
+	require.NoError(t, err)
+	defer client.Close()
+}
+
+func TestReloadAuditLogOutput(t *testing.T) {
+	s, testRoot := setupServer(t)
+
+	// An audit log that is disabled at startup is enabled by a reload
+	auditLogFile := path.Join(t.TempDir(), "audit.log")
+	cfg := &config.Config{GitlabUrl: s.Config.GitlabUrl, User: user, Server: s.Config.Server}
+	cfg.Server.AuditLog.Output = auditLogFile
+	require.NoError(t, s.Reload(cfg))
+
+	client, err := ssh.Dial("tcp", serverURL, clientConfig(t, testRoot))
+	require.NoError(t, err)
+	defer client.Close()
+
+	holdSession(t, client)
+
+	require.Eventually(t, func() bool {
+		data, err := os.ReadFile(auditLogFile)
+		return err == nil && len(data) > 0
+	}, 2*time.Second, time.Millisecond)
+}
+
+func TestReloadSessionSettings(t *testing.T) {
+	s, testRoot := setupServer(t)
+
+	client, err := ssh.Dial("tcp", serverURL, clientConfig(t, testRoot))
+	require.NoError(t, err)
+	defer client.Close()
+
+	cfg := &config.Config{GitlabUrl: s.Config.GitlabUrl, User: user, Server: s.Config.Server}
+	cfg.Server.ConcurrentSessionsLimit = 2
+	require.NoError(t, s.Reload(cfg))
+
+	// Established connections keep the limit they were accepted with
+	session, err := client.NewSession()
+	require.NoError(t, err)
+	defer session.Close()
+
+	_, err = client.NewSession()
+	require.ErrorContains(t, err, "too many concurrent sessions")
+
+	client, err = ssh.Dial("tcp", serverURL, clientConfig(t, testRoot))
+	require.NoError(t, err)
+	defer client.Close()
+
+	for i := 0; i < 2; i++ {
+		session, err := client.NewSession()
+		require.NoError(t, err)
+		defer session.Close()
+	}
+}
+
+func TestReloadIPRules(t *testing.T) {
+	rulesFile := path.Join(t.TempDir(), "ip_rules")
+	require.NoError(t, os.WriteFile(rulesFile, []byte("deny 127.0.0.0/8\n"), 0o600))
+
+	s, testRoot := setupServerWithConfig(t, &config.Config{Server: config.ServerConfig{IPRulesFile: rulesFile}})
+
+	_, err := ssh.Dial("tcp", serverURL, clientConfig(t, testRoot))
+	require.Error(t, err)
+
+	// The file is only read again on reload
+	require.NoError(t, os.WriteFile(rulesFile, []byte("allow 127.0.0.1\n"), 0o600))
+
+	_, err = ssh.Dial("tcp", serverURL, clientConfig(t, testRoot))
+	require.Error(t, err)
+
+	require.NoError(t, s.Reload(s.Config))
+
+	client, err := ssh.Dial("tcp", serverURL, clientConfig(t, testRoot))
+	require.NoError(t, err)
+	defer client.Close()
+
+	holdSession(t, client)
+}
+
+func TestReloadKeepsGitalyClient(t *testing.T) {
+	gitalyAddress, _ := testserver.StartGitalyServer(t, "unix")
+
+	cfg := &config.Config{}
+	cfg.GitalyClient.InitSidechannelRegistry(context.Background())
+
+	s, testRoot := setupServerWithContext(context.Background(), t, cfg, requesthandlers.BuildAllowedWithGitalyHandlers(t, gitalyAddress)...)
+
+	require.NoError(t, s.Reload(&config.Config{GitlabUrl: s.Config.GitlabUrl, User: user, Server: s.Config.Server}))
+
+	client, err := ssh.Dial("tcp", serverURL, clientConfig(t, testRoot))
+	require.NoError(t, err)
+	defer client.Close()
+
+	session, err := client.NewSession()
+	require.NoError(t, err)
+	defer session.Close()
+
+	output, err := session.Output("git-upload-pack group/repo")
+	require.NoError(t, err)
+	require.Equal(t, "SSHUploadPackWithSidechannel: group/repo", string(output))
+}
+
+func TestReloadWithInvalidConfig(t *testing.T) {
+	s, testRoot := setupServer(t)
+
+	cfg := &config.Config{GitlabUrl: s.Config.GitlabUrl, User: user, Server: s.Config.Server}
+	cfg.Server.HostKeyFiles = []string{path.Join(testRoot, "certs/invalid-path.key")}
+	require.EqualError(t, s.Reload(cfg), "no host keys could be loaded, aborting")
+
+	client, err := ssh.Dial("tcp", serverURL, clientConfig(t, testRoot))
+	require.NoError(t, err)
+	defer client.Close()
+
+	holdSession(t, client)
+}
+
+func TestShutdownDrainsIdleSessions(t *testing.T) {
+	s, testRoot := setupServer(t)
+
+	client, err := ssh.Dial("tcp", serverURL, clientConfig(t, testRoot))
+	require.NoError(t, err)
+	defer client.Close()
+
+	session, err := client.NewSession()
+	require.NoError(t, err)
+	defer session.Close()
+
+	stderr, err := session.StderrPipe()
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool { return s.remainingSessions() == 1 }, 2*time.Second, time.Millisecond)
+
+	require.NoError(t, s.Shutdown())
+
+	output, err := io.ReadAll(stderr)
+	require.NoError(t, err)
+	require.Contains(t, string(output), "remote: The server is shutting down. Please try again in a few moments.\n")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	require.True(t, s.WaitForSessions(ctx))
+}
+
+func TestDrainSessionsWithStuckClient(t *testing.T) {
+	s := &Server{Config: &config.Config{}}
+
+	channel := newStuckChannel()
+	s.registerSession(context.Background(), &session{channel: channel})
+
+	drained := make(chan struct{})
+	go func() {
+		s.drainSessions()
+		close(drained)
+	}()
+
+	// The sessions aren't locked while the stuck client is notified
+	s.registerSession(context.Background(), &session{channel: newStuckChannel()})
+	require.Equal(t, 2, s.remainingSessions())
+
+	select {
+	case <-drained:
+	case <-time.After(5 * noticeTimeout):
+		require.FailNow(t, "drainSessions is blocked by the client")
+	}
+
+	require.True(t, channel.isClosed())
+}
+
+func TestWaitForSessionsTimeout(t *testing.T) {
+	s := &Server{Config: &config.Config{}}
+	s.registerSession(context.Background(), &session{})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	require.False(t, s.WaitForSessions(ctx))
+}
+
 func TestCorrelationId(t *testing.T) {
 	_, testRoot := setupServer(t)
 
@@ -235,6 +708,47 @@ func TestCorrelationId(t *testing.T) {
 	require.NotEqual(t, previousCorrelationID, correlationID)
 }
 
+func TestAuditLog(t *testing.T) {
+	auditLogFile := path.Join(t.TempDir(), "audit.log")
+
+	cfg := &config.Config{}
+	cfg.Server.AuditLog.Output = auditLogFile
+
+	_, testRoot := setupServerWithConfig(t, cfg)
+
+	clientCfg := clientConfig(t, testRoot)
+	client, err := ssh.Dial("tcp", serverURL, clientCfg)
+	require.NoError(t, err)
+	defer client.Close()
+
+	holdSession(t, client)
+
+	var data []byte
+	require.Eventually(t, func() bool {
+		data, err = os.ReadFile(auditLogFile)
+		return err == nil && len(data) > 0
+	}, 2*time.Second, time.Millisecond)
+
+	var record auditlog.Record
+	require.NoError(t, json.Unmarshal(data, &record))
+
+	key, err := os.ReadFile(path.Join(testRoot, "certs/client/key.pem"))
+	require.NoError(t, err)
+	signer, err := ssh.ParsePrivateKey(key)
+	require.NoError(t, err)
+
+	require.Equal(t, correlationID, record.CorrelationID)
+	require.NotEmpty(t, record.RemoteAddr)
+	require.Equal(t, auditlog.AuthMethodKey, record.AuthMethod)
+	require.Equal(t, ssh.FingerprintSHA256(signer.PublicKey()), record.KeyFingerprint)
+	require.Equal(t, "1000", record.KeyID)
+	require.Equal(t, "test-user", record.Username)
+	require.Equal(t, "discover", record.CommandType)
+	require.Equal(t, uint32(0), record.ExitStatus)
+	require.Equal(t, int64(len("Welcome to GitLab, @test-user!\n")), record.WrittenBytes)
+	require.Positive(t, record.DurationS)
+}
+
 func TestReadinessProbe(t *testing.T) {
 	s := &Server{Config: &config.Config{Server: config.DefaultServerConfig}}
 
@@ -280,6 +794,34 @@ func TestLivenessProbe(t *testing.T) {
 	res.Body.Close()
 }
 
+func TestDrainProbe(t *testing.T) {
+	s := &Server{Config: &config.Config{Server: config.DefaultServerConfig}}
+	s.registerSession(context.Background(), &session{})
+
+	mux := s.MonitoringServeMux()
+
+	req := httptest.NewRequest("GET", "/drain", nil)
+
+	r := httptest.NewRecorder()
+	mux.ServeHTTP(r, req)
+	res := r.Result()
+	require.Equal(t, 200, res.StatusCode)
+	body, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"draining":false,"remaining_sessions":1}`, string(body))
+	res.Body.Close()
+
+	s.changeStatus(StatusOnShutdown)
+
+	r = httptest.NewRecorder()
+	mux.ServeHTTP(r, req)
+	res = r.Result()
+	body, err = io.ReadAll(res.Body)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"draining":true,"remaining_sessions":1}`, string(body))
+	res.Body.Close()
+}
+
 func TestInvalidClientConfig(t *testing.T) {
 	_, testRoot := setupServer(t)
 
@@ -399,7 +941,7 @@ func setupServerWithConfig(t *testing.T, cfg *config.Config) (*Server, string) {
 	return setupServerWithContext(context.Background(), t, cfg)
 }
 
-func setupServerWithContext(ctx context.Context, t *testing.T, cfg *config.Config) (*Server, string) {
+func setupServerWithContext(ctx context.Context, t *testing.T, cfg *config.Config, extraRequests ...testserver.TestRequestHandler) (*Server, string) {
 	t.Helper()
 
 	testRoot := testhelper.PrepareTestRootDir(t)
@@ -425,6 +967,7 @@ func setupServerWithContext(ctx context.Context, t *testing.T, cfg *config.Confi
 			},
 		},
 	}
+	requests = append(requests, extraRequests...)
 
 	url := testserver.StartSocketHTTPServer(t, requests)
 
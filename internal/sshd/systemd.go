@@ -0,0 +1,81 @@
+package sshd
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// Environment variables of systemd socket activation, see sd_listen_fds(3)
+const (
+	listenPIDEnv     = "LISTEN_PID"
+	listenFDsEnv     = "LISTEN_FDS"
+	listenFDNamesEnv = "LISTEN_FDNAMES"
+
+	// listenFDsStart is the first file descriptor passed by systemd
+	listenFDsStart = 3
+	// unknownFDName is the name systemd gives to a socket without FileDescriptorName
+	unknownFDName = "unknown"
+)
+
+var (
+	systemdSocketsOnce sync.Once
+	systemdSocketsMu   sync.Mutex
+	systemdSockets     map[string]*os.File
+)
+
+// takeSystemdSocket returns the socket passed by systemd with the name, which
+// is set by FileDescriptorName in the socket unit. A socket can only be taken
+// once.
+func takeSystemdSocket(name string) (*os.File, bool) {
+	systemdSocketsOnce.Do(func() {
+		systemdSockets = parseSystemdSockets(os.Getenv, listenFDsStart)
+
+		// The sockets must not be passed on to the processes we start
+		_ = os.Unsetenv(listenPIDEnv)
+		_ = os.Unsetenv(listenFDsEnv)
+		_ = os.Unsetenv(listenFDNamesEnv)
+	})
+
+	systemdSocketsMu.Lock()
+	defer systemdSocketsMu.Unlock()
+
+	f, ok := systemdSockets[name]
+	delete(systemdSockets, name)
+
+	return f, ok
+}
+
+func parseSystemdSockets(getenv func(string) string, firstFD int) map[string]*os.File {
+	if getenv(listenPIDEnv) != strconv.Itoa(os.Getpid()) {
+		return nil
+	}
+
+	count, err := strconv.Atoi(getenv(listenFDsEnv))
+	if err != nil || count <= 0 {
+		return nil
+	}
+
+	names := strings.Split(getenv(listenFDNamesEnv), ":")
+	sockets := make(map[string]*os.File, count)
+
+	for i := 0; i < count; i++ {
+		fd := firstFD + i
+		syscall.CloseOnExec(fd)
+
+		name := unknownFDName
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+
+		if _, ok := sockets[name]; ok {
+			continue
+		}
+
+		sockets[name] = os.NewFile(uintptr(fd), name)
+	}
+
+	return sockets
+}
@@ -0,0 +1,75 @@
+package sshd
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSystemdSockets(t *testing.T) {
+	tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer tcpListener.Close()
+
+	f, err := tcpListener.(*net.TCPListener).File()
+	require.NoError(t, err)
+	defer f.Close()
+
+	testCases := []struct {
+		desc          string
+		env           map[string]string
+		expectedNames []string
+	}{
+		{
+			desc:          "no socket activation",
+			env:           map[string]string{},
+			expectedNames: nil,
+		},
+		{
+			desc:          "sockets passed to another process",
+			env:           map[string]string{listenPIDEnv: "1", listenFDsEnv: "1", listenFDNamesEnv: "ssh"},
+			expectedNames: nil,
+		},
+		{
+			desc:          "named socket",
+			env:           map[string]string{listenPIDEnv: strconv.Itoa(os.Getpid()), listenFDsEnv: "1", listenFDNamesEnv: "ssh"},
+			expectedNames: []string{"ssh"},
+		},
+		{
+			desc:          "socket without a name",
+			env:           map[string]string{listenPIDEnv: strconv.Itoa(os.Getpid()), listenFDsEnv: "1"},
+			expectedNames: []string{unknownFDName},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			// The parsed sockets own their file descriptor
+			fd, err := syscall.Dup(int(f.Fd()))
+			require.NoError(t, err)
+
+			getenv := func(key string) string { return tc.env[key] }
+
+			sockets := parseSystemdSockets(getenv, fd)
+			if sockets == nil {
+				require.NoError(t, syscall.Close(fd))
+			}
+
+			var names []string
+			for name, socket := range sockets {
+				names = append(names, name)
+
+				l, err := net.FileListener(socket)
+				require.NoError(t, err)
+				require.Equal(t, tcpListener.Addr().String(), l.Addr().String())
+				require.NoError(t, l.Close())
+				require.NoError(t, socket.Close())
+			}
+			require.Equal(t, tc.expectedNames, names)
+		})
+	}
+}
@@ -0,0 +1,314 @@
+package sshd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+
+	"gitlab.com/gitlab-org/labkit/log"
+)
+
+// upgradeEnv describes the sockets passed to the new process of an upgrade
+const upgradeEnv = "GITLAB_SSHD_UPGRADE"
+
+// upgradeState is passed to the new process in upgradeEnv. The file descriptors
+// are the ones of the new process.
+type upgradeState struct {
+	// Listeners maps the names of the listeners to their socket
+	Listeners map[string]int `json:"listeners"`
+	// MonitoringFD is the socket of the monitoring endpoints, if any
+	MonitoringFD int `json:"monitoring_fd,omitempty"`
+	// ReadyFD is closed by the new process once it accepts connections
+	ReadyFD int `json:"ready_fd"`
+}
+
+// upgradeCommand starts the new binary with the same arguments
+var upgradeCommand = func() *exec.Cmd {
+	return exec.Command(os.Args[0], os.Args[1:]...) //nolint:gosec
+}
+
+var (
+	inheritedUpgradeOnce sync.Once
+	inheritedUpgradeMu   sync.Mutex
+	inheritedUpgrade     *upgradeState
+)
+
+func loadInheritedUpgrade() {
+	inheritedUpgradeOnce.Do(func() {
+		inheritedUpgrade = parseUpgradeState(os.Getenv(upgradeEnv))
+
+		// The sockets must not be passed on to the processes we start
+		_ = os.Unsetenv(upgradeEnv)
+	})
+}
+
+func parseUpgradeState(value string) *upgradeState {
+	if value == "" {
+		return nil
+	}
+
+	var state upgradeState
+	if err := json.Unmarshal([]byte(value), &state); err != nil {
+		log.WithError(err).Warn("Failed to parse the sockets passed by the previous process")
+		return nil
+	}
+
+	for _, fd := range state.Listeners {
+		syscall.CloseOnExec(fd)
+	}
+	if state.MonitoringFD != 0 {
+		syscall.CloseOnExec(state.MonitoringFD)
+	}
+	syscall.CloseOnExec(state.ReadyFD)
+
+	return &state
+}
+
+// takeUpgradeSocket returns the socket of the listener passed by the previous
+// process of an upgrade
+func takeUpgradeSocket(name string) (*os.File, bool) {
+	loadInheritedUpgrade()
+
+	inheritedUpgradeMu.Lock()
+	defer inheritedUpgradeMu.Unlock()
+
+	if inheritedUpgrade == nil {
+		return nil, false
+	}
+
+	fd, ok := inheritedUpgrade.Listeners[name]
+	if !ok {
+		return nil, false
+	}
+	delete(inheritedUpgrade.Listeners, name)
+
+	return os.NewFile(uintptr(fd), name), true
+}
+
+func takeUpgradeMonitoringSocket() (*os.File, bool) {
+	loadInheritedUpgrade()
+
+	inheritedUpgradeMu.Lock()
+	defer inheritedUpgradeMu.Unlock()
+
+	if inheritedUpgrade == nil || inheritedUpgrade.MonitoringFD == 0 {
+		return nil, false
+	}
+
+	fd := inheritedUpgrade.MonitoringFD
+	inheritedUpgrade.MonitoringFD = 0
+
+	return os.NewFile(uintptr(fd), "monitoring"), true
+}
+
+// notifyUpgradeParent tells the previous process of an upgrade that the
+// connections are accepted, so it can stop accepting them
+func notifyUpgradeParent(ctx context.Context) {
+	loadInheritedUpgrade()
+
+	inheritedUpgradeMu.Lock()
+	defer inheritedUpgradeMu.Unlock()
+
+	if inheritedUpgrade == nil || inheritedUpgrade.ReadyFD == 0 {
+		return
+	}
+
+	ready := os.NewFile(uintptr(inheritedUpgrade.ReadyFD), "ready")
+	inheritedUpgrade.ReadyFD = 0
+
+	if _, err := ready.Write([]byte{1}); err != nil {
+		log.ContextLogger(ctx).WithError(err).Warn("Failed to notify the previous process")
+	}
+	_ = ready.Close()
+}
+
+// ListenMonitoring opens the socket of the monitoring endpoints, or takes it
+// from the previous process of an upgrade
+func (s *Server) ListenMonitoring(addr string) (net.Listener, error) {
+	var l net.Listener
+	var err error
+
+	if f, ok := takeUpgradeMonitoringSocket(); ok {
+		l, err = net.FileListener(f)
+		_ = f.Close()
+	} else {
+		l, err = net.Listen("tcp", addr)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	s.statusMu.Lock()
+	s.monitoringListener = l
+	s.statusMu.Unlock()
+
+	return l, nil
+}
+
+// Upgrade starts the binary again, passing it the listening sockets, and waits
+// until the new process accepts connections. Once it returns successfully, the
+// server must be shut down to stop accepting connections and drain the sessions.
+// If the new process fails to start, it's killed and the server keeps serving.
+func (s *Server) Upgrade(ctx context.Context) error {
+	if !s.upgrading.CompareAndSwap(false, true) {
+		return errors.New("an upgrade is already in progress")
+	}
+	defer s.upgrading.Store(false)
+
+	if s.getStatus() != StatusReady {
+		return errors.New("the server isn't accepting connections")
+	}
+
+	var files []*os.File
+	closeFiles := func() {
+		for _, f := range files {
+			_ = f.Close()
+		}
+		files = nil
+	}
+	defer closeFiles()
+
+	// The files are passed as file descriptors 3 and up
+	addFile := func(f *os.File) int {
+		files = append(files, f)
+		return 2 + len(files)
+	}
+
+	state := upgradeState{Listeners: map[string]int{}}
+
+	for _, l := range s.getListeners() {
+		f, err := listenerFile(l.raw)
+		if err != nil {
+			return fmt.Errorf("failed to pass listener %q: %w", l.cfg.Name, err)
+		}
+		state.Listeners[l.cfg.Name] = addFile(f)
+	}
+
+	s.statusMu.RLock()
+	monitoringListener := s.monitoringListener
+	s.statusMu.RUnlock()
+
+	if monitoringListener != nil {
+		f, err := listenerFile(monitoringListener)
+		if err != nil {
+			return fmt.Errorf("failed to pass the monitoring listener: %w", err)
+		}
+		state.MonitoringFD = addFile(f)
+	}
+
+	readyReader, readyWriter, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = readyReader.Close() }()
+	state.ReadyFD = addFile(readyWriter)
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	cmd := upgradeCommand()
+	cmd.Env = append(os.Environ(), upgradeEnv+"="+string(data))
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = files
+
+	err = cmd.Start()
+
+	// Passing the sockets puts them in blocking mode, which they share with
+	// our listeners, whose Accept would then block Close
+	for _, l := range s.getListeners() {
+		restoreNonblock(ctx, l.raw)
+	}
+	if monitoringListener != nil {
+		restoreNonblock(ctx, monitoringListener)
+	}
+
+	if err != nil {
+		return fmt.Errorf("failed to start the new process: %w", err)
+	}
+
+	// The new process has its own copies, and the ready pipe is only closed
+	// once our copy of the writer is
+	closeFiles()
+
+	ctxlog := log.WithContextFields(ctx, log.Fields{"pid": cmd.Process.Pid})
+	ctxlog.Info("Waiting for the new process to accept connections")
+
+	if err := waitForReady(readyReader, time.Duration(s.Config.Server.UpgradeTimeout)); err != nil {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+
+		return fmt.Errorf("the new process failed to accept connections: %w", err)
+	}
+
+	_ = cmd.Process.Release()
+
+	// The sockets of the Unix domain listeners are used by the new process
+	for _, l := range s.getListeners() {
+		if unixListener, ok := l.raw.(*net.UnixListener); ok {
+			unixListener.SetUnlinkOnClose(false)
+		}
+	}
+	s.upgraded.Store(true)
+
+	ctxlog.Info("The new process accepts connections")
+
+	return nil
+}
+
+func listenerFile(l net.Listener) (*os.File, error) {
+	filer, ok := l.(interface{ File() (*os.File, error) })
+	if !ok {
+		return nil, fmt.Errorf("%T can't be passed to another process", l)
+	}
+
+	return filer.File()
+}
+
+func restoreNonblock(ctx context.Context, l net.Listener) {
+	conn, ok := l.(syscall.Conn)
+	if !ok {
+		return
+	}
+
+	rawConn, err := conn.SyscallConn()
+	if err == nil {
+		err = rawConn.Control(func(fd uintptr) {
+			err = syscall.SetNonblock(int(fd), true)
+		})
+	}
+
+	if err != nil {
+		log.ContextLogger(ctx).WithError(err).Warn("Failed to put the listener back in non-blocking mode")
+	}
+}
+
+func waitForReady(ready *os.File, timeout time.Duration) error {
+	if timeout > 0 {
+		if err := ready.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+			return err
+		}
+	}
+
+	buf := make([]byte, 1)
+	if _, err := ready.Read(buf); err != nil {
+		if errors.Is(err, io.EOF) {
+			return errors.New("the process exited")
+		}
+
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,133 @@
+package sshd
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/config"
+)
+
+const (
+	upgradeHelperEnv    = "GITLAB_SSHD_TEST_UPGRADE_HELPER"
+	upgradeGitlabURLEnv = "GITLAB_SSHD_TEST_GITLAB_URL"
+	upgradeTestRootEnv  = "GITLAB_SSHD_TEST_ROOT"
+)
+
+func TestUpgrade(t *testing.T) {
+	s, testRoot := setupServerWithConfig(t, &config.Config{
+		Server: config.ServerConfig{ReadinessProbe: "/start", LivenessProbe: "/health", UpgradeTimeout: config.YamlDuration(10 * time.Second)},
+	})
+
+	t.Setenv(upgradeHelperEnv, "1")
+	t.Setenv(upgradeGitlabURLEnv, s.Config.GitlabUrl)
+	t.Setenv(upgradeTestRootEnv, testRoot)
+
+	// The new process exits when its stdin is closed
+	stdinReader, stdinWriter, err := os.Pipe()
+	require.NoError(t, err)
+	defer stdinReader.Close()
+	t.Cleanup(func() {
+		stdinWriter.Close()
+
+		// Wait for the new process to release the address
+		require.Eventually(t, func() bool {
+			conn, err := net.Dial("tcp", serverURL)
+			if err == nil {
+				conn.Close()
+			}
+			return err != nil
+		}, 10*time.Second, 10*time.Millisecond)
+	})
+
+	stubUpgradeCommand(t, func() *exec.Cmd {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestUpgradeHelperProcess$")
+		cmd.Stdin = stdinReader
+		return cmd
+	})
+
+	client, err := ssh.Dial("tcp", serverURL, clientConfig(t, testRoot))
+	require.NoError(t, err)
+	defer client.Close()
+
+	require.NoError(t, s.Upgrade(context.Background()))
+	require.NoError(t, s.Shutdown())
+
+	// The connections of this process don't open new sessions anymore
+	_, err = client.NewSession()
+	require.EqualError(t, err, "ssh: rejected: resource shortage (The server is shutting down. Please try again in a few moments.)")
+
+	// The new process accepts the connections
+	newClient, err := ssh.Dial("tcp", serverURL, clientConfig(t, testRoot))
+	require.NoError(t, err)
+	defer newClient.Close()
+
+	holdSession(t, newClient)
+
+	r := httptest.NewRecorder()
+	s.MonitoringServeMux().ServeHTTP(r, httptest.NewRequest("GET", "/start", nil))
+	require.Equal(t, http.StatusOK, r.Code)
+}
+
+func TestUpgradeFailure(t *testing.T) {
+	s, testRoot := setupServer(t)
+
+	stubUpgradeCommand(t, func() *exec.Cmd {
+		return exec.Command("false")
+	})
+
+	err := s.Upgrade(context.Background())
+	require.EqualError(t, err, "the new process failed to accept connections: the process exited")
+
+	// The server keeps accepting connections
+	client, err := ssh.Dial("tcp", serverURL, clientConfig(t, testRoot))
+	require.NoError(t, err)
+	defer client.Close()
+
+	holdSession(t, client)
+}
+
+// TestUpgradeHelperProcess is the new process started by TestUpgrade
+func TestUpgradeHelperProcess(t *testing.T) {
+	if os.Getenv(upgradeHelperEnv) != "1" {
+		t.Skip("only run as the new process of an upgrade")
+	}
+
+	testRoot := os.Getenv(upgradeTestRootEnv)
+	cfg := &config.Config{
+		GitlabUrl: os.Getenv(upgradeGitlabURLEnv),
+		RootDir:   "/tmp",
+		User:      user,
+		Server: config.ServerConfig{
+			Listen:                  serverURL,
+			ConcurrentSessionsLimit: 1,
+			HostKeyFiles:            []string{path.Join(testRoot, "certs/valid/server.key")},
+		},
+	}
+
+	s, err := NewServer(cfg)
+	require.NoError(t, err)
+
+	go func() {
+		_, _ = io.Copy(io.Discard, os.Stdin)
+		os.Exit(0)
+	}()
+
+	require.NoError(t, s.ListenAndServe(context.Background()))
+}
+
+func stubUpgradeCommand(t *testing.T, command func() *exec.Cmd) {
+	original := upgradeCommand
+	upgradeCommand = command
+	t.Cleanup(func() { upgradeCommand = original })
+}
@@ -0,0 +1,151 @@
+package sshd
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/command/commandargs"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/config"
+)
+
+const (
+	timeoutReasonIdle        = "idle"
+	timeoutReasonMaxDuration = "max_duration"
+)
+
+// commandTimeoutError is returned when a command has been terminated by its watchdog
+type commandTimeoutError struct {
+	reason  string
+	timeout time.Duration
+}
+
+func (e *commandTimeoutError) Error() string {
+	if e.reason == timeoutReasonIdle {
+		return fmt.Sprintf("The command has been terminated because no data was transferred for %v.", e.timeout)
+	}
+
+	return fmt.Sprintf("The command has been terminated because it ran for longer than %v.", e.timeout)
+}
+
+// commandWatchdog terminates a command that runs for longer than the maximum
+// duration of its type, or that doesn't read from or write to the client for
+// longer than the idle timeout
+type commandWatchdog struct {
+	maxDuration time.Duration
+	idleTimeout time.Duration
+	onTimeout   func(*commandTimeoutError)
+
+	lastActivity atomic.Int64
+	timedOut     atomic.Pointer[commandTimeoutError]
+
+	mu      sync.Mutex
+	stopped bool
+	timers  []*time.Timer
+}
+
+func newCommandWatchdog(cfg config.CommandTimeoutsConfig, commandType commandargs.CommandType, onTimeout func(*commandTimeoutError)) *commandWatchdog {
+	return &commandWatchdog{
+		maxDuration: time.Duration(cfg.MaxDuration[string(commandType)]),
+		idleTimeout: time.Duration(cfg.IdleTimeout),
+		onTimeout:   onTimeout,
+	}
+}
+
+// start arms the timers. stop must be called once the command is done.
+func (w *commandWatchdog) start() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.maxDuration > 0 {
+		w.timers = append(w.timers, time.AfterFunc(w.maxDuration, func() {
+			w.fire(timeoutReasonMaxDuration, w.maxDuration)
+		}))
+	}
+
+	if w.idleTimeout > 0 {
+		w.touch()
+
+		var idleTimer *time.Timer
+		idleTimer = time.AfterFunc(w.idleTimeout, func() {
+			idle := time.Since(time.Unix(0, w.lastActivity.Load()))
+			if idle >= w.idleTimeout {
+				w.fire(timeoutReasonIdle, w.idleTimeout)
+				return
+			}
+
+			w.mu.Lock()
+			defer w.mu.Unlock()
+			if !w.stopped {
+				idleTimer.Reset(w.idleTimeout - idle)
+			}
+		})
+		w.timers = append(w.timers, idleTimer)
+	}
+}
+
+func (w *commandWatchdog) stop() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.stopped = true
+	for _, timer := range w.timers {
+		timer.Stop()
+	}
+}
+
+func (w *commandWatchdog) fire(reason string, timeout time.Duration) {
+	err := &commandTimeoutError{reason: reason, timeout: timeout}
+	if w.timedOut.CompareAndSwap(nil, err) {
+		w.onTimeout(err)
+	}
+}
+
+// err returns why the command has been terminated, or nil
+func (w *commandWatchdog) err() *commandTimeoutError {
+	return w.timedOut.Load()
+}
+
+func (w *commandWatchdog) touch() {
+	w.lastActivity.Store(time.Now().UnixNano())
+}
+
+// reader records the reads from the client as activity
+func (w *commandWatchdog) reader(r io.Reader) io.Reader {
+	return &watchedReader{r: r, watchdog: w}
+}
+
+// writer records the writes to the client as activity
+func (w *commandWatchdog) writer(wr io.Writer) io.Writer {
+	return &watchedWriter{w: wr, watchdog: w}
+}
+
+type watchedReader struct {
+	r        io.Reader
+	watchdog *commandWatchdog
+}
+
+func (wr *watchedReader) Read(p []byte) (int, error) {
+	n, err := wr.r.Read(p)
+	if n > 0 {
+		wr.watchdog.touch()
+	}
+
+	return n, err
+}
+
+type watchedWriter struct {
+	w        io.Writer
+	watchdog *commandWatchdog
+}
+
+func (ww *watchedWriter) Write(p []byte) (int, error) {
+	n, err := ww.w.Write(p)
+	if n > 0 {
+		ww.watchdog.touch()
+	}
+
+	return n, err
+}
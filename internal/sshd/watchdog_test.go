@@ -0,0 +1,126 @@
+package sshd
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/command/commandargs"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/config"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/metrics"
+)
+
+func TestCommandWatchdogMaxDuration(t *testing.T) {
+	cfg := config.CommandTimeoutsConfig{
+		MaxDuration: map[string]config.YamlDuration{
+			string(commandargs.UploadPack): config.YamlDuration(time.Millisecond),
+		},
+	}
+
+	timedOut := make(chan *commandTimeoutError, 1)
+	w := newCommandWatchdog(cfg, commandargs.UploadPack, func(err *commandTimeoutError) { timedOut <- err })
+	w.start()
+	defer w.stop()
+
+	err := <-timedOut
+	require.Equal(t, timeoutReasonMaxDuration, err.reason)
+	require.Equal(t, err, w.err())
+	require.EqualError(t, err, "The command has been terminated because it ran for longer than 1ms.")
+
+	// Other command types aren't limited
+	other := newCommandWatchdog(cfg, commandargs.ReceivePack, func(*commandTimeoutError) { t.Fatal("unexpected timeout") })
+	other.start()
+	time.Sleep(5 * time.Millisecond)
+	other.stop()
+	require.Nil(t, other.err())
+}
+
+func TestCommandWatchdogIdle(t *testing.T) {
+	cfg := config.CommandTimeoutsConfig{IdleTimeout: config.YamlDuration(50 * time.Millisecond)}
+
+	timedOut := make(chan *commandTimeoutError, 1)
+	w := newCommandWatchdog(cfg, commandargs.UploadPack, func(err *commandTimeoutError) { timedOut <- err })
+
+	out := w.writer(io.Discard)
+	in := w.reader(bytes.NewReader(bytes.Repeat([]byte("x"), 10)))
+
+	started := time.Now()
+	w.start()
+	defer w.stop()
+
+	// Reads and writes keep the command alive
+	for i := 0; i < 5; i++ {
+		time.Sleep(20 * time.Millisecond)
+		if i%2 == 0 {
+			_, err := out.Write([]byte("data"))
+			require.NoError(t, err)
+		} else {
+			_, err := in.Read(make([]byte, 1))
+			require.NoError(t, err)
+		}
+	}
+	require.Nil(t, w.err())
+
+	err := <-timedOut
+	require.GreaterOrEqual(t, time.Since(started), 150*time.Millisecond)
+	require.Equal(t, timeoutReasonIdle, err.reason)
+	require.EqualError(t, err, "The command has been terminated because no data was transferred for 50ms.")
+}
+
+func TestCommandWatchdogStopped(t *testing.T) {
+	cfg := config.CommandTimeoutsConfig{IdleTimeout: config.YamlDuration(time.Millisecond)}
+
+	w := newCommandWatchdog(cfg, commandargs.UploadPack, func(*commandTimeoutError) { t.Fatal("unexpected timeout") })
+	w.start()
+	w.stop()
+
+	time.Sleep(5 * time.Millisecond)
+	require.Nil(t, w.err())
+}
+
+func TestTerminateCommand(t *testing.T) {
+	stdErr := &bytes.Buffer{}
+	s := &session{
+		channel:     &fakeChannel{stdErr: stdErr, stdOut: &bytes.Buffer{}},
+		commandType: commandargs.UploadPack,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	timeouts := testutil.ToFloat64(metrics.SshdCommandTimeoutsTotal.WithLabelValues(string(commandargs.UploadPack), timeoutReasonIdle))
+
+	s.terminateCommand(context.Background(), cancel, &commandTimeoutError{reason: timeoutReasonIdle, timeout: time.Minute})
+
+	require.ErrorIs(t, ctx.Err(), context.Canceled)
+	require.Contains(t, stdErr.String(), "ERROR: The command has been terminated because no data was transferred for 1m0s.")
+	require.InDelta(t, timeouts+1, testutil.ToFloat64(metrics.SshdCommandTimeoutsTotal.WithLabelValues(string(commandargs.UploadPack), timeoutReasonIdle)), 0.1)
+}
+
+func TestTerminateCommandWithStuckClient(t *testing.T) {
+	channel := newStuckChannel()
+	s := &session{channel: channel, commandType: commandargs.UploadPack}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	terminated := make(chan struct{})
+	go func() {
+		s.terminateCommand(context.Background(), cancel, &commandTimeoutError{reason: timeoutReasonMaxDuration, timeout: time.Minute})
+		close(terminated)
+	}()
+
+	select {
+	case <-terminated:
+	case <-time.After(5 * noticeTimeout):
+		require.FailNow(t, "terminateCommand is blocked by the client")
+	}
+
+	require.ErrorIs(t, ctx.Err(), context.Canceled)
+	require.True(t, channel.isClosed())
+}
@@ -3,6 +3,7 @@ package sshenv
 
 import (
 	"os"
+	"path"
 	"strings"
 )
 
@@ -22,6 +23,22 @@ type Env struct {
 	OriginalCommand    string
 	RemoteAddr         string
 	NamespacePath      string
+	// ClientEnv holds the variables sent by the client that are in the accepted list
+	ClientEnv map[string]string
+	// ProxyTLVs holds the configured PROXY protocol v2 TLVs of the connection
+	ProxyTLVs map[string]string
+}
+
+// IsAccepted tells whether the variable name matches one of the patterns.
+// Patterns may contain the * and ? wildcards, such as GL_*.
+func IsAccepted(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if matched, err := path.Match(pattern, name); err == nil && matched {
+			return true
+		}
+	}
+
+	return false
 }
 
 // NewFromEnv creates a new Env instance based on the current environment variables
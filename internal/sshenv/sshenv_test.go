@@ -39,6 +39,29 @@ func TestNewFromEnv(t *testing.T) {
 	}
 }
 
+func TestIsAccepted(t *testing.T) {
+	patterns := []string{"LANG", "GL_*"}
+
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{name: "LANG", want: true},
+		{name: "GL_FEATURE_HINT", want: true},
+		{name: "GL_", want: true},
+		{name: "LANGUAGE", want: false},
+		{name: "GIT_TRACE2_PARENT_SID", want: false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			require.Equal(t, tc.want, IsAccepted(patterns, tc.name))
+		})
+	}
+
+	require.False(t, IsAccepted(nil, "LANG"))
+}
+
 func TestRemoteAddrFromEnv(t *testing.T) {
 	t.Setenv(SSHConnectionEnv, "127.0.0.1 0")
 